@@ -0,0 +1,202 @@
+// xault-wordlist builds a word list for xcrypt's recovery phrases from a dictionary of candidate
+// words, or checks an existing word list.  Recovery phrases can only fix misspellings if every pair
+// of words, including the version words, is at least edit distance two apart, so this picks as
+// many candidates as it can that keep that guarantee.
+//
+// go run main.go -dict candidates.txt -out words.txt -report report.txt
+// go run main.go -dict words.txt -check
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+var dictPath = flag.String("dict", "", "path of the dictionary of candidate words, separated by whitespace")
+var versionsPath = flag.String("versions", "", "path of the versions file whose version words are excluded, defaults to xcrypt's own")
+var minDistance = flag.Int("distance", 2, "minimum edit distance between words, use 3 for stronger correction")
+var minLength = flag.Int("min-length", 3, "minimum length of a word")
+var maxLength = flag.Int("max-length", 12, "maximum length of a word")
+var size = flag.Int("size", 0, "number of words to keep, or 0 to keep every word that was selected")
+var outPath = flag.String("out", "words.txt", "path of the output word list")
+var reportPath = flag.String("report", "", "path of the report, defaults to stdout")
+var check = flag.Bool("check", false, "check the dictionary as a word list instead of selecting words from it")
+
+// phraseBits is the entropy that the report says how many words are needed for, it's the same as
+// what the app uses.
+const phraseBits = 128
+
+func main() {
+	flag.Parse()
+	if *dictPath == "" {
+		fmt.Printf("-dict is required\n")
+		os.Exit(1)
+	}
+	if *minDistance < 1 {
+		fmt.Printf("-distance must be at least 1\n")
+		os.Exit(1)
+	}
+	data, err := ioutil.ReadFile(*dictPath)
+	if err != nil {
+		fmt.Printf("unable to read dictionary: %v\n", err)
+		os.Exit(1)
+	}
+	versionWords := xcrypt.DefaultKeyMaker().VersionWords()
+	if *versionsPath != "" {
+		versionWords, err = xcrypt.ReadVersionWords(*versionsPath)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var report bytes.Buffer
+	var ok bool
+	if *check {
+		ok = checkList(&report, strings.Fields(string(data)), versionWords)
+	} else {
+		ok = buildList(&report, strings.Fields(string(data)), versionWords)
+	}
+
+	if *reportPath == "" {
+		os.Stdout.Write(report.Bytes())
+	} else if err := ioutil.WriteFile(*reportPath, report.Bytes(), 0644); err != nil {
+		fmt.Printf("unable to write report: %v\n", err)
+		os.Exit(1)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// buildList selects words from the candidates and writes them to -out.  It returns false if that
+// wasn't possible.
+func buildList(report io.Writer, candidates, versionWords []string) bool {
+	var valid []string
+	seen := make(map[string]bool)
+	var duplicates, invalid, badLength, nearVersion int
+	for _, word := range candidates {
+		word = strings.ToLower(word)
+		switch {
+		case seen[word]:
+			duplicates++
+		case !isLetters(word):
+			invalid++
+		case len(word) < *minLength || len(word) > *maxLength:
+			badLength++
+		case nearVersionWord(word, versionWords):
+			nearVersion++
+		default:
+			valid = append(valid, word)
+		}
+		seen[word] = true
+	}
+	fmt.Fprintf(report, "candidates: %d\n", len(candidates))
+	fmt.Fprintf(report, "duplicates: %d\n", duplicates)
+	fmt.Fprintf(report, "not only the letters a-z: %d\n", invalid)
+	fmt.Fprintf(report, "shorter than %d or longer than %d letters: %d\n", *minLength, *maxLength, badLength)
+	fmt.Fprintf(report, "within edit distance %d of a version word: %d\n", *minDistance-1, nearVersion)
+
+	words := xcrypt.SelectWords(valid, versionWords, *minDistance)
+	fmt.Fprintf(report, "too close to another selected word: %d\n", len(valid)-len(words))
+	if *size > 0 {
+		if len(words) < *size {
+			fmt.Fprintf(report, "only %d words could be selected, but -size is %d\n", len(words), *size)
+			return false
+		}
+		words = words[:*size]
+	}
+	if len(words) <= 1 {
+		fmt.Fprintf(report, "not enough words could be selected\n")
+		return false
+	}
+	reportList(report, words)
+	if err := ioutil.WriteFile(*outPath, []byte(strings.Join(words, "\n")+"\n"), 0644); err != nil {
+		fmt.Fprintf(report, "unable to write word list: %v\n", err)
+		return false
+	}
+	fmt.Fprintf(report, "wrote %s\n", *outPath)
+	return true
+}
+
+// checkList reports on words as an existing word list.  It returns false if the list isn't one that
+// xcrypt would load, or doesn't meet -distance.  The pairs of words that xcrypt allows to be close
+// because existing phrases use them are reported, but only fail the check if -distance is more than
+// two.
+func checkList(report io.Writer, words, versionWords []string) bool {
+	for i := range words {
+		words[i] = strings.ToLower(words[i])
+	}
+	if len(words) <= 1 {
+		fmt.Fprintf(report, "not enough words\n")
+		return false
+	}
+	reportList(report, words)
+	ok := true
+	if err := xcrypt.CheckWordDistances(words); err != nil {
+		fmt.Fprintf(report, "FAIL: %v\n", err)
+		ok = false
+	}
+	for _, pair := range xcrypt.KnownClosePairs(words) {
+		fmt.Fprintf(report, "known exception: %s and %s are edit distance %d apart, but phrases already use them\n", pair[0], pair[1], xcrypt.EditDistance(pair[0], pair[1]))
+	}
+	if _, dist := xcrypt.MinEditDistance(words); *minDistance > 2 && dist < *minDistance {
+		fmt.Fprintf(report, "FAIL: words must be at least edit distance %d apart\n", *minDistance)
+		ok = false
+	}
+	for _, word := range words {
+		if !isLetters(word) {
+			fmt.Fprintf(report, "FAIL: %q isn't only the letters a-z\n", word)
+			ok = false
+		}
+		if nearVersionWord(word, versionWords) {
+			fmt.Fprintf(report, "FAIL: %q is within edit distance %d of a version word\n", word, *minDistance-1)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// reportList reports the entropy and edit distances of a word list.
+func reportList(report io.Writer, words []string) {
+	bits := math.Log2(float64(len(words)))
+	fmt.Fprintf(report, "words: %d\n", len(words))
+	fmt.Fprintf(report, "entropy: %.2f bits per word, %d words for %d bits\n", bits, int(math.Ceil(phraseBits/bits)), phraseBits)
+	closest, dist := xcrypt.MinEditDistance(words)
+	fmt.Fprintf(report, "minimum edit distance: %d, for %d words\n", dist, len(closest))
+	if len(closest) <= maxClosestReported {
+		fmt.Fprintf(report, "closest words: %s\n", strings.Join(closest, " "))
+	}
+}
+
+// maxClosestReported is the most closest words that the report lists.
+const maxClosestReported = 20
+
+func isLetters(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, c := range word {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func nearVersionWord(word string, versionWords []string) bool {
+	for _, versionWord := range versionWords {
+		if xcrypt.EditDistance(word, versionWord) < *minDistance {
+			return true
+		}
+	}
+	return false
+}
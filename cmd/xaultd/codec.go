@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/runningwild/xault/shared/api"
+)
+
+// serverCodec is an rpc.ServerCodec that speaks the same gob encoding as rpc.ServeConn, so any
+// rpc.Client can talk to it, and logs a line for every request once its response has been sent.
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	conn   uint64
+
+	// The rpc server reads every request's header and then its body before reading the next one,
+	// so reading is the request whose body is about to be read.  Responses can be sent from other
+	// goroutines, in any order, so mu protects requests, which is every request that's been read
+	// and hasn't been responded to yet by sequence number, and what's in them.
+	reading  *requestInfo
+	mu       sync.Mutex
+	requests map[uint64]*requestInfo
+}
+
+// requestInfo is what's logged about a request.
+type requestInfo struct {
+	id    string
+	start time.Time
+}
+
+func makeServerCodec(rwc io.ReadWriteCloser, conn uint64) *serverCodec {
+	buf := bufio.NewWriter(rwc)
+	return &serverCodec{
+		rwc:      rwc,
+		dec:      gob.NewDecoder(rwc),
+		enc:      gob.NewEncoder(buf),
+		encBuf:   buf,
+		conn:     conn,
+		requests: make(map[uint64]*requestInfo),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.reading = &requestInfo{start: time.Now()}
+	c.mu.Lock()
+	c.requests[r.Seq] = c.reading
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.reading.id = requestId(body)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	c.mu.Lock()
+	info := c.requests[r.Seq]
+	delete(c.requests, r.Seq)
+	c.mu.Unlock()
+	if info == nil {
+		info = &requestInfo{start: time.Now()}
+	}
+	errStr := r.Error
+	if err != nil {
+		errStr = "unable to send response: " + err.Error()
+	}
+	log.Printf("event=request conn=%d method=%s seq=%d id=%q duration=%s error=%q", c.conn, r.ServiceMethod, r.Seq, info.id, time.Since(info.start), errStr)
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+func (c *serverCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// requestId returns the id of the user that body, the body of a request, was sent by, or "" if
+// it isn't a request that has one.
+func requestId(body interface{}) string {
+	switch req := body.(type) {
+	case *api.MakeIdRequest:
+		return req.Id
+	case *api.MakeIdChallengeResponse:
+		return req.Id
+	case *api.AddContactRequest:
+		return req.Id
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+// xaultd runs the xault server.  It loads the server's private key from the private.key that
+// secure/gen.go writes, keeps everything it knows about its users in the store directory, and serves
+// the Xault rpc service over TCP and, optionally, a unix socket.  On SIGTERM or SIGINT it stops
+// accepting connections, lets the requests that are in progress finish, and closes the store.
+//
+// Every request is logged as a line of key=value pairs.
+//
+// go run main.go codec.go -key ../../secure/private.key -store /var/lib/xaultd -listen :9900
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/runningwild/xault/server"
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+var keyPath = flag.String("key", "private.key", "path of the server's private key, as written by secure/gen.go")
+var storeDir = flag.String("store", "xaultd-store", "directory that the server's state is kept in")
+var listenAddr = flag.String("listen", ":9900", "TCP address to listen on")
+var unixPath = flag.String("unix", "", "path of a unix socket to also listen on, if any")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for requests in progress when shutting down")
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.LUTC)
+	keys, err := loadKey(*keyPath)
+	if err != nil {
+		log.Fatalf("event=start error=%q", err.Error())
+	}
+	store, err := server.OpenLogStore(*storeDir)
+	if err != nil {
+		log.Fatalf("event=start error=%q", fmt.Sprintf("unable to open store: %v", err))
+	}
+	d := &daemon{
+		server: server.MakeXaultServer(keys, store),
+		conns:  make(map[net.Conn]uint64),
+	}
+
+	var listeners []net.Listener
+	tcp, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		store.Close()
+		log.Fatalf("event=start error=%q", fmt.Sprintf("unable to listen: %v", err))
+	}
+	listeners = append(listeners, tcp)
+	if *unixPath != "" {
+		unix, err := listenUnix(*unixPath)
+		if err != nil {
+			tcp.Close()
+			store.Close()
+			log.Fatalf("event=start error=%q", fmt.Sprintf("unable to listen: %v", err))
+		}
+		listeners = append(listeners, unix)
+	}
+	for _, l := range listeners {
+		log.Printf("event=listen network=%s addr=%s", l.Addr().Network(), l.Addr())
+		go d.serve(l)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("event=shutdown signal=%s", sig)
+	d.shutdown(listeners, *shutdownTimeout)
+	if err := store.Close(); err != nil {
+		log.Fatalf("event=shutdown error=%q", fmt.Sprintf("unable to close store: %v", err))
+	}
+	log.Printf("event=stopped")
+}
+
+// loadKey loads the private key that secure/gen.go wrote to path.
+func loadKey(path string) (*xcrypt.DualKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key: %v", err)
+	}
+	keys, err := xcrypt.DualKeyFromString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load key from %q: %v", path, err)
+	}
+	return keys, nil
+}
+
+// listenUnix listens on a unix socket at path.  A socket left at path by a server that was killed
+// is removed first, anything else at path is left alone and is an error.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// daemon serves the rpc server on any number of listeners and keeps track of the connections it
+// has open so that it can shut them all down.
+type daemon struct {
+	server *rpc.Server
+
+	// mu protects everything below.  wg counts the connections in conns, which maps each one to
+	// the number it's logged with.
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	conns    map[net.Conn]uint64
+	nextConn uint64
+	closing  bool
+}
+
+// serve accepts connections from l until l is closed.
+func (d *daemon) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if d.isClosing() {
+				return
+			}
+			log.Printf("event=accept addr=%s error=%q", l.Addr(), err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		id, ok := d.track(conn)
+		if !ok {
+			conn.Close()
+			return
+		}
+		go d.serveConn(conn, id)
+	}
+}
+
+func (d *daemon) serveConn(conn net.Conn, id uint64) {
+	defer d.untrack(conn)
+	log.Printf("event=connect conn=%d network=%s remote=%q", id, conn.LocalAddr().Network(), conn.RemoteAddr().String())
+	d.server.ServeCodec(makeServerCodec(conn, id))
+	log.Printf("event=disconnect conn=%d", id)
+}
+
+func (d *daemon) isClosing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closing
+}
+
+// track records that conn is open and returns the number it's logged with, unless the daemon is
+// shutting down.
+func (d *daemon) track(conn net.Conn) (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return 0, false
+	}
+	d.nextConn++
+	d.conns[conn] = d.nextConn
+	d.wg.Add(1)
+	return d.nextConn, true
+}
+
+func (d *daemon) untrack(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conns, conn)
+	d.wg.Done()
+}
+
+// shutdown stops accepting connections and stops reading requests from the connections that are
+// open, then waits up to timeout for the responses to the requests already read to be sent.  Any
+// connections still open after that are closed.
+func (d *daemon) shutdown(listeners []net.Listener, timeout time.Duration) {
+	d.mu.Lock()
+	d.closing = true
+	for _, l := range listeners {
+		l.Close()
+	}
+	for conn := range d.conns {
+		// Closing just the reading half makes the rpc server see the end of the requests, it
+		// still sends the responses to the ones it's working on before it closes conn.
+		if cr, ok := conn.(interface {
+			CloseRead() error
+		}); ok {
+			cr.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		d.mu.Lock()
+		log.Printf("event=shutdown open_conns=%d error=%q", len(d.conns), "timed out waiting for requests to finish")
+		for conn := range d.conns {
+			conn.Close()
+		}
+		d.mu.Unlock()
+		<-done
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/runningwild/xault/shared/api"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testService is registered as "Test" for the codec and daemon to serve.  Block tells started that
+// it has been called and then waits for release before responding.
+type testService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func makeTestService() *testService {
+	return &testService{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *testService) Echo(req *api.MakeIdRequest, resp *api.MakeIdRequest) error {
+	*resp = *req
+	return nil
+}
+
+func (s *testService) Fail(req *api.MakeIdRequest, resp *api.MakeIdRequest) error {
+	return fmt.Errorf("failed on purpose")
+}
+
+func (s *testService) Block(req *api.MakeIdRequest, resp *api.MakeIdRequest) error {
+	s.started <- struct{}{}
+	<-s.release
+	*resp = *req
+	return nil
+}
+
+func makeTestServer(svc *testService) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Test", svc); err != nil {
+		panic(err)
+	}
+	return server
+}
+
+// logLines collects what's logged one line at a time, since the codec logs from the rpc server's
+// goroutines after the response has already been sent.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func (l logLines) next() string {
+	select {
+	case line := <-l:
+		return line
+	case <-time.After(5 * time.Second):
+		return "nothing was logged"
+	}
+}
+
+// captureLog sends everything logged to the returned logLines until the returned func is called.
+func captureLog() (logLines, func()) {
+	lines := make(logLines, 100)
+	log.SetOutput(lines)
+	return lines, func() { log.SetOutput(os.Stderr) }
+}
+
+func TestServerCodec(t *testing.T) {
+	Convey("an rpc.Client can talk to the codec and every request is logged", t, func() {
+		lines, restore := captureLog()
+		defer restore()
+		svc := makeTestService()
+		serverConn, clientConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			makeTestServer(svc).ServeCodec(makeServerCodec(serverConn, 7))
+			close(done)
+		}()
+		client := rpc.NewClient(clientConn)
+
+		var resp api.MakeIdRequest
+		So(client.Call("Test.Echo", &api.MakeIdRequest{Id: "alice"}, &resp), ShouldBeNil)
+		So(resp.Id, ShouldEqual, "alice")
+		line := lines.next()
+		So(line, ShouldContainSubstring, "event=request conn=7 method=Test.Echo seq=0 id=\"alice\"")
+		So(line, ShouldContainSubstring, "error=\"\"")
+
+		err := client.Call("Test.Fail", &api.MakeIdRequest{Id: "bob"}, &resp)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "failed on purpose")
+		line = lines.next()
+		So(line, ShouldContainSubstring, "method=Test.Fail seq=1 id=\"bob\"")
+		So(line, ShouldContainSubstring, "error=\"failed on purpose\"")
+
+		err = client.Call("Test.Missing", &api.MakeIdRequest{Id: "carol"}, &resp)
+		So(err, ShouldNotBeNil)
+		So(lines.next(), ShouldContainSubstring, "method=Test.Missing seq=2")
+
+		// Responses can be sent out of order, each is logged with its own request.
+		blocked := client.Go("Test.Block", &api.MakeIdRequest{Id: "dave"}, &api.MakeIdRequest{}, nil)
+		<-svc.started
+		So(client.Call("Test.Echo", &api.MakeIdRequest{Id: "erin"}, &resp), ShouldBeNil)
+		So(lines.next(), ShouldContainSubstring, "id=\"erin\"")
+		close(svc.release)
+		<-blocked.Done
+		So(blocked.Error, ShouldBeNil)
+		So(blocked.Reply.(*api.MakeIdRequest).Id, ShouldEqual, "dave")
+		So(lines.next(), ShouldContainSubstring, "method=Test.Block seq=3 id=\"dave\"")
+
+		So(client.Close(), ShouldBeNil)
+		<-done
+	})
+
+	Convey("the user that sent a request is logged if it has one", t, func() {
+		So(requestId(&api.MakeIdChallengeResponse{Id: "alice"}), ShouldEqual, "alice")
+		So(requestId(&api.AddContactRequest{Id: "bob"}), ShouldEqual, "bob")
+		So(requestId(&api.MakeIdResponse{}), ShouldEqual, "")
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("requests in progress finish when the daemon shuts down", t, func() {
+		lines, restore := captureLog()
+		defer func() {
+			restore()
+			close(lines)
+		}()
+		go func() {
+			for range lines {
+			}
+		}()
+
+		svc := makeTestService()
+		d := &daemon{server: makeTestServer(svc), conns: make(map[net.Conn]uint64)}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go d.serve(l)
+		client, err := rpc.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		blocked := client.Go("Test.Block", &api.MakeIdRequest{Id: "alice"}, &api.MakeIdRequest{}, nil)
+		<-svc.started
+		stopped := make(chan struct{})
+		go func() {
+			d.shutdown([]net.Listener{l}, 5*time.Second)
+			close(stopped)
+		}()
+
+		// New connections aren't accepted, and shutdown waits for the request.
+		for !d.isClosing() {
+			time.Sleep(time.Millisecond)
+		}
+		_, err = net.DialTimeout("tcp", l.Addr().String(), time.Second)
+		So(err, ShouldNotBeNil)
+		select {
+		case <-stopped:
+			So("shutdown returned before the request finished", ShouldBeEmpty)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(svc.release)
+		<-blocked.Done
+		So(blocked.Error, ShouldBeNil)
+		So(blocked.Reply.(*api.MakeIdRequest).Id, ShouldEqual, "alice")
+		<-stopped
+		So(len(d.conns), ShouldEqual, 0)
+	})
+
+	Convey("connections are closed if requests take longer than the timeout", t, func() {
+		lines, restore := captureLog()
+		timedOut := make(chan bool, 1)
+		go func() {
+			found := false
+			for line := range lines {
+				found = found || strings.Contains(line, "timed out")
+			}
+			timedOut <- found
+		}()
+
+		svc := makeTestService()
+		d := &daemon{server: makeTestServer(svc), conns: make(map[net.Conn]uint64)}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		go d.serve(l)
+		client, err := rpc.Dial("tcp", l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		blocked := client.Go("Test.Block", &api.MakeIdRequest{Id: "alice"}, &api.MakeIdRequest{}, nil)
+		<-svc.started
+		// The rpc server only notices the connection is closed once it tries to respond, so the
+		// request has to finish for shutdown to return.
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			close(svc.release)
+		}()
+		d.shutdown([]net.Listener{l}, 10*time.Millisecond)
+		<-blocked.Done
+		So(blocked.Error, ShouldNotBeNil)
+		restore()
+		close(lines)
+		So(<-timedOut, ShouldBeTrue)
+	})
+}
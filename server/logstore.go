@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logFileName      = "log"
+	snapshotFileName = "snapshot"
+
+	// defaultSnapshotEvery is how many changes are appended to the log before it's replaced by a
+	// snapshot.
+	defaultSnapshotEvery = 1000
+)
+
+// storeSnapshot is what's saved in the snapshot file.  Seq is the last change that State includes.
+type storeSnapshot struct {
+	Seq   uint64
+	State *storeState
+}
+
+// storeLog is the on-disk half of a Store made by OpenLogStore.  Every change to the store is
+// appended to the log file and synced before it's made.  Once the log has snapshotEvery changes in
+// it the whole state is saved to the snapshot file and the log is emptied, so opening the store
+// only has to replay the changes made since the last snapshot.
+//
+// Each change in the log file has the following format:
+// L0, 4 bytes, length of the record
+// C0, 4 bytes, crc32 of L0 and the record
+// record, L0 bytes, the gob encoding of a storeRecord
+type storeLog struct {
+	dir           string
+	f             *os.File
+	size          int64
+	records       int
+	snapshotEvery int
+}
+
+// OpenLogStore opens the Store saved in dir, making it if it doesn't exist yet.  Everything is kept
+// in memory and every change is also written to disk before it's made, so nothing is lost if the
+// server is killed.  Only one Store can have dir open at a time.
+func OpenLogStore(dir string) (Store, error) {
+	return openLogStore(dir, defaultSnapshotEvery)
+}
+
+func openLogStore(dir string, snapshotEvery int) (*memoryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to make store directory: %v", err)
+	}
+	ms := makeMemoryStore()
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read snapshot: %v", err)
+	}
+	if err == nil {
+		snapshot := storeSnapshot{State: ms.state}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+			return nil, fmt.Errorf("snapshot is corrupt: %v", err)
+		}
+		ms.seq = snapshot.Seq
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open log: %v", err)
+	}
+	log := &storeLog{dir: dir, f: f, snapshotEvery: snapshotEvery}
+	if err := log.replay(ms); err != nil {
+		f.Close()
+		return nil, err
+	}
+	ms.log = log
+	return ms, nil
+}
+
+// replay applies every change in the log that isn't already in ms to it.  If the server was killed
+// while appending a change then the last record in the log is partial, which is cut off, since
+// that change was never made.  A bad record anywhere else means the log is corrupt, and cutting it
+// off there would throw away the changes after it, so that's an error.  A bad record is only
+// taken to be the last one if there's no good record anywhere after it, since a corrupt length
+// can make a record look like it runs past the end of the log.
+func (l *storeLog) replay(ms *memoryStore) error {
+	data, err := ioutil.ReadAll(l.f)
+	if err != nil {
+		return fmt.Errorf("unable to read log: %v", err)
+	}
+	for len(data[l.size:]) >= 8 {
+		buf := data[l.size:]
+		record, ok := logRecordAt(buf)
+		if !ok {
+			if !hasLogRecord(buf[8:]) {
+				break
+			}
+			return fmt.Errorf("log is corrupt: the change at offset %d is damaged but there are changes after it", l.size)
+		}
+		var rec storeRecord
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&rec); err != nil {
+			return fmt.Errorf("log is corrupt: unable to decode the change at offset %d: %v", l.size, err)
+		}
+		// A snapshot is taken before the log is emptied, so the log can start with changes that
+		// are already in the snapshot.
+		if rec.Seq > ms.seq {
+			if rec.Seq != ms.seq+1 {
+				return fmt.Errorf("log is missing changes %d through %d", ms.seq+1, rec.Seq-1)
+			}
+			if err := ms.state.apply(&rec); err != nil {
+				return fmt.Errorf("log is corrupt: %v", err)
+			}
+			ms.seq = rec.Seq
+		}
+		l.size += int64(8 + len(record))
+		l.records++
+	}
+	if l.size < int64(len(data)) {
+		if err := l.truncate(l.size); err != nil {
+			return fmt.Errorf("unable to cut off partial change at the end of the log: %v", err)
+		}
+	}
+	return nil
+}
+
+// logChecksum returns the checksum of a record in the log with the given length bytes.
+func logChecksum(length, record []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(length), crc32.IEEETable, record)
+}
+
+// logRecordAt returns the record at the start of buf, and whether it's complete and matches its
+// checksum.
+func logRecordAt(buf []byte) ([]byte, bool) {
+	if len(buf) < 8 {
+		return nil, false
+	}
+	length := binary.LittleEndian.Uint32(buf[0:4])
+	if uint64(length) > uint64(len(buf)-8) {
+		return nil, false
+	}
+	record := buf[8 : 8+length]
+	return record, logChecksum(buf[0:4], record) == binary.LittleEndian.Uint32(buf[4:8])
+}
+
+// hasLogRecord returns whether a good record starts anywhere in buf.
+func hasLogRecord(buf []byte) bool {
+	for i := range buf {
+		if _, ok := logRecordAt(buf[i:]); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// append writes rec to the end of the log and syncs it.  If that fails then the log is left as it
+// was, so a partial record never ends up in the middle of it.
+func (l *storeLog) append(rec *storeRecord) error {
+	buf := bytes.NewBuffer(make([]byte, 8))
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		return fmt.Errorf("unable to encode change: %v", err)
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(data)-8))
+	binary.LittleEndian.PutUint32(data[4:8], logChecksum(data[0:4], data[8:]))
+	if _, err := l.f.WriteAt(data, l.size); err != nil {
+		l.truncate(l.size)
+		return fmt.Errorf("unable to write to log: %v", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		l.truncate(l.size)
+		return fmt.Errorf("unable to write to log: %v", err)
+	}
+	l.size += int64(len(data))
+	l.records++
+	return nil
+}
+
+// maybeSnapshot saves state, which includes every change up to seq, as the snapshot and empties
+// the log, if the log has had enough changes appended to it since the last snapshot.
+func (l *storeLog) maybeSnapshot(seq uint64, state *storeState) error {
+	if l.records < l.snapshotEvery {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(storeSnapshot{Seq: seq, State: state}); err != nil {
+		return fmt.Errorf("unable to encode snapshot: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(l.dir, snapshotFileName), buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := l.truncate(0); err != nil {
+		return fmt.Errorf("unable to empty log: %v", err)
+	}
+	l.size = 0
+	l.records = 0
+	return nil
+}
+
+// truncate cuts the log file off after size bytes.
+func (l *storeLog) truncate(size int64) error {
+	if err := l.f.Truncate(size); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *storeLog) close() error {
+	return l.f.Close()
+}
+
+// writeFileAtomic replaces the contents of path with data such that path always holds either the
+// old contents or all of data, even if the server is killed part way through.  data is written to a
+// temporary file in the same directory, which is synced and then renamed over path, and then the
+// directory is synced so that the rename itself survives a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to make temporary file for %q: %v", path, err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	return nil
+}
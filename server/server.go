@@ -6,7 +6,6 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"fmt"
-	"io"
 	"net/rpc"
 	"sync"
 	"time"
@@ -17,32 +16,38 @@ import (
 
 var foo api.MakeIdRequest
 
-type userInfo struct {
-	keys          *xcrypt.DualPublicKey
-	verified      bool
-	challenge     []byte
-	challengeTime time.Time
-
-	contactsMutex sync.RWMutex
-	contacts      map[string]bool
-}
+// challengeTimeout is how long a client has to complete the challenge after asking to make an id.
+// Until then nobody else can ask for the same id.
+const challengeTimeout = 10 * time.Second
 
 type Xault struct {
+	// usersMutex is held while making an id, so that two clients can't both be making the same id.
 	usersMutex sync.Mutex
-	users      map[string]*userInfo
+	store      Store
 	keys       *xcrypt.DualKey
 }
 
 func (x *Xault) MakeId(req *api.MakeIdRequest, resp *api.MakeIdChallenge) error {
+	if req.Keys == nil {
+		return fmt.Errorf("no keys specified")
+	}
+	if err := req.Keys.Validate(); err != nil {
+		return fmt.Errorf("invalid keys: %v", err)
+	}
 	x.usersMutex.Lock()
 	defer x.usersMutex.Unlock()
-	user, ok := x.users[req.Id]
-	if ok {
-		if time.Since(user.challengeTime).Seconds() > 10 {
-			delete(x.users, req.Id)
-		} else {
-			return fmt.Errorf("user %q already exists", req.Id)
+	if _, err := x.store.UserKeys(req.Id); err != ErrNotFound {
+		if err != nil {
+			return fmt.Errorf("unable to look up user: %v", err)
 		}
+		return fmt.Errorf("user %q already exists", req.Id)
+	}
+	pending, err := x.store.GetChallenge(req.Id)
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("unable to look up user: %v", err)
+	}
+	if err == nil && time.Since(pending.Time) <= challengeTimeout {
+		return fmt.Errorf("user %q already exists", req.Id)
 	}
 
 	challenge := make([]byte, 32)
@@ -54,11 +59,8 @@ func (x *Xault) MakeId(req *api.MakeIdRequest, resp *api.MakeIdChallenge) error
 		return fmt.Errorf("unable to make challenge")
 	}
 
-	x.users[req.Id] = &userInfo{
-		keys:          req.Keys,
-		challenge:     challenge,
-		challengeTime: time.Now(),
-		contacts:      make(map[string]bool),
+	if err := x.store.PutChallenge(req.Id, &Challenge{Keys: req.Keys, Challenge: challenge, Time: time.Now()}); err != nil {
+		return fmt.Errorf("unable to save challenge: %v", err)
 	}
 	resp.EncryptedChallenge = encryptedChallenge
 	return nil
@@ -67,50 +69,75 @@ func (x *Xault) MakeId(req *api.MakeIdRequest, resp *api.MakeIdChallenge) error
 func (x *Xault) MakeIdCompleteChallenge(req *api.MakeIdChallengeResponse, resp *api.MakeIdResponse) error {
 	x.usersMutex.Lock()
 	defer x.usersMutex.Unlock()
-	user, ok := x.users[req.Id]
-	if !ok || time.Since(user.challengeTime).Seconds() > 10 {
-		delete(x.users, req.Id)
+	pending, err := x.store.GetChallenge(req.Id)
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("unable to look up user: %v", err)
+	}
+	if err == ErrNotFound || time.Since(pending.Time) > challengeTimeout {
+		x.store.DeleteChallenge(req.Id)
 		return fmt.Errorf("user %q does not exist", req.Id)
 	}
-	hashed := sha256.Sum256(user.challenge)
-	if err := rsa.VerifyPKCS1v15(user.keys.GetRSAVerificationKey(), crypto.SHA256, hashed[:], req.SignedChallenge); err != nil {
+	hashed := sha256.Sum256(pending.Challenge)
+	if err := rsa.VerifyPKCS1v15(pending.Keys.GetRSAVerificationKey(), crypto.SHA256, hashed[:], req.SignedChallenge); err != nil {
 		return fmt.Errorf("could not verify signiature")
 	}
 
-	user.verified = true
+	if err := x.store.PutUser(req.Id, pending.Keys); err != nil {
+		return fmt.Errorf("unable to save user: %v", err)
+	}
+	// The user is verified now, so a challenge that's left behind by this failing doesn't matter.
+	x.store.DeleteChallenge(req.Id)
 	return nil
 }
 
+// AddContactRequest records that the user req.Id has added the user named in req.Envelope as a
+// contact.  The envelope must be sealed for the server and signed by the user, so only the user can
+// add contacts for themselves, and both the user and the contact must have completed the challenge.
+// The response has the keys the contact registered with, so the user can check that the server
+// agrees with what they got from the contact, and whether the contact has added the user too.
 func (x *Xault) AddContactRequest(req *api.AddContactRequest, resp *api.AddContactResponse) error {
-	x.usersMutex.Lock()
-	user, ok := x.users[req.Id]
-	x.usersMutex.Unlock()
-	if !ok {
-		return fmt.Errorf("no such user")
+	userKeys, err := x.store.UserKeys(req.Id)
+	if err == ErrNotFound {
+		return fmt.Errorf("user %q does not exist", req.Id)
 	}
-	contactIdBytes, err := x.keys.OpenEnvelope(random, user.keys, req.Envelope)
 	if err != nil {
-		return fmt.Errorf("internal error")
+		return fmt.Errorf("unable to look up user: %v", err)
+	}
+	contactIdBytes, err := x.keys.OpenEnvelope(rand.Reader, userKeys, req.Envelope)
+	if err != nil {
+		return fmt.Errorf("unable to open envelope: %v", err)
 	}
 	contactId := string(contactIdBytes)
-
-	x.usersMutex.Lock()
-	contact, ok := x.users[contactId]
-	x.usersMutex.Unlock()
-	if !ok {
-		return fmt.Errorf("no such contact")
+	if contactId == req.Id {
+		return fmt.Errorf("cannot add yourself as a contact")
 	}
 
-	user.contactsMutex.Lock()
-	user.contacts[contactId] = true
-	user.contactsMutex.Unlock()
+	contactKeys, err := x.store.UserKeys(contactId)
+	if err == ErrNotFound {
+		return fmt.Errorf("contact %q does not exist", contactId)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to look up contact: %v", err)
+	}
+	if err := x.store.AddContact(req.Id, contactId); err != nil {
+		return fmt.Errorf("unable to save contact: %v", err)
+	}
+	mutual, err := x.store.HasContact(contactId, req.Id)
+	if err != nil {
+		return fmt.Errorf("unable to look up contact: %v", err)
+	}
+	resp.Keys = contactKeys
+	resp.Mutual = mutual
+	return nil
 }
 
-func MakeXaultServer(keys *xcrypt.DualKey, random io.Reader) *rpc.Server {
+// MakeXaultServer makes an rpc server for the Xault service.  keys are the server's private keys,
+// clients seal envelopes for the server with the matching public keys.  Everything the server knows
+// about its users is kept in store.
+func MakeXaultServer(keys *xcrypt.DualKey, store Store) *rpc.Server {
 	x := &Xault{
-		users:  make(map[string]*userInfo),
-		keys:   keys,
-		random: random,
+		store: store,
+		keys:  keys,
 	}
 	server := rpc.NewServer()
 	server.Register(x)
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/rpc"
+	"os"
 	"testing"
 
 	"github.com/runningwild/cmwc"
@@ -101,7 +102,6 @@ func (fbc *fakeBlockingConn) Read(data []byte) (n int, err error) {
 		resp := <-req.resp
 		return resp.n, resp.err
 	}
-	return 0, nil
 }
 func (fbc *fakeBlockingConn) String() string {
 	return fmt.Sprintf("FBC:%p", fbc)
@@ -187,7 +187,7 @@ func init() {
 
 func TestServer(t *testing.T) {
 	Convey("TestServer", t, func() {
-		server := MakeXaultServer()
+		server := MakeXaultServer(keys[3], MakeMemoryStore())
 		dk := keys[0]
 		dpk, err := dk.MakePublicKey()
 		So(err, ShouldBeNil)
@@ -215,6 +215,13 @@ func TestServer(t *testing.T) {
 			})
 		})
 
+		Convey("invalid keys cannot be used to make an id", func() {
+			bad := &xcrypt.DualPublicKey{N: dpk.N, E0: dpk.E0, E1: dpk.E0}
+			req := api.MakeIdRequest{Id: "badid", Keys: bad}
+			var challenge api.MakeIdChallenge
+			So(doCallOnXaultServer(server, "Xault.MakeId", req, &challenge), ShouldNotBeNil)
+		})
+
 		Convey("the wrong keys cannot complete the challenge", func() {
 			_, err = rsa.DecryptOAEP(sha256.New(), nil, wrongKeys.GetRSADecryptionKey(), challenge.EncryptedChallenge, []byte("challenge"))
 			So(err, ShouldNotBeNil)
@@ -241,3 +248,127 @@ func TestServer(t *testing.T) {
 		})
 	})
 }
+
+// makeVerifiedId registers id on server with dk's keys and completes the challenge.
+func makeVerifiedId(server *rpc.Server, id string, dk *xcrypt.DualKey) {
+	dpk, err := dk.MakePublicKey()
+	So(err, ShouldBeNil)
+	var challenge api.MakeIdChallenge
+	So(doCallOnXaultServer(server, "Xault.MakeId", api.MakeIdRequest{Id: id, Keys: dpk}, &challenge), ShouldBeNil)
+	data, err := rsa.DecryptOAEP(sha256.New(), nil, dk.GetRSADecryptionKey(), challenge.EncryptedChallenge, []byte("challenge"))
+	So(err, ShouldBeNil)
+	hashed := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(nil, dk.GetRSASigniatureKey(), crypto.SHA256, hashed[:])
+	So(err, ShouldBeNil)
+	req := api.MakeIdChallengeResponse{Id: id, SignedChallenge: signature}
+	var reply api.MakeIdResponse
+	So(doCallOnXaultServer(server, "Xault.MakeIdCompleteChallenge", req, &reply), ShouldBeNil)
+}
+
+func TestAddContact(t *testing.T) {
+	Convey("TestAddContact", t, func() {
+		c := cmwc.MakeGoodCmwc()
+		c.Seed(987654321)
+		serverKeys := keys[3]
+		serverPublic, err := serverKeys.MakePublicKey()
+		So(err, ShouldBeNil)
+		server := MakeXaultServer(serverKeys, MakeMemoryStore())
+		makeVerifiedId(server, "alice", keys[0])
+		makeVerifiedId(server, "bob", keys[1])
+		addContact := func(id string, dk *xcrypt.DualKey, dst xcrypt.PublicKey, contactId string) (*api.AddContactResponse, error) {
+			envelope, err := dk.SealEnvelope(c, dst, []byte(contactId))
+			So(err, ShouldBeNil)
+			var resp api.AddContactResponse
+			err = doCallOnXaultServer(server, "Xault.AddContactRequest", api.AddContactRequest{Id: id, Envelope: envelope}, &resp)
+			return &resp, err
+		}
+
+		Convey("verified users can add each other", func() {
+			resp, err := addContact("alice", keys[0], serverPublic, "bob")
+			So(err, ShouldBeNil)
+			bobPublic, err := keys[1].MakePublicKey()
+			So(err, ShouldBeNil)
+			So(resp.Keys.String(), ShouldEqual, bobPublic.String())
+			So(resp.Mutual, ShouldBeFalse)
+
+			resp, err = addContact("bob", keys[1], serverPublic, "alice")
+			So(err, ShouldBeNil)
+			So(resp.Mutual, ShouldBeTrue)
+
+			// Adding the same contact again is fine.
+			resp, err = addContact("alice", keys[0], serverPublic, "bob")
+			So(err, ShouldBeNil)
+			So(resp.Mutual, ShouldBeTrue)
+		})
+
+		Convey("contacts must be verified users", func() {
+			_, err := addContact("alice", keys[0], serverPublic, "carol")
+			So(err, ShouldNotBeNil)
+
+			dpk, err := keys[2].MakePublicKey()
+			So(err, ShouldBeNil)
+			var challenge api.MakeIdChallenge
+			So(doCallOnXaultServer(server, "Xault.MakeId", api.MakeIdRequest{Id: "carol", Keys: dpk}, &challenge), ShouldBeNil)
+			_, err = addContact("alice", keys[0], serverPublic, "carol")
+			So(err, ShouldNotBeNil)
+			_, err = addContact("carol", keys[2], serverPublic, "alice")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("users can't add themselves", func() {
+			_, err := addContact("alice", keys[0], serverPublic, "alice")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("only the user can add contacts for themselves", func() {
+			_, err := addContact("alice", keys[1], serverPublic, "bob")
+			So(err, ShouldNotBeNil)
+			_, err = addContact("nobody", keys[0], serverPublic, "bob")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("envelopes that aren't for the server can't be opened", func() {
+			bobPublic, err := keys[1].MakePublicKey()
+			So(err, ShouldBeNil)
+			_, err = addContact("alice", keys[0], bobPublic, "bob")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestServerRestart(t *testing.T) {
+	Convey("ids and contacts survive restarting the server", t, func() {
+		dir, err := ioutil.TempDir("", "xault-store")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		c := cmwc.MakeGoodCmwc()
+		c.Seed(192837465)
+		serverKeys := keys[3]
+		serverPublic, err := serverKeys.MakePublicKey()
+		So(err, ShouldBeNil)
+
+		store, err := OpenLogStore(dir)
+		So(err, ShouldBeNil)
+		server := MakeXaultServer(serverKeys, store)
+		makeVerifiedId(server, "alice", keys[0])
+		makeVerifiedId(server, "bob", keys[1])
+		envelope, err := keys[0].SealEnvelope(c, serverPublic, []byte("bob"))
+		So(err, ShouldBeNil)
+		var resp api.AddContactResponse
+		So(doCallOnXaultServer(server, "Xault.AddContactRequest", api.AddContactRequest{Id: "alice", Envelope: envelope}, &resp), ShouldBeNil)
+		So(store.Close(), ShouldBeNil)
+
+		store, err = OpenLogStore(dir)
+		So(err, ShouldBeNil)
+		defer store.Close()
+		server = MakeXaultServer(serverKeys, store)
+		dpk, err := keys[2].MakePublicKey()
+		So(err, ShouldBeNil)
+		var challenge api.MakeIdChallenge
+		So(doCallOnXaultServer(server, "Xault.MakeId", api.MakeIdRequest{Id: "alice", Keys: dpk}, &challenge), ShouldNotBeNil)
+		envelope, err = keys[1].SealEnvelope(c, serverPublic, []byte("alice"))
+		So(err, ShouldBeNil)
+		So(doCallOnXaultServer(server, "Xault.AddContactRequest", api.AddContactRequest{Id: "bob", Envelope: envelope}, &resp), ShouldBeNil)
+		So(resp.Mutual, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+// ErrNotFound is returned by a Store when there's nothing stored for the id that was asked for.
+var ErrNotFound = fmt.Errorf("not found")
+
+var errStoreClosed = fmt.Errorf("store is closed")
+
+// Store is where the server keeps everything it knows about its users: the keys of every verified
+// id, the challenges of ids that are still being made, who each user has added as a contact, and
+// the mail waiting in each user's mailbox.  Every method is safe to call concurrently, but a Store
+// doesn't check anything about what it's given, that's up to the server.
+//
+// Challenges are only kept in memory.  Anyone can make one without being a user, and they can only
+// be completed for challengeTimeout anyway, so they aren't worth saving.
+type Store interface {
+	// PutUser records that id has been verified as belonging to whoever holds the private keys
+	// matching keys.
+	PutUser(id string, keys *xcrypt.DualPublicKey) error
+
+	// UserKeys returns the keys of the verified id, or ErrNotFound if id hasn't been verified.
+	UserKeys(id string) (*xcrypt.DualPublicKey, error)
+
+	// PutChallenge records the challenge that has to be completed before id is verified, replacing
+	// any challenge that was already recorded for it.  Challenges older than challengeTimeout are
+	// forgotten.
+	PutChallenge(id string, challenge *Challenge) error
+
+	// GetChallenge returns the challenge recorded for id, or ErrNotFound if there isn't one.
+	GetChallenge(id string) (*Challenge, error)
+
+	// DeleteChallenge forgets the challenge recorded for id, if there is one.
+	DeleteChallenge(id string) error
+
+	// AddContact records that id has added contactId as a contact.
+	AddContact(id, contactId string) error
+
+	// HasContact returns whether id has added contactId as a contact.
+	HasContact(id, contactId string) (bool, error)
+
+	// Contacts returns the ids of everyone that id has added as a contact, sorted.
+	Contacts(id string) ([]string, error)
+
+	// PutMail adds mail to the end of id's mailbox.
+	PutMail(id string, mail []byte) error
+
+	// TakeMail empties id's mailbox and returns everything that was in it, oldest first.
+	TakeMail(id string) ([][]byte, error)
+
+	// Close releases anything the Store holds on to.  The Store can't be used afterwards.
+	Close() error
+}
+
+// Challenge is what an id has to complete to be verified.  Keys are the keys the id is being made
+// with and Challenge is the plaintext of the challenge that was encrypted with them.
+type Challenge struct {
+	Keys      *xcrypt.DualPublicKey
+	Challenge []byte
+	Time      time.Time
+}
+
+// storeState is everything in a Store apart from the challenges.  It's exported field by field so
+// that it can be saved in a snapshot with gob.
+type storeState struct {
+	Users    map[string]*xcrypt.DualPublicKey
+	Contacts map[string]map[string]bool
+	Mail     map[string][][]byte
+}
+
+func makeStoreState() *storeState {
+	return &storeState{
+		Users:    make(map[string]*xcrypt.DualPublicKey),
+		Contacts: make(map[string]map[string]bool),
+		Mail:     make(map[string][][]byte),
+	}
+}
+
+// The kinds of changes that can be made to a storeState.
+const (
+	opPutUser byte = iota + 1
+	opAddContact
+	opPutMail
+	opTakeMail
+)
+
+// storeRecord is a single change to a storeState.  Only the fields that Op needs are set.  Seq
+// numbers the changes made to a Store, starting at 1, so that a log of them can be replayed on top
+// of a snapshot without applying any twice.
+type storeRecord struct {
+	Seq       uint64
+	Op        byte
+	Id        string
+	ContactId string
+	Keys      *xcrypt.DualPublicKey
+	Mail      []byte
+}
+
+// apply makes the change described by rec to s.
+func (s *storeState) apply(rec *storeRecord) error {
+	switch rec.Op {
+	case opPutUser:
+		s.Users[rec.Id] = rec.Keys
+	case opAddContact:
+		if s.Contacts[rec.Id] == nil {
+			s.Contacts[rec.Id] = make(map[string]bool)
+		}
+		s.Contacts[rec.Id][rec.ContactId] = true
+	case opPutMail:
+		s.Mail[rec.Id] = append(s.Mail[rec.Id], rec.Mail)
+	case opTakeMail:
+		delete(s.Mail, rec.Id)
+	default:
+		return fmt.Errorf("unknown store operation %d", rec.Op)
+	}
+	return nil
+}
+
+// memoryStore is a Store that keeps everything in a storeState, and the challenges in challenges.
+// If log is set then every change to state is written to it before it's made, otherwise everything
+// is lost when the process exits.
+type memoryStore struct {
+	mu         sync.RWMutex
+	state      *storeState
+	challenges map[string]*Challenge
+	seq        uint64
+	log        *storeLog
+}
+
+// MakeMemoryStore makes a Store that only keeps things in memory, which is only useful for tests.
+func MakeMemoryStore() Store {
+	return makeMemoryStore()
+}
+
+func makeMemoryStore() *memoryStore {
+	return &memoryStore{state: makeStoreState(), challenges: make(map[string]*Challenge)}
+}
+
+// update makes the change described by rec.
+func (ms *memoryStore) update(rec *storeRecord) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.updateLocked(rec)
+}
+
+// updateLocked is update for when ms.mu is already held.  If there's a log then rec is written to it
+// before the change is made, and a snapshot is taken afterwards if the log is due for one.
+func (ms *memoryStore) updateLocked(rec *storeRecord) error {
+	if ms.state == nil {
+		return errStoreClosed
+	}
+	rec.Seq = ms.seq + 1
+	if ms.log != nil {
+		if err := ms.log.append(rec); err != nil {
+			return err
+		}
+	}
+	if err := ms.state.apply(rec); err != nil {
+		return err
+	}
+	ms.seq = rec.Seq
+	if ms.log != nil {
+		// A snapshot that fails doesn't lose anything, the log just keeps growing until one works.
+		ms.log.maybeSnapshot(ms.seq, ms.state)
+	}
+	return nil
+}
+
+// read calls f with the state held for reading.
+func (ms *memoryStore) read(f func(s *storeState) error) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.state == nil {
+		return errStoreClosed
+	}
+	return f(ms.state)
+}
+
+func (ms *memoryStore) PutUser(id string, keys *xcrypt.DualPublicKey) error {
+	return ms.update(&storeRecord{Op: opPutUser, Id: id, Keys: keys})
+}
+
+func (ms *memoryStore) UserKeys(id string) (keys *xcrypt.DualPublicKey, err error) {
+	err = ms.read(func(s *storeState) error {
+		var ok bool
+		if keys, ok = s.Users[id]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (ms *memoryStore) PutChallenge(id string, challenge *Challenge) error {
+	c := *challenge
+	c.Challenge = append([]byte(nil), challenge.Challenge...)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.state == nil {
+		return errStoreClosed
+	}
+	// Nobody can complete an expired challenge, so this is when they're cleaned up, otherwise
+	// clients that never complete theirs would fill up the server's memory.
+	for other, pending := range ms.challenges {
+		if time.Since(pending.Time) > challengeTimeout {
+			delete(ms.challenges, other)
+		}
+	}
+	ms.challenges[id] = &c
+	return nil
+}
+
+func (ms *memoryStore) GetChallenge(id string) (challenge *Challenge, err error) {
+	err = ms.read(func(s *storeState) error {
+		c, ok := ms.challenges[id]
+		if !ok {
+			return ErrNotFound
+		}
+		challenge = &Challenge{Keys: c.Keys, Challenge: append([]byte(nil), c.Challenge...), Time: c.Time}
+		return nil
+	})
+	return challenge, err
+}
+
+func (ms *memoryStore) DeleteChallenge(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.state == nil {
+		return errStoreClosed
+	}
+	delete(ms.challenges, id)
+	return nil
+}
+
+func (ms *memoryStore) AddContact(id, contactId string) error {
+	return ms.update(&storeRecord{Op: opAddContact, Id: id, ContactId: contactId})
+}
+
+func (ms *memoryStore) HasContact(id, contactId string) (has bool, err error) {
+	err = ms.read(func(s *storeState) error {
+		has = s.Contacts[id][contactId]
+		return nil
+	})
+	return has, err
+}
+
+func (ms *memoryStore) Contacts(id string) (contactIds []string, err error) {
+	err = ms.read(func(s *storeState) error {
+		for contactId := range s.Contacts[id] {
+			contactIds = append(contactIds, contactId)
+		}
+		return nil
+	})
+	sort.Strings(contactIds)
+	return contactIds, err
+}
+
+func (ms *memoryStore) PutMail(id string, mail []byte) error {
+	return ms.update(&storeRecord{Op: opPutMail, Id: id, Mail: append([]byte(nil), mail...)})
+}
+
+func (ms *memoryStore) TakeMail(id string) ([][]byte, error) {
+	// The mail has to be read and removed under the same lock, otherwise mail that arrives in
+	// between would be thrown away without ever being taken.
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.state == nil {
+		return nil, errStoreClosed
+	}
+	mail := ms.state.Mail[id]
+	if err := ms.updateLocked(&storeRecord{Op: opTakeMail, Id: id}); err != nil {
+		return nil, err
+	}
+	return mail, nil
+}
+
+func (ms *memoryStore) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.state = nil
+	if ms.log != nil {
+		return ms.log.close()
+	}
+	return nil
+}
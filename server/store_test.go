@@ -0,0 +1,250 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testStore checks that store behaves like a Store, and leaves it with a user, a challenge, a
+// contact, and some mail in it.
+func testStore(store Store) {
+	dpk, err := keys[0].MakePublicKey()
+	So(err, ShouldBeNil)
+
+	_, err = store.UserKeys("alice")
+	So(err, ShouldEqual, ErrNotFound)
+	So(store.PutUser("alice", dpk), ShouldBeNil)
+	got, err := store.UserKeys("alice")
+	So(err, ShouldBeNil)
+	So(got.String(), ShouldEqual, dpk.String())
+
+	_, err = store.GetChallenge("bob")
+	So(err, ShouldEqual, ErrNotFound)
+	now := time.Now()
+	So(store.PutChallenge("bob", &Challenge{Keys: dpk, Challenge: []byte("first"), Time: now}), ShouldBeNil)
+	So(store.PutChallenge("bob", &Challenge{Keys: dpk, Challenge: []byte("second"), Time: now}), ShouldBeNil)
+	challenge, err := store.GetChallenge("bob")
+	So(err, ShouldBeNil)
+	So(string(challenge.Challenge), ShouldEqual, "second")
+	So(challenge.Time.Equal(now), ShouldBeTrue)
+	So(store.PutChallenge("carol", &Challenge{Keys: dpk, Challenge: []byte("carol"), Time: now}), ShouldBeNil)
+	So(store.DeleteChallenge("carol"), ShouldBeNil)
+	So(store.DeleteChallenge("carol"), ShouldBeNil)
+	_, err = store.GetChallenge("carol")
+	So(err, ShouldEqual, ErrNotFound)
+
+	// Expired challenges are forgotten when another one is put.
+	So(store.PutChallenge("dave", &Challenge{Keys: dpk, Challenge: []byte("dave"), Time: now.Add(-2 * challengeTimeout)}), ShouldBeNil)
+	_, err = store.GetChallenge("dave")
+	So(err, ShouldBeNil)
+	So(store.PutChallenge("erin", &Challenge{Keys: dpk, Challenge: []byte("erin"), Time: now}), ShouldBeNil)
+	_, err = store.GetChallenge("dave")
+	So(err, ShouldEqual, ErrNotFound)
+	So(store.DeleteChallenge("erin"), ShouldBeNil)
+
+	So(store.AddContact("alice", "carol"), ShouldBeNil)
+	So(store.AddContact("alice", "bob"), ShouldBeNil)
+	So(store.AddContact("alice", "bob"), ShouldBeNil)
+	has, err := store.HasContact("alice", "bob")
+	So(err, ShouldBeNil)
+	So(has, ShouldBeTrue)
+	has, err = store.HasContact("bob", "alice")
+	So(err, ShouldBeNil)
+	So(has, ShouldBeFalse)
+	contacts, err := store.Contacts("alice")
+	So(err, ShouldBeNil)
+	So(contacts, ShouldResemble, []string{"bob", "carol"})
+
+	mail, err := store.TakeMail("alice")
+	So(err, ShouldBeNil)
+	So(len(mail), ShouldEqual, 0)
+	So(store.PutMail("alice", []byte("one")), ShouldBeNil)
+	So(store.PutMail("alice", []byte("two")), ShouldBeNil)
+	mail, err = store.TakeMail("alice")
+	So(err, ShouldBeNil)
+	So(mail, ShouldResemble, [][]byte{[]byte("one"), []byte("two")})
+	mail, err = store.TakeMail("alice")
+	So(err, ShouldBeNil)
+	So(len(mail), ShouldEqual, 0)
+	So(store.PutMail("alice", []byte("three")), ShouldBeNil)
+}
+
+// checkTestStore checks that store has what testStore left in it.  Challenges are only kept in
+// memory, so if store was reopened since then hasChallenge is false.
+func checkTestStore(store Store, hasChallenge bool) {
+	dpk, err := keys[0].MakePublicKey()
+	So(err, ShouldBeNil)
+	got, err := store.UserKeys("alice")
+	So(err, ShouldBeNil)
+	So(got.String(), ShouldEqual, dpk.String())
+	challenge, err := store.GetChallenge("bob")
+	if hasChallenge {
+		So(err, ShouldBeNil)
+		So(string(challenge.Challenge), ShouldEqual, "second")
+	} else {
+		So(err, ShouldEqual, ErrNotFound)
+	}
+	_, err = store.GetChallenge("carol")
+	So(err, ShouldEqual, ErrNotFound)
+	contacts, err := store.Contacts("alice")
+	So(err, ShouldBeNil)
+	So(contacts, ShouldResemble, []string{"bob", "carol"})
+	mail, err := store.TakeMail("alice")
+	So(err, ShouldBeNil)
+	So(mail, ShouldResemble, [][]byte{[]byte("three")})
+}
+
+func TestMemoryStore(t *testing.T) {
+	Convey("TestMemoryStore", t, func() {
+		store := MakeMemoryStore()
+		testStore(store)
+		checkTestStore(store, true)
+		So(store.Close(), ShouldBeNil)
+		_, err := store.UserKeys("alice")
+		So(err, ShouldNotBeNil)
+		So(store.PutUser("alice", nil), ShouldNotBeNil)
+	})
+}
+
+func TestLogStore(t *testing.T) {
+	Convey("TestLogStore", t, func() {
+		dir, err := ioutil.TempDir("", "xault-store")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		logPath := filepath.Join(dir, logFileName)
+		snapshotPath := filepath.Join(dir, snapshotFileName)
+
+		Convey("everything but the challenges is still there after reopening", func() {
+			store, err := openLogStore(dir, defaultSnapshotEvery)
+			So(err, ShouldBeNil)
+			testStore(store)
+			records := store.log.records
+			So(store.PutChallenge("frank", &Challenge{Challenge: []byte("frank"), Time: time.Now()}), ShouldBeNil)
+			So(store.DeleteChallenge("frank"), ShouldBeNil)
+			So(store.log.records, ShouldEqual, records)
+			So(store.Close(), ShouldBeNil)
+			_, err = os.Stat(snapshotPath)
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			store, err = openLogStore(dir, defaultSnapshotEvery)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			checkTestStore(store, false)
+		})
+
+		Convey("snapshots replace the log", func() {
+			store, err := openLogStore(dir, 5)
+			So(err, ShouldBeNil)
+			testStore(store)
+			So(store.Close(), ShouldBeNil)
+			_, err = os.Stat(snapshotPath)
+			So(err, ShouldBeNil)
+			So(store.log.records, ShouldBeLessThan, 5)
+
+			store, err = openLogStore(dir, 5)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			checkTestStore(store, false)
+		})
+
+		Convey("a log left behind by a snapshot isn't applied twice", func() {
+			store, err := openLogStore(dir, 1000)
+			So(err, ShouldBeNil)
+			testStore(store)
+			So(store.Close(), ShouldBeNil)
+			log, err := ioutil.ReadFile(logPath)
+			So(err, ShouldBeNil)
+
+			// Force a snapshot, then put the log back like the server was killed before emptying it.
+			store, err = openLogStore(dir, 1)
+			So(err, ShouldBeNil)
+			So(store.PutMail("alice", []byte("four")), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+			So(ioutil.WriteFile(logPath, log, 0600), ShouldBeNil)
+
+			store, err = openLogStore(dir, 1000)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			mail, err := store.TakeMail("alice")
+			So(err, ShouldBeNil)
+			So(mail, ShouldResemble, [][]byte{[]byte("three"), []byte("four")})
+		})
+
+		Convey("a partial change at the end of the log is cut off", func() {
+			store, err := OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			testStore(store)
+			So(store.Close(), ShouldBeNil)
+
+			store, err = OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			So(store.PutMail("alice", []byte("four")), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+			withFour, err := ioutil.ReadFile(logPath)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(logPath, withFour[:len(withFour)-3], 0600), ShouldBeNil)
+
+			store, err = OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			So(store.PutMail("alice", []byte("five")), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+
+			store, err = OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			defer store.Close()
+			mail, err := store.TakeMail("alice")
+			So(err, ShouldBeNil)
+			So(mail, ShouldResemble, [][]byte{[]byte("three"), []byte("five")})
+		})
+
+		Convey("a corrupt change before the end of the log is an error", func() {
+			store, err := OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			testStore(store)
+			So(store.Close(), ShouldBeNil)
+			log, err := ioutil.ReadFile(logPath)
+			So(err, ShouldBeNil)
+
+			// The last change only fails its checksum because it was cut short, so it's cut off.
+			last := append([]byte{}, log...)
+			last[len(last)-1] ^= 1
+			So(ioutil.WriteFile(logPath, last, 0600), ShouldBeNil)
+			store, err = OpenLogStore(dir)
+			So(err, ShouldBeNil)
+			mail, err := store.TakeMail("alice")
+			So(err, ShouldBeNil)
+			So(len(mail), ShouldEqual, 0)
+			So(store.Close(), ShouldBeNil)
+
+			// Anywhere else, the changes after it would be lost.
+			log[20] ^= 1
+			So(ioutil.WriteFile(logPath, log, 0600), ShouldBeNil)
+			_, err = OpenLogStore(dir)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "corrupt")
+			log[20] ^= 1
+
+			// That includes a corrupt length that makes the first change look like it runs past the
+			// end of the log, and the log is left as it was.
+			log[3] = 0xff
+			So(ioutil.WriteFile(logPath, log, 0600), ShouldBeNil)
+			_, err = OpenLogStore(dir)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "corrupt")
+			onDisk, err := ioutil.ReadFile(logPath)
+			So(err, ShouldBeNil)
+			So(onDisk, ShouldResemble, log)
+		})
+
+		Convey("a corrupt snapshot is an error", func() {
+			So(ioutil.WriteFile(snapshotPath, []byte("not a snapshot"), 0600), ShouldBeNil)
+			_, err := OpenLogStore(dir)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -27,5 +27,8 @@ type AddContactRequest struct {
 	Envelope []byte
 }
 
+// S->C: Contact's public keys, whether the contact has also added C
 type AddContactResponse struct {
+	Keys   *xcrypt.DualPublicKey
+	Mutual bool
 }
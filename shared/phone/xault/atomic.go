@@ -0,0 +1,66 @@
+package xault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the contents of path with data such that path always holds either the
+// old contents or all of data, even if the app is killed or the disk fills up part way through.
+// data is written to a temporary file in the same directory, which is synced and then renamed over
+// path, and then the directory is synced so that the rename itself survives a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to make temporary file for %q: %v", path, err)
+	}
+	tmp := f.Name()
+	if err := writeAndSync(f, data, perm); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("unable to write %q: %v", path, err)
+	}
+	return nil
+}
+
+// writeAndSync writes data to f, sets its permissions to perm, and flushes it to disk before
+// closing it.  f is closed even if there's an error.
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes dir to disk, which is what makes a rename within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// backupPath returns the path of the backup that's kept of the previous contents of path.
+func backupPath(path string) string {
+	return path + ".bak"
+}
@@ -0,0 +1,388 @@
+package xault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+// Social recovery works like this:
+// 1. The owner calls MakeBackupShares, which splits their key into one share for each trusted
+//    contact, and sends each contact their share, either through the server or in person.
+// 2. Each contact calls StoreBackupShare to check the share and keep it.
+// 3. When the owner loses their key they call BeginRecovery on their new device, which makes a
+//    temporary key, and give its recovery key to their contacts.
+// 4. Each contact checks that it's really the owner asking, then calls ReleaseBackupShare to seal
+//    their share to the recovery key and sends the result back.
+// 5. The owner calls AddRecoveryShare with each released share, and once there are enough of them
+//    FinishRecovery puts the key back together and saves it.
+
+// backupShare is what MakeBackupShares seals to each trusted contact.
+type backupShare struct {
+	// Owner is the contact id of the owner of the key.
+	Owner string
+
+	// Fingerprint is the fingerprint of the owner's public key, so that the reconstructed key can
+	// be checked.
+	Fingerprint []byte
+
+	// Threshold is the number of shares needed to reconstruct the key.
+	Threshold int
+
+	// Share is the share itself, made by xcrypt.SplitSecret from the key's binary encoding.
+	Share []byte
+}
+
+// heldShare is how a trusted contact keeps a share on disk.  The share stays sealed until it's
+// released, and the owner's key is kept with it because it's needed to open the share.
+type heldShare struct {
+	OwnerKey string
+	Envelope []byte
+}
+
+// releasedShare is what ReleaseBackupShare gives back to the owner.  The owner might not have the
+// contact's key any more, so it's included, the share is checked when the key is reconstructed.
+type releasedShare struct {
+	HolderKey string
+	Envelope  []byte
+}
+
+// recoveryState is the state of a recovery started by BeginRecovery.
+type recoveryState struct {
+	key *xcrypt.CurveKey
+
+	// These are set from the first share that's added, every other share must match them.
+	owner       string
+	fingerprint []byte
+	threshold   int
+
+	// shares maps the x coordinate of each share to the share.
+	shares map[byte][]byte
+}
+
+// MakeBackupShares splits this user's key into one share for each of the whitespace-separated
+// contactIds, such that any threshold of them can be used to recover the key.  Each share is sealed
+// to its contact's key, so only that contact can open it.  The shares are returned as a JSON object
+// that maps each contact id to the share, in base64, to send to that contact.
+func (ls *LifetimeState) MakeBackupShares(contactIds string, threshold int) (string, error) {
+	if err := ls.checkKeys(); err != nil {
+		return "", err
+	}
+	ids := strings.Fields(contactIds)
+	var dsts []*xcrypt.DualPublicKey
+	for _, id := range ids {
+		if id == ls.info.ContactId() {
+			return "", fmt.Errorf("backup shares can't be given to yourself")
+		}
+		dpk, err := ls.contactKey(id)
+		if err != nil {
+			return "", err
+		}
+		dsts = append(dsts, dpk)
+	}
+	sealed := make(map[string][]byte)
+	err := ls.withKey(func(dk *xcrypt.DualKey) error {
+		data, err := dk.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		shares, err := xcrypt.SplitSecret(rand.Reader, data, len(ids), threshold)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if _, ok := sealed[id]; ok {
+				return fmt.Errorf("%q was given more than once", id)
+			}
+			var buf bytes.Buffer
+			share := backupShare{
+				Owner:       ls.info.ContactId(),
+				Fingerprint: ls.public.Fingerprint(),
+				Threshold:   threshold,
+				Share:       shares[i],
+			}
+			if err := gob.NewEncoder(&buf).Encode(share); err != nil {
+				return err
+			}
+			envelope, err := dk.SealEnvelope(rand.Reader, dsts[i], buf.Bytes())
+			if err != nil {
+				return fmt.Errorf("unable to seal share for %q: %v", id, err)
+			}
+			sealed[id] = envelope
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func MakeBackupShares(contactIds string, threshold int) (string, error) {
+	return ls.MakeBackupShares(contactIds, threshold)
+}
+
+// StoreBackupShare checks that share is a backup share that ownerId made for this user with
+// MakeBackupShares, then saves it to disk so that it can be released later.  It replaces any share
+// that was already stored for ownerId.
+func (ls *LifetimeState) StoreBackupShare(ownerId string, share []byte) error {
+	if err := ls.checkKeys(); err != nil {
+		return err
+	}
+	ownerKey, err := ls.contactKey(ownerId)
+	if err != nil {
+		return err
+	}
+	err = ls.withKey(func(dk *xcrypt.DualKey) error {
+		_, err := openBackupShare(dk, ownerKey, ownerId, share)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	data, err := encodeState(stateShare, heldShare{OwnerKey: ownerKey.String(), Envelope: share})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(ls.rootDir, "shares")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to make %q: %v", dir, err)
+	}
+	path := ls.heldSharePath(ownerId)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("unable to save share: %v", err)
+	}
+	return nil
+}
+
+func StoreBackupShare(ownerId string, share []byte) error {
+	return ls.StoreBackupShare(ownerId, share)
+}
+
+// ReleaseBackupShare seals the share stored for ownerId to recoveryKey, which is what the owner got
+// from BeginRecovery.  Anyone with the result and enough other shares gets ownerId's key, so the UI
+// must make sure that it's really ownerId asking, ideally in person, before calling this.
+func (ls *LifetimeState) ReleaseBackupShare(ownerId, recoveryKey string) ([]byte, error) {
+	if err := ls.checkKeys(); err != nil {
+		return nil, err
+	}
+	cpk, err := xcrypt.CurvePublicKeyFromString(recoveryKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse recovery key: %v", err)
+	}
+	path := ls.heldSharePath(ownerId)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no share is stored for %q: %v", ownerId, err)
+	}
+	var held heldShare
+	if err := decodeState(stateShare, data, &held); err != nil {
+		return nil, fmt.Errorf("unable to read share from %q: %v", path, err)
+	}
+	ownerKey, err := xcrypt.DualPublicKeyFromString(held.OwnerKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read share from %q: %v", path, err)
+	}
+	var envelope []byte
+	err = ls.withKey(func(dk *xcrypt.DualKey) error {
+		share, err := openBackupShare(dk, ownerKey, ownerId, held.Envelope)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(share); err != nil {
+			return err
+		}
+		envelope, err = dk.SealEnvelope(rand.Reader, cpk, buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(releasedShare{HolderKey: ls.public.String(), Envelope: envelope}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ReleaseBackupShare(ownerId, recoveryKey string) ([]byte, error) {
+	return ls.ReleaseBackupShare(ownerId, recoveryKey)
+}
+
+// BeginRecovery starts recovering this user's key from backup shares, forgetting about any recovery
+// that was already in progress.  It returns the recovery key to give to the contacts holding the
+// shares.
+func (ls *LifetimeState) BeginRecovery() (string, error) {
+	if err := ls.checkInitted(); err != nil {
+		return "", err
+	}
+	ck, err := xcrypt.MakeCurveKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	cpk, err := ck.MakePublicKey()
+	if err != nil {
+		return "", err
+	}
+	ls.recovery = &recoveryState{key: ck, shares: make(map[byte][]byte)}
+	return cpk.String(), nil
+}
+
+func BeginRecovery() (string, error) {
+	return ls.BeginRecovery()
+}
+
+// AddRecoveryShare adds a share released by ReleaseBackupShare to the recovery started by
+// BeginRecovery.  It returns the number of shares that are still needed, once that's zero
+// FinishRecovery can be called.
+func (ls *LifetimeState) AddRecoveryShare(released []byte) (int, error) {
+	r := ls.recovery
+	if r == nil {
+		return 0, fmt.Errorf("must call BeginRecovery() first")
+	}
+	var rs releasedShare
+	if err := gob.NewDecoder(bytes.NewReader(released)).Decode(&rs); err != nil {
+		return 0, fmt.Errorf("unable to read share: %v", err)
+	}
+	holderKey, err := xcrypt.DualPublicKeyFromString(rs.HolderKey)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read share: %v", err)
+	}
+	data, err := r.key.OpenEnvelope(rand.Reader, holderKey, rs.Envelope)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open share: %v", err)
+	}
+	var share backupShare
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&share); err != nil {
+		return 0, fmt.Errorf("unable to read share: %v", err)
+	}
+	if len(share.Share) == 0 {
+		return 0, fmt.Errorf("share is empty")
+	}
+	if len(r.shares) == 0 {
+		r.owner = share.Owner
+		r.fingerprint = share.Fingerprint
+		r.threshold = share.Threshold
+	} else if share.Owner != r.owner || !bytes.Equal(share.Fingerprint, r.fingerprint) || share.Threshold != r.threshold {
+		return 0, fmt.Errorf("share is for a different key than the other shares")
+	}
+	r.shares[share.Share[0]] = share.Share
+	return ls.sharesNeeded(), nil
+}
+
+func AddRecoveryShare(released []byte) (int, error) {
+	return ls.AddRecoveryShare(released)
+}
+
+// FinishRecovery reconstructs this user's key from the shares given to AddRecoveryShare and saves it
+// to disk along with name, just like RecoverKeys.  It returns this user's contact id, which is the
+// same as it was before the key was lost.
+func (ls *LifetimeState) FinishRecovery(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	r := ls.recovery
+	if r == nil {
+		return "", fmt.Errorf("must call BeginRecovery() first")
+	}
+	if n := ls.sharesNeeded(); n > 0 {
+		return "", fmt.Errorf("%d more shares are needed", n)
+	}
+	var shares [][]byte
+	for _, share := range r.shares {
+		shares = append(shares, share)
+	}
+	data, err := xcrypt.CombineShares(shares)
+	if err != nil {
+		return "", err
+	}
+	var dk xcrypt.DualKey
+	if err := dk.UnmarshalBinary(data); err != nil {
+		return "", fmt.Errorf("shares did not give a valid key: %v", err)
+	}
+	if err := dk.Validate(); err != nil {
+		return "", fmt.Errorf("shares did not give a valid key: %v", err)
+	}
+	dpk, err := dk.MakePublicKey()
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(dpk.Fingerprint(), r.fingerprint) {
+		return "", fmt.Errorf("shares did not give the right key, one of them may be wrong")
+	}
+	// The owner's id is kept rather than derived again from the key, so that contacts still know
+	// this user by the same id, but it has to be the id that the key would have been given.
+	id, server, ok := strings.Cut(r.owner, "@")
+	if !ok || server == "" {
+		return "", fmt.Errorf("shares are for %q, which is not a contact id", r.owner)
+	}
+	want, err := idFromKey(&dk)
+	if err != nil {
+		return "", err
+	}
+	if id != want {
+		return "", fmt.Errorf("shares are for %q, which is not the id of the key they give", r.owner)
+	}
+	if err := ls.saveKeys(&dk, publicInfo{Name: name, Id: id, Server: server}); err != nil {
+		return "", err
+	}
+	r.key.Zero()
+	ls.recovery = nil
+	return ls.info.ContactId(), nil
+}
+
+func FinishRecovery(name string) (string, error) {
+	return ls.FinishRecovery(name)
+}
+
+// sharesNeeded returns the number of shares that the recovery in progress still needs.
+func (ls *LifetimeState) sharesNeeded() int {
+	r := ls.recovery
+	if len(r.shares) == 0 {
+		// Every share has a threshold of at least two.
+		return 2
+	}
+	if n := r.threshold - len(r.shares); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// openBackupShare opens a share that ownerKey sealed to key with MakeBackupShares, and checks that
+// it's ownerId's share.
+func openBackupShare(key *xcrypt.DualKey, ownerKey *xcrypt.DualPublicKey, ownerId string, envelope []byte) (*backupShare, error) {
+	data, err := key.OpenEnvelope(rand.Reader, ownerKey, envelope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open share: %v", err)
+	}
+	var share backupShare
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&share); err != nil {
+		return nil, fmt.Errorf("unable to read share: %v", err)
+	}
+	if share.Owner != ownerId {
+		return nil, fmt.Errorf("share belongs to %q, not %q", share.Owner, ownerId)
+	}
+	if !bytes.Equal(share.Fingerprint, ownerKey.Fingerprint()) {
+		return nil, fmt.Errorf("share is not for %q's key", ownerId)
+	}
+	return &share, nil
+}
+
+// heldSharePath is where the share held for ownerId is stored.
+func (ls *LifetimeState) heldSharePath(ownerId string) string {
+	return filepath.Join(ls.rootDir, "shares", base64.URLEncoding.EncodeToString([]byte(ownerId)))
+}
@@ -0,0 +1,103 @@
+package xault
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackupShares(t *testing.T) {
+	Convey("keys can be recovered from shares held by contacts", t, func() {
+		// owner backs up their key with holders, then recovers it on a new device.
+		users := make([]*LifetimeState, 4)
+		for i := range users {
+			users[i] = &LifetimeState{}
+			dir := makeTestRootDir()
+			defer os.RemoveAll(dir)
+			So(users[i].SetRootDir(dir), ShouldBeNil)
+			_, err := users[i].MakeKeys("this is a name")
+			So(err, ShouldBeNil)
+		}
+		owner, holders := users[0], users[1:]
+		ownerKey := owner.public
+		var ids []string
+		for _, holder := range holders {
+			So(owner.AddContactKey(holder.info.ContactId(), holder.public.String()), ShouldBeNil)
+			So(holder.AddContactKey(owner.info.ContactId(), ownerKey.String()), ShouldBeNil)
+			ids = append(ids, holder.info.ContactId())
+		}
+
+		_, err := owner.MakeBackupShares(strings.Join(ids, " "), 4)
+		So(err, ShouldNotBeNil)
+		_, err = owner.MakeBackupShares(ids[0]+" nobody@thisisaserver.com", 2)
+		So(err, ShouldNotBeNil)
+		_, err = owner.MakeBackupShares(ids[0]+" "+owner.info.ContactId(), 2)
+		So(err, ShouldNotBeNil)
+
+		out, err := owner.MakeBackupShares(strings.Join(ids, " "), 2)
+		So(err, ShouldBeNil)
+		var shares map[string][]byte
+		So(json.Unmarshal([]byte(out), &shares), ShouldBeNil)
+		So(len(shares), ShouldEqual, len(holders))
+		for i, holder := range holders {
+			So(holder.StoreBackupShare(owner.info.ContactId(), shares[ids[i]]), ShouldBeNil)
+		}
+		// A share can only be stored by the contact it was made for.
+		So(holders[0].StoreBackupShare(owner.info.ContactId(), shares[ids[1]]), ShouldNotBeNil)
+
+		var recovered LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(recovered.SetRootDir(dir), ShouldBeNil)
+		_, err = recovered.AddRecoveryShare(nil)
+		So(err, ShouldNotBeNil)
+		recoveryKey, err := recovered.BeginRecovery()
+		So(err, ShouldBeNil)
+		_, err = holders[0].ReleaseBackupShare("nobody@thisisaserver.com", recoveryKey)
+		So(err, ShouldNotBeNil)
+
+		released, err := holders[2].ReleaseBackupShare(owner.info.ContactId(), recoveryKey)
+		So(err, ShouldBeNil)
+		needed, err := recovered.AddRecoveryShare(released)
+		So(err, ShouldBeNil)
+		So(needed, ShouldEqual, 1)
+		_, err = recovered.FinishRecovery("this is a name")
+		So(err, ShouldNotBeNil)
+
+		// Adding the same share again doesn't help.
+		needed, err = recovered.AddRecoveryShare(released)
+		So(err, ShouldBeNil)
+		So(needed, ShouldEqual, 1)
+
+		// Shares released to a different recovery key can't be used.
+		otherKey, err := owner.BeginRecovery()
+		So(err, ShouldBeNil)
+		wrong, err := holders[0].ReleaseBackupShare(owner.info.ContactId(), otherKey)
+		So(err, ShouldBeNil)
+		_, err = recovered.AddRecoveryShare(wrong)
+		So(err, ShouldNotBeNil)
+
+		released, err = holders[0].ReleaseBackupShare(owner.info.ContactId(), recoveryKey)
+		So(err, ShouldBeNil)
+		needed, err = recovered.AddRecoveryShare(released)
+		So(err, ShouldBeNil)
+		So(needed, ShouldEqual, 0)
+
+		// The shares have to be for the id that the key was given.
+		ownerId := recovered.recovery.owner
+		recovered.recovery.owner = "someoneelse@" + owner.info.Server
+		_, err = recovered.FinishRecovery("this is a name")
+		So(err, ShouldNotBeNil)
+		recovered.recovery.owner = ownerId
+
+		id, err := recovered.FinishRecovery("this is a name")
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, owner.info.ContactId())
+		So(testKeyString(&recovered), ShouldEqual, testKeyString(owner))
+		So(recovered.LoadKeys(), ShouldBeNil)
+		So(recovered.info.Id, ShouldEqual, owner.info.Id)
+	})
+}
@@ -0,0 +1,379 @@
+package xault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+// The ways that a contact's key can be verified, see VerifyContact.
+const (
+	// VerifiedNone means the key hasn't been verified, it's just what someone said it was.
+	VerifiedNone = ""
+
+	// VerifiedExchange means the keys were exchanged in person with BeginExchange.
+	VerifiedExchange = "exchange"
+
+	// VerifiedSafetyWords means both users read out the words from SafetyWords and they matched.
+	VerifiedSafetyWords = "safety-words"
+
+	// VerifiedFingerprint means the words from FingerprintWords matched what the contact has.
+	VerifiedFingerprint = "fingerprint"
+)
+
+// contact is an entry in the contact book.  It's saved to disk with gob and given to the UI as JSON.
+type contact struct {
+	// ContactId is the contact's id, foo@bar.com.
+	ContactId string
+
+	// Name is what the user calls the contact, it starts out as the name the contact gave.
+	Name string
+
+	// Key is the contact's key, as produced by xcrypt.DualPublicKey.String(), and Fingerprint is its
+	// fingerprint in hex.
+	Key         string
+	Fingerprint string
+
+	// Verified is how the key was verified, one of the Verified constants, and VerifiedAt is when.
+	// Changing the key resets both.
+	Verified   string
+	VerifiedAt time.Time
+
+	// Added is when the contact was added.
+	Added time.Time
+
+	// Permissions are the names of the things that the user has agreed to share with the contact.
+	// What they mean is up to the UI, they're kept sorted and without duplicates.
+	Permissions []string
+
+	// key is Key, parsed.
+	key *xcrypt.DualPublicKey
+}
+
+// contactsFile is how contacts are saved to disk.
+type contactsFile struct {
+	Contacts []*contact
+}
+
+// contactsFileV1 is how contacts were saved to disk in state version 1.
+type contactsFileV1 struct {
+	// Keys maps contact ids to their keys, as produced by xcrypt.DualPublicKey.String().
+	Keys map[string]string
+}
+
+// makeContact makes a new, unverified, contact with key.
+func makeContact(contactId, name string, key *xcrypt.DualPublicKey) *contact {
+	return &contact{
+		ContactId:   contactId,
+		Name:        name,
+		Key:         key.String(),
+		Fingerprint: hex.EncodeToString(key.Fingerprint()),
+		Added:       time.Now(),
+		key:         key,
+	}
+}
+
+// setKey changes c's key, and if it's really a different key then c is no longer verified.
+func (c *contact) setKey(key *xcrypt.DualPublicKey) {
+	fingerprint := hex.EncodeToString(key.Fingerprint())
+	if fingerprint != c.Fingerprint {
+		c.Verified = VerifiedNone
+		c.VerifiedAt = time.Time{}
+	}
+	c.Key = key.String()
+	c.Fingerprint = fingerprint
+	c.key = key
+}
+
+// loadContacts loads the contacts saved by saveContacts, if there are any.
+func (ls *LifetimeState) loadContacts() error {
+	var cf contactsFile
+	if err := ls.loadState("contacts", stateContacts, &cf); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	contacts := make(map[string]*contact)
+	for _, c := range cf.Contacts {
+		dpk, err := xcrypt.DualPublicKeyFromString(c.Key)
+		if err != nil {
+			return fmt.Errorf("unable to parse saved key for %q: %v", c.ContactId, err)
+		}
+		if hex.EncodeToString(dpk.Fingerprint()) != c.Fingerprint {
+			return fmt.Errorf("saved key for %q does not match its fingerprint", c.ContactId)
+		}
+		c.key = dpk
+		contacts[c.ContactId] = c
+	}
+	ls.contacts = contacts
+	return nil
+}
+
+// updateContacts calls update with a copy of the contact book, and if it succeeds saves the copy and
+// makes it the contact book.  That way a failure at any point leaves the contact book as it was.
+func (ls *LifetimeState) updateContacts(update func(contacts map[string]*contact) error) error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	contacts := make(map[string]*contact)
+	for id, c := range ls.contacts {
+		copied := *c
+		copied.Permissions = append([]string(nil), c.Permissions...)
+		contacts[id] = &copied
+	}
+	if err := update(contacts); err != nil {
+		return err
+	}
+	var cf contactsFile
+	for _, c := range contacts {
+		cf.Contacts = append(cf.Contacts, c)
+	}
+	sort.Slice(cf.Contacts, func(i, j int) bool { return cf.Contacts[i].ContactId < cf.Contacts[j].ContactId })
+	if err := ls.saveState("contacts", stateContacts, cf); err != nil {
+		return err
+	}
+	ls.contacts = contacts
+	return nil
+}
+
+// AddContact adds contactId to the contact book with name and key, a string produced by
+// xcrypt.DualPublicKey.String().  Ids are derived from keys, so contactId has to belong to key.  It's
+// an error if contactId is already a contact.
+func (ls *LifetimeState) AddContact(contactId, name, key string) error {
+	dpk, err := xcrypt.DualPublicKeyFromString(key)
+	if err != nil {
+		return fmt.Errorf("unable to parse key for %q: %v", contactId, err)
+	}
+	if err := checkContactId(contactId, dpk); err != nil {
+		return err
+	}
+	return ls.updateContacts(func(contacts map[string]*contact) error {
+		if _, ok := contacts[contactId]; ok {
+			return fmt.Errorf("%q is already a contact", contactId)
+		}
+		contacts[contactId] = makeContact(contactId, strings.TrimSpace(name), dpk)
+		return nil
+	})
+}
+
+func AddContact(contactId, name, key string) error {
+	return ls.AddContact(contactId, name, key)
+}
+
+// AddContactKey remembers that key, a string produced by xcrypt.DualPublicKey.String(), belongs to
+// contactId, so that it can be used to verify things from that contact.  contactId is added to the
+// contact book if it isn't already there.  Like AddContact, contactId has to belong to key, so this
+// can't change the key of a contact that's already there.
+func (ls *LifetimeState) AddContactKey(contactId, key string) error {
+	dpk, err := xcrypt.DualPublicKeyFromString(key)
+	if err != nil {
+		return fmt.Errorf("unable to parse key for %q: %v", contactId, err)
+	}
+	if err := checkContactId(contactId, dpk); err != nil {
+		return err
+	}
+	return ls.updateContacts(func(contacts map[string]*contact) error {
+		if c, ok := contacts[contactId]; ok {
+			c.setKey(dpk)
+		} else {
+			contacts[contactId] = makeContact(contactId, "", dpk)
+		}
+		return nil
+	})
+}
+
+func AddContactKey(contactId, key string) error {
+	return ls.AddContactKey(contactId, key)
+}
+
+// GetContact returns contactId's entry in the contact book as a JSON object with the fields
+// ContactId, Name, Key, Fingerprint, Verified, VerifiedAt, Added, and Permissions.
+func (ls *LifetimeState) GetContact(contactId string) (string, error) {
+	c, ok := ls.contacts[contactId]
+	if !ok {
+		return "", fmt.Errorf("no such contact %q", contactId)
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func GetContact(contactId string) (string, error) {
+	return ls.GetContact(contactId)
+}
+
+// ListContacts returns every contact as a JSON array of the objects returned by GetContact, sorted
+// by name and then by id.
+func (ls *LifetimeState) ListContacts() (string, error) {
+	return ls.SearchContacts("")
+}
+
+func ListContacts() (string, error) {
+	return ls.ListContacts()
+}
+
+// SearchContacts is like ListContacts, but only returns the contacts whose name or id contains
+// query, ignoring case.
+func (ls *LifetimeState) SearchContacts(query string) (string, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	found := []*contact{}
+	for _, c := range ls.contacts {
+		if strings.Contains(strings.ToLower(c.Name), query) || strings.Contains(strings.ToLower(c.ContactId), query) {
+			found = append(found, c)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Name != found[j].Name {
+			return found[i].Name < found[j].Name
+		}
+		return found[i].ContactId < found[j].ContactId
+	})
+	out, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func SearchContacts(query string) (string, error) {
+	return ls.SearchContacts(query)
+}
+
+// SetContactName changes the name of contactId.
+func (ls *LifetimeState) SetContactName(contactId, name string) error {
+	return ls.updateContact(contactId, func(c *contact) error {
+		c.Name = strings.TrimSpace(name)
+		return nil
+	})
+}
+
+func SetContactName(contactId, name string) error {
+	return ls.SetContactName(contactId, name)
+}
+
+// VerifyContact records that contactId's key was verified by method, one of the Verified
+// constants.  VerifiedNone marks the key as unverified again.
+func (ls *LifetimeState) VerifyContact(contactId, method string) error {
+	switch method {
+	case VerifiedNone, VerifiedExchange, VerifiedSafetyWords, VerifiedFingerprint:
+	default:
+		return fmt.Errorf("unknown verification method %q", method)
+	}
+	return ls.updateContact(contactId, func(c *contact) error {
+		c.Verified = method
+		c.VerifiedAt = time.Time{}
+		if method != VerifiedNone {
+			c.VerifiedAt = time.Now()
+		}
+		return nil
+	})
+}
+
+func VerifyContact(contactId, method string) error {
+	return ls.VerifyContact(contactId, method)
+}
+
+// SetContactPermissions replaces the permissions of contactId with the whitespace-separated names
+// in permissions.
+func (ls *LifetimeState) SetContactPermissions(contactId, permissions string) error {
+	return ls.updateContact(contactId, func(c *contact) error {
+		seen := make(map[string]bool)
+		c.Permissions = nil
+		for _, permission := range strings.Fields(permissions) {
+			if !seen[permission] {
+				seen[permission] = true
+				c.Permissions = append(c.Permissions, permission)
+			}
+		}
+		sort.Strings(c.Permissions)
+		return nil
+	})
+}
+
+func SetContactPermissions(contactId, permissions string) error {
+	return ls.SetContactPermissions(contactId, permissions)
+}
+
+// RemoveContact removes contactId from the contact book.
+func (ls *LifetimeState) RemoveContact(contactId string) error {
+	return ls.updateContacts(func(contacts map[string]*contact) error {
+		if _, ok := contacts[contactId]; !ok {
+			return fmt.Errorf("no such contact %q", contactId)
+		}
+		delete(contacts, contactId)
+		return nil
+	})
+}
+
+func RemoveContact(contactId string) error {
+	return ls.RemoveContact(contactId)
+}
+
+// updateContact calls update with contactId's entry in a copy of the contact book, see
+// updateContacts.
+func (ls *LifetimeState) updateContact(contactId string, update func(c *contact) error) error {
+	return ls.updateContacts(func(contacts map[string]*contact) error {
+		c, ok := contacts[contactId]
+		if !ok {
+			return fmt.Errorf("no such contact %q", contactId)
+		}
+		return update(c)
+	})
+}
+
+// contactKey returns the public key of contactId, which may also be this user's own id.
+func (ls *LifetimeState) contactKey(contactId string) (*xcrypt.DualPublicKey, error) {
+	if contactId == ls.info.ContactId() {
+		return ls.public, nil
+	}
+	c, ok := ls.contacts[contactId]
+	if !ok {
+		return nil, fmt.Errorf("no such contact %q", contactId)
+	}
+	return c.key, nil
+}
+
+// checkContactId checks that contactId is the id that belongs to key, see idFromKey.
+func checkContactId(contactId string, key *xcrypt.DualPublicKey) error {
+	id, server, ok := strings.Cut(contactId, "@")
+	if !ok || server == "" || id != base64.URLEncoding.EncodeToString(key.Fingerprint()) {
+		return fmt.Errorf("contact id %q does not belong to the key", contactId)
+	}
+	return nil
+}
+
+// migrateContactsV1 converts contacts from state version 1, which only had keys, to version 2.
+func migrateContactsV1(data []byte) ([]byte, error) {
+	var v1 contactsFileV1
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v1); err != nil {
+		return nil, err
+	}
+	var v2 contactsFile
+	for contactId, key := range v1.Keys {
+		dpk, err := xcrypt.DualPublicKeyFromString(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse key for %q: %v", contactId, err)
+		}
+		c := makeContact(contactId, "", dpk)
+		// There's no way to know when it was really added.
+		c.Added = time.Time{}
+		v2.Contacts = append(v2.Contacts, c)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v2); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
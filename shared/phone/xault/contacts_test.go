@@ -0,0 +1,105 @@
+package xault
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContacts(t *testing.T) {
+	users := make([]*LifetimeState, 3)
+	for i := range users {
+		users[i] = &LifetimeState{}
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		if err := users[i].SetRootDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users[i].MakeKeys("this is a name"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := users[0], users[1], users[2]
+	getContact := func(ls *LifetimeState, contactId string) *contact {
+		out, err := ls.GetContact(contactId)
+		So(err, ShouldBeNil)
+		var got contact
+		So(json.Unmarshal([]byte(out), &got), ShouldBeNil)
+		return &got
+	}
+	listContacts := func(out string, err error) []string {
+		So(err, ShouldBeNil)
+		var got []*contact
+		So(json.Unmarshal([]byte(out), &got), ShouldBeNil)
+		ids := []string{}
+		for _, c := range got {
+			ids = append(ids, c.ContactId)
+		}
+		return ids
+	}
+
+	Convey("contacts can be added, changed, found, and removed", t, func() {
+		bId, cId := b.info.ContactId(), c.info.ContactId()
+		So(a.AddContact(bId, " Bob ", b.public.String()), ShouldBeNil)
+		So(a.AddContact(bId, "Bob", b.public.String()), ShouldNotBeNil)
+		So(a.AddContact(cId, "Carol", b.public.String()), ShouldNotBeNil)
+		So(a.AddContact(cId, "Carol", "not a key"), ShouldNotBeNil)
+		So(a.AddContact(cId, "Carol", c.public.String()), ShouldBeNil)
+
+		got := getContact(a, bId)
+		So(got.Name, ShouldEqual, "Bob")
+		So(got.Key, ShouldEqual, b.public.String())
+		fingerprint, err := b.Fingerprint()
+		So(err, ShouldBeNil)
+		So(got.Fingerprint, ShouldEqual, fingerprint)
+		So(got.Verified, ShouldEqual, VerifiedNone)
+		So(got.Added.IsZero(), ShouldBeFalse)
+		_, err = a.GetContact("nobody@thisisaserver.com")
+		So(err, ShouldNotBeNil)
+
+		So(a.SetContactName(bId, "Robert"), ShouldBeNil)
+		So(a.SetContactName("nobody@thisisaserver.com", "Nobody"), ShouldNotBeNil)
+		So(a.VerifyContact(bId, "by guessing"), ShouldNotBeNil)
+		So(a.VerifyContact(bId, VerifiedSafetyWords), ShouldBeNil)
+		So(a.SetContactPermissions(bId, "files backup files"), ShouldBeNil)
+		got = getContact(a, bId)
+		So(got.Name, ShouldEqual, "Robert")
+		So(got.Verified, ShouldEqual, VerifiedSafetyWords)
+		So(got.VerifiedAt.IsZero(), ShouldBeFalse)
+		So(got.Permissions, ShouldResemble, []string{"backup", "files"})
+
+		// The same key again doesn't change anything, and a key that the id doesn't belong to can't
+		// replace it.
+		So(a.AddContactKey(bId, b.public.String()), ShouldBeNil)
+		So(getContact(a, bId).Verified, ShouldEqual, VerifiedSafetyWords)
+		So(a.AddContactKey(bId, c.public.String()), ShouldNotBeNil)
+		got = getContact(a, bId)
+		So(got.Key, ShouldEqual, b.public.String())
+		So(got.Verified, ShouldEqual, VerifiedSafetyWords)
+		So(got.Name, ShouldEqual, "Robert")
+
+		So(listContacts(a.ListContacts()), ShouldResemble, []string{cId, bId})
+		So(listContacts(a.SearchContacts("ROB")), ShouldResemble, []string{bId})
+		So(listContacts(a.SearchContacts(cId[:10])), ShouldResemble, []string{cId})
+		So(listContacts(a.SearchContacts("thisisaserver")), ShouldResemble, []string{cId, bId})
+		So(listContacts(a.SearchContacts("dave")), ShouldResemble, []string{})
+
+		// The contact book is saved.
+		var a1 LifetimeState
+		So(a1.SetRootDir(a.rootDir), ShouldBeNil)
+		So(a1.LoadKeys(), ShouldBeNil)
+		before, err := a.ListContacts()
+		So(err, ShouldBeNil)
+		after, err := a1.ListContacts()
+		So(err, ShouldBeNil)
+		So(after, ShouldEqual, before)
+
+		So(a.RemoveContact(cId), ShouldBeNil)
+		So(a.RemoveContact(cId), ShouldNotBeNil)
+		So(listContacts(a.ListContacts()), ShouldResemble, []string{bId})
+		_, err = a.contactKey(cId)
+		So(err, ShouldNotBeNil)
+	})
+}
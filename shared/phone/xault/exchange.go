@@ -0,0 +1,449 @@
+package xault
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
+)
+
+// The exchange is the Add Contact handshake from server/notes.txt, done by two phones that are next
+// to each other.  The messages are just bytes, so they can be carried over NFC, Bluetooth, QR codes,
+// or anything else.  It takes three messages:
+// A->B: hello, A's contact id, name, public key, and a new nonce Ra, all signed by A
+// B->A: reply, B's contact id, name, public key, and a new nonce Rb, and Envelope(H(hello, reply))
+// A->B: confirm, Envelope(H(hello, reply))
+// Only B can seal the envelope in the reply, and it covers Ra, which A just made up, so A knows that
+// the reply isn't a replay and that B has the private half of the key it sent.  The confirm does the
+// same for B with Rb.  The notes stop after the reply, but without the confirm B has no way to tell
+// a fresh hello from a replayed one.  Each hash covers everything that was sent before it, and uses
+// a different label, so no part of one exchange can be used in another.
+const (
+	exchangeVersion   = 1
+	exchangeNonceSize = 32
+
+	// exchangeMaxAge is how far a hello's signiature time can be from now.  Both phones are right
+	// there, so anything older is a replay.
+	exchangeMaxAge = 10 * time.Minute
+
+	// exchangeMaxMessageSize is the size of the largest message that will be decoded.  Real messages
+	// are a couple of kilobytes.
+	exchangeMaxMessageSize = 64 * 1024
+
+	exchangeHelloLabel   = "xault exchange hello"
+	exchangeReplyLabel   = "xault exchange reply"
+	exchangeConfirmLabel = "xault exchange confirm"
+)
+
+// The types of exchange messages, in the order that they're sent.
+const (
+	exchangeHello = iota + 1
+	exchangeReply
+	exchangeConfirm
+)
+
+// exchangeMessage is every message of the exchange, gobbed.
+type exchangeMessage struct {
+	Version int
+	Type    int
+
+	// ContactId, Name, Key, and Nonce are only set in hellos and replies.  Key is the sender's
+	// DualPublicKey in its binary encoding.
+	ContactId string
+	Name      string
+	Key       []byte
+	Nonce     []byte
+
+	// Sig is only set in hellos, Envelope is only set in replies and confirms.
+	Sig      []byte
+	Envelope []byte
+}
+
+// exchangeState is the exchange that's in progress, or that has just completed.
+type exchangeState struct {
+	// initiator is true for the side that called BeginExchange.
+	initiator bool
+
+	// expecting is the type of the next message, or 0 once the exchange is complete.
+	expecting int
+
+	// nonce is this side's nonce.  helloDigest and replyDigest are the digests of the hello and
+	// reply, once they've been sent or received.
+	nonce                    []byte
+	helloDigest, replyDigest []byte
+
+	// These describe the other side, once their hello or reply has been received.
+	peer     *xcrypt.DualPublicKey
+	peerId   string
+	peerName string
+}
+
+// exchangeResult is what ExchangeResult returns, as JSON.
+type exchangeResult struct {
+	ContactId string
+	Name      string
+}
+
+// BeginExchange starts adding a contact by exchanging keys with them, forgetting about any exchange
+// that was already in progress.  It returns the first message, to send to the other phone, which
+// should pass it to HandleExchangeMessage.  Only one of the phones should call BeginExchange, but if
+// both do then one of them gives way when it gets the other's message.
+func (ls *LifetimeState) BeginExchange() ([]byte, error) {
+	if err := ls.checkKeys(); err != nil {
+		return nil, err
+	}
+	ls.exchange = nil
+	nonce, err := makeExchangeNonce()
+	if err != nil {
+		return nil, err
+	}
+	hello, err := ls.exchangeIntro(exchangeHello, nonce)
+	if err != nil {
+		return nil, err
+	}
+	digest := exchangeIntroDigest(hello)
+	err = ls.withKey(func(dk *xcrypt.DualKey) error {
+		var err error
+		hello.Sig, err = dk.Sign(rand.Reader, digest, exchangeHelloLabel)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeExchangeMessage(hello)
+	if err != nil {
+		return nil, err
+	}
+	ls.exchange = &exchangeState{initiator: true, expecting: exchangeReply, nonce: nonce, helloDigest: digest}
+	return data, nil
+}
+
+func BeginExchange() ([]byte, error) {
+	return ls.BeginExchange()
+}
+
+// HandleExchangeMessage handles a message from the other phone and returns the message to send back,
+// or nil if there's nothing to send.  Once it has returned without error on the side that called
+// BeginExchange, and then on the other side, the exchange is complete and ExchangeResult says who
+// was added.  If it returns an error then the exchange is over and has to be started again.
+func (ls *LifetimeState) HandleExchangeMessage(msg []byte) ([]byte, error) {
+	if err := ls.checkKeys(); err != nil {
+		return nil, err
+	}
+	reply, err := ls.handleExchangeMessage(msg)
+	if err != nil {
+		ls.exchange = nil
+		return nil, err
+	}
+	return reply, nil
+}
+
+func HandleExchangeMessage(msg []byte) ([]byte, error) {
+	return ls.HandleExchangeMessage(msg)
+}
+
+// ExchangeResult returns the contact that was added by the last exchange, as a JSON object with the
+// contact's ContactId and Name.  It's an error to call it before the exchange is complete.
+func (ls *LifetimeState) ExchangeResult() (string, error) {
+	ex := ls.exchange
+	if ex == nil || ex.expecting != 0 {
+		return "", fmt.Errorf("no exchange has completed")
+	}
+	out, err := json.Marshal(exchangeResult{ContactId: ex.peerId, Name: ex.peerName})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func ExchangeResult() (string, error) {
+	return ls.ExchangeResult()
+}
+
+func (ls *LifetimeState) handleExchangeMessage(msg []byte) ([]byte, error) {
+	m, err := decodeExchangeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case exchangeHello:
+		return ls.handleHello(m)
+	case exchangeReply:
+		return ls.handleReply(m)
+	case exchangeConfirm:
+		return nil, ls.handleConfirm(m)
+	}
+	return nil, fmt.Errorf("unknown exchange message type %d", m.Type)
+}
+
+// handleHello checks a hello and makes the reply to it.
+func (ls *LifetimeState) handleHello(hello *exchangeMessage) ([]byte, error) {
+	if ex := ls.exchange; ex != nil && ex.initiator && ex.expecting == exchangeReply {
+		// Both sides began an exchange, the one with the lower nonce gives way and replies.  The
+		// other ignores this hello and waits for that reply.
+		if bytes.Compare(ex.nonce, hello.Nonce) > 0 {
+			return nil, nil
+		}
+	}
+	peer, helloDigest, err := ls.checkExchangeIntro(hello)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := peer.Verify(helloDigest, hello.Sig)
+	if err != nil {
+		return nil, fmt.Errorf("exchange hello is not signed by its key: %v", err)
+	}
+	if sig.Context != exchangeHelloLabel {
+		return nil, fmt.Errorf("exchange hello has the wrong signiature")
+	}
+	if age := time.Since(sig.Time); age > exchangeMaxAge || age < -exchangeMaxAge {
+		return nil, fmt.Errorf("exchange hello is too old, or one of the phones has the wrong time")
+	}
+	if err := ls.rememberHello(hello.Nonce, sig.Time); err != nil {
+		return nil, err
+	}
+
+	nonce, err := makeExchangeNonce()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ls.exchangeIntro(exchangeReply, nonce)
+	if err != nil {
+		return nil, err
+	}
+	replyDigest := exchangeIntroDigest(reply)
+	proof := exchangeProof(exchangeReplyLabel, helloDigest, replyDigest)
+	err = ls.withKey(func(dk *xcrypt.DualKey) error {
+		var err error
+		reply.Envelope, err = dk.SealEnvelope(rand.Reader, peer, proof)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeExchangeMessage(reply)
+	if err != nil {
+		return nil, err
+	}
+	ls.exchange = &exchangeState{
+		expecting:   exchangeConfirm,
+		nonce:       nonce,
+		helloDigest: helloDigest,
+		replyDigest: replyDigest,
+		peer:        peer,
+		peerId:      hello.ContactId,
+		peerName:    hello.Name,
+	}
+	return data, nil
+}
+
+// handleReply checks a reply to this side's hello, completes the exchange, and makes the confirm.
+func (ls *LifetimeState) handleReply(reply *exchangeMessage) ([]byte, error) {
+	ex := ls.exchange
+	if ex == nil || !ex.initiator || ex.expecting != exchangeReply {
+		return nil, fmt.Errorf("not expecting an exchange reply, call BeginExchange() first")
+	}
+	peer, replyDigest, err := ls.checkExchangeIntro(reply)
+	if err != nil {
+		return nil, err
+	}
+	if err := ls.checkExchangeProof(peer, reply.Envelope, exchangeProof(exchangeReplyLabel, ex.helloDigest, replyDigest)); err != nil {
+		return nil, err
+	}
+	confirm := &exchangeMessage{Version: exchangeVersion, Type: exchangeConfirm}
+	proof := exchangeProof(exchangeConfirmLabel, ex.helloDigest, replyDigest)
+	err = ls.withKey(func(dk *xcrypt.DualKey) error {
+		var err error
+		confirm.Envelope, err = dk.SealEnvelope(rand.Reader, peer, proof)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeExchangeMessage(confirm)
+	if err != nil {
+		return nil, err
+	}
+	ex.replyDigest = replyDigest
+	ex.peer = peer
+	ex.peerId = reply.ContactId
+	ex.peerName = reply.Name
+	if err := ls.completeExchange(ex); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// handleConfirm checks the confirm of this side's reply and completes the exchange.
+func (ls *LifetimeState) handleConfirm(confirm *exchangeMessage) error {
+	ex := ls.exchange
+	if ex == nil || ex.initiator || ex.expecting != exchangeConfirm {
+		return fmt.Errorf("not expecting an exchange confirm")
+	}
+	if err := ls.checkExchangeProof(ex.peer, confirm.Envelope, exchangeProof(exchangeConfirmLabel, ex.helloDigest, ex.replyDigest)); err != nil {
+		return err
+	}
+	return ls.completeExchange(ex)
+}
+
+// completeExchange adds the other side to the contact book, verified by the exchange.  If they were
+// already a contact then their name is only set if it wasn't already.
+func (ls *LifetimeState) completeExchange(ex *exchangeState) error {
+	err := ls.updateContacts(func(contacts map[string]*contact) error {
+		c, ok := contacts[ex.peerId]
+		if ok {
+			c.setKey(ex.peer)
+		} else {
+			c = makeContact(ex.peerId, ex.peerName, ex.peer)
+			contacts[ex.peerId] = c
+		}
+		if c.Name == "" {
+			c.Name = ex.peerName
+		}
+		c.Verified = VerifiedExchange
+		c.VerifiedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ex.expecting = 0
+	return nil
+}
+
+// rememberHello records that a hello with nonce, signed at t, has been handled, and returns an error
+// if one already was.  Hellos are only remembered for as long as they'd pass the age check.
+func (ls *LifetimeState) rememberHello(nonce []byte, t time.Time) error {
+	if ls.seenHellos == nil {
+		ls.seenHellos = make(map[string]time.Time)
+	}
+	for seen, when := range ls.seenHellos {
+		if time.Since(when) > exchangeMaxAge {
+			delete(ls.seenHellos, seen)
+		}
+	}
+	if _, ok := ls.seenHellos[string(nonce)]; ok {
+		return fmt.Errorf("exchange hello has already been used")
+	}
+	ls.seenHellos[string(nonce)] = t
+	return nil
+}
+
+// exchangeIntro makes a hello or a reply from this user with nonce.
+func (ls *LifetimeState) exchangeIntro(msgType int, nonce []byte) (*exchangeMessage, error) {
+	key, err := ls.public.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &exchangeMessage{
+		Version:   exchangeVersion,
+		Type:      msgType,
+		ContactId: ls.info.ContactId(),
+		Name:      ls.info.Name,
+		Key:       key,
+		Nonce:     nonce,
+	}, nil
+}
+
+// checkExchangeIntro checks that a hello or reply is from someone else and that its contact id
+// belongs to its key, and returns the key and the digest of the message.
+func (ls *LifetimeState) checkExchangeIntro(m *exchangeMessage) (*xcrypt.DualPublicKey, []byte, error) {
+	if len(m.Nonce) != exchangeNonceSize {
+		return nil, nil, fmt.Errorf("exchange nonce must be %d bytes", exchangeNonceSize)
+	}
+	var dpk xcrypt.DualPublicKey
+	if err := dpk.UnmarshalBinary(m.Key); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse exchanged key: %v", err)
+	}
+	if err := dpk.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("exchanged key is invalid: %v", err)
+	}
+	if bytes.Equal(dpk.Fingerprint(), ls.public.Fingerprint()) {
+		return nil, nil, fmt.Errorf("can't exchange keys with yourself")
+	}
+	// Ids are derived from keys, so a contact id can't be claimed with another key.
+	if err := checkContactId(m.ContactId, &dpk); err != nil {
+		return nil, nil, err
+	}
+	return &dpk, exchangeIntroDigest(m), nil
+}
+
+// checkExchangeProof opens envelope from peer and checks that it contains proof.
+func (ls *LifetimeState) checkExchangeProof(peer *xcrypt.DualPublicKey, envelope, proof []byte) error {
+	var opened []byte
+	err := ls.withKey(func(dk *xcrypt.DualKey) error {
+		var err error
+		opened, err = dk.OpenEnvelope(rand.Reader, peer, envelope)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to open exchange envelope: %v", err)
+	}
+	if !hmac.Equal(opened, proof) {
+		return fmt.Errorf("exchange envelope is not for this exchange")
+	}
+	return nil
+}
+
+// exchangeIntroDigest returns the digest of everything in a hello or reply, except its signiature.
+func exchangeIntroDigest(m *exchangeMessage) []byte {
+	label := exchangeHelloLabel
+	if m.Type == exchangeReply {
+		label = exchangeReplyLabel
+	}
+	return exchangeDigest(label, []byte(m.ContactId), []byte(m.Name), m.Key, m.Nonce)
+}
+
+// exchangeProof returns what goes in the envelope of a reply or confirm.
+func exchangeProof(label string, helloDigest, replyDigest []byte) []byte {
+	return exchangeDigest(label, helloDigest, replyDigest)
+}
+
+// exchangeDigest returns the SHA-256 hash of label and fields, each preceded by its length so that
+// different fields can't run together to give the same hash.
+func exchangeDigest(label string, fields ...[]byte) []byte {
+	h := sha256.New()
+	for _, field := range append([][]byte{[]byte(label)}, fields...) {
+		binary.Write(h, binary.LittleEndian, uint32(len(field)))
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+func makeExchangeNonce() ([]byte, error) {
+	nonce := make([]byte, exchangeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to make nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+func encodeExchangeMessage(m *exchangeMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeExchangeMessage(data []byte) (*exchangeMessage, error) {
+	if len(data) > exchangeMaxMessageSize {
+		return nil, fmt.Errorf("exchange message is too large")
+	}
+	var m exchangeMessage
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("unable to read exchange message: %v", err)
+	}
+	if m.Version != exchangeVersion {
+		return nil, fmt.Errorf("unknown exchange version %d", m.Version)
+	}
+	return &m, nil
+}
@@ -0,0 +1,233 @@
+package xault
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// runExchangeSide plays one side of an exchange over conn, starting by sending first if it isn't
+// nil.  Messages are sent with their length first, like they would be over any stream.
+func runExchangeSide(ls *LifetimeState, conn net.Conn, first []byte) error {
+	defer conn.Close()
+	send := func(msg []byte) error {
+		if err := binary.Write(conn, binary.LittleEndian, uint32(len(msg))); err != nil {
+			return err
+		}
+		_, err := conn.Write(msg)
+		return err
+	}
+	if first != nil {
+		if err := send(first); err != nil {
+			return err
+		}
+	}
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return err
+		}
+		reply, err := ls.HandleExchangeMessage(msg)
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			if err := send(reply); err != nil {
+				return err
+			}
+		}
+		if ls.exchange.expecting == 0 {
+			return nil
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	users := make([]*LifetimeState, 3)
+	for i := range users {
+		users[i] = &LifetimeState{}
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		if err := users[i].SetRootDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users[i].MakeKeys("this is a name"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := users[0], users[1], users[2]
+
+	Convey("two phones exchange keys over a pipe", t, func() {
+		_, err := a.ExchangeResult()
+		So(err, ShouldNotBeNil)
+		hello, err := a.BeginExchange()
+		So(err, ShouldBeNil)
+		connA, connB := net.Pipe()
+		errs := make(chan error)
+		go func() { errs <- runExchangeSide(b, connB, nil) }()
+		So(runExchangeSide(a, connA, hello), ShouldBeNil)
+		So(<-errs, ShouldBeNil)
+
+		for _, pair := range [][2]*LifetimeState{{a, b}, {b, a}} {
+			out, err := pair[0].ExchangeResult()
+			So(err, ShouldBeNil)
+			var result exchangeResult
+			So(json.Unmarshal([]byte(out), &result), ShouldBeNil)
+			So(result.ContactId, ShouldEqual, pair[1].info.ContactId())
+			So(result.Name, ShouldEqual, pair[1].info.Name)
+			out, err = pair[0].GetContact(result.ContactId)
+			So(err, ShouldBeNil)
+			var added contact
+			So(json.Unmarshal([]byte(out), &added), ShouldBeNil)
+			So(added.Name, ShouldEqual, pair[1].info.Name)
+			So(added.Key, ShouldEqual, pair[1].public.String())
+			So(added.Verified, ShouldEqual, VerifiedExchange)
+		}
+		safetyA, err := a.SafetyWords(b.info.ContactId())
+		So(err, ShouldBeNil)
+		safetyB, err := b.SafetyWords(a.info.ContactId())
+		So(err, ShouldBeNil)
+		So(safetyA, ShouldEqual, safetyB)
+	})
+
+	Convey("users whose keys were saved by the first release can be added and exchange keys", t, func() {
+		var old LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "state", "v0", "keys"))
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "keys"), data, 0600), ShouldBeNil)
+		So(old.SetRootDir(dir), ShouldBeNil)
+		So(old.LoadKeys(), ShouldBeNil)
+		old.setAutoLock(0)
+
+		So(c.AddContact(old.info.ContactId(), old.info.Name, old.public.String()), ShouldBeNil)
+		hello, err := old.BeginExchange()
+		So(err, ShouldBeNil)
+		connOld, connB := net.Pipe()
+		errs := make(chan error)
+		go func() { errs <- runExchangeSide(b, connB, nil) }()
+		So(runExchangeSide(&old, connOld, hello), ShouldBeNil)
+		So(<-errs, ShouldBeNil)
+		_, err = b.contactKey(old.info.ContactId())
+		So(err, ShouldBeNil)
+		_, err = old.contactKey(b.info.ContactId())
+		So(err, ShouldBeNil)
+	})
+
+	Convey("replayed messages are rejected", t, func() {
+		hello, err := a.BeginExchange()
+		So(err, ShouldBeNil)
+		reply, err := b.HandleExchangeMessage(hello)
+		So(err, ShouldBeNil)
+		confirm, err := a.HandleExchangeMessage(reply)
+		So(err, ShouldBeNil)
+		_, err = b.HandleExchangeMessage(confirm)
+		So(err, ShouldBeNil)
+
+		_, err = b.HandleExchangeMessage(confirm)
+		So(err, ShouldNotBeNil)
+		_, err = b.HandleExchangeMessage(hello)
+		So(err, ShouldNotBeNil)
+
+		// c hasn't seen the hello, but the confirm can't be replayed to c's reply.
+		_, err = c.HandleExchangeMessage(hello)
+		So(err, ShouldBeNil)
+		_, err = c.HandleExchangeMessage(confirm)
+		So(err, ShouldNotBeNil)
+		_, err = c.contactKey(a.info.ContactId())
+		So(err, ShouldNotBeNil)
+
+		// An old reply doesn't answer a new hello.
+		_, err = a.BeginExchange()
+		So(err, ShouldBeNil)
+		_, err = a.HandleExchangeMessage(reply)
+		So(err, ShouldNotBeNil)
+		_, err = a.HandleExchangeMessage(reply)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("tampered messages are rejected", t, func() {
+		tamper := func(msg []byte, f func(m *exchangeMessage)) []byte {
+			m, err := decodeExchangeMessage(msg)
+			So(err, ShouldBeNil)
+			f(m)
+			data, err := encodeExchangeMessage(m)
+			So(err, ShouldBeNil)
+			return data
+		}
+
+		hello, err := a.BeginExchange()
+		So(err, ShouldBeNil)
+		_, err = c.HandleExchangeMessage(tamper(hello, func(m *exchangeMessage) { m.Name = "someone else" }))
+		So(err, ShouldNotBeNil)
+		_, err = c.HandleExchangeMessage(tamper(hello, func(m *exchangeMessage) { m.ContactId = b.info.ContactId() }))
+		So(err, ShouldNotBeNil)
+		_, err = c.HandleExchangeMessage(tamper(hello, func(m *exchangeMessage) { m.Key = testPublicKeyBinary(c) }))
+		So(err, ShouldNotBeNil)
+		_, err = c.HandleExchangeMessage(hello[:len(hello)/2])
+		So(err, ShouldNotBeNil)
+
+		reply, err := c.HandleExchangeMessage(hello)
+		So(err, ShouldBeNil)
+		_, err = a.HandleExchangeMessage(tamper(reply, func(m *exchangeMessage) { m.Name = "someone else" }))
+		So(err, ShouldNotBeNil)
+
+		// The failure ended a's exchange, so even the real reply is rejected now.
+		_, err = a.HandleExchangeMessage(reply)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("a phone can't exchange keys with itself", t, func() {
+		hello, err := a.BeginExchange()
+		So(err, ShouldBeNil)
+		_, err = a.HandleExchangeMessage(hello)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("if both phones begin then one of them gives way", t, func() {
+		helloA, err := a.BeginExchange()
+		So(err, ShouldBeNil)
+		helloC, err := c.BeginExchange()
+		So(err, ShouldBeNil)
+		replyA, err := a.HandleExchangeMessage(helloC)
+		So(err, ShouldBeNil)
+		replyC, err := c.HandleExchangeMessage(helloA)
+		So(err, ShouldBeNil)
+		So((replyA == nil) != (replyC == nil), ShouldBeTrue)
+
+		first, second := a, c
+		reply := replyC
+		if reply == nil {
+			first, second, reply = c, a, replyA
+		}
+		confirm, err := first.HandleExchangeMessage(reply)
+		So(err, ShouldBeNil)
+		_, err = second.HandleExchangeMessage(confirm)
+		So(err, ShouldBeNil)
+		_, err = a.ExchangeResult()
+		So(err, ShouldBeNil)
+		_, err = c.ExchangeResult()
+		So(err, ShouldBeNil)
+	})
+}
+
+// testPublicKeyBinary returns ls's public key in its binary encoding.
+func testPublicKeyBinary(ls *LifetimeState) []byte {
+	key, err := ls.public.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,126 @@
+package xault
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// stateVersion is the version of the encoding of everything saved under rootDir.  Whenever the
+// encoding of any kind of state changes, stateVersion must be bumped, a migration from the previous
+// version must be added to stateMigrations, and fixtures of the previous version must be added to
+// testdata/state so that the migration stays tested.
+const stateVersion = 2
+
+// The kinds of state that are saved under rootDir.
+const (
+	stateKeys     = "keys"
+	stateContacts = "contacts"
+	stateSettings = "settings"
+	stateShare    = "share"
+)
+
+// stateMagic starts every file that's saved in a state container.  Files that don't start with it
+// were saved before there was a container, and they're version 0.
+var stateMagic = []byte("xault state\n")
+
+// stateContainer is what every file under rootDir is saved as, after stateMagic.  Data is the gob
+// encoding of the state in the given version's encoding for its kind.
+type stateContainer struct {
+	Kind    string
+	Version int
+	Data    []byte
+}
+
+// stateMigrations[i] converts the data of a kind of state from version i to version i+1.
+var stateMigrations = []func(kind string, data []byte) ([]byte, error){
+	migrateStateV0,
+	migrateStateV1,
+}
+
+// migrateStateV0 converts version 0 state, which is what the first release saved, to version 1.
+// The first release only saved keys, and it saved them with gob encoding the key's fields rather
+// than with the key's binary encoding.
+func migrateStateV0(kind string, data []byte) ([]byte, error) {
+	if kind == stateKeys {
+		return migrateKeysV0(data)
+	}
+	return nil, fmt.Errorf("%s were not saved before version 1", kind)
+}
+
+// migrateStateV1 converts version 1 state to version 2, which added names, verification, and
+// permissions to contacts.
+func migrateStateV1(kind string, data []byte) ([]byte, error) {
+	if kind == stateContacts {
+		return migrateContactsV1(data)
+	}
+	return data, nil
+}
+
+// encodeState encodes v, which must be the current version's type for kind, in a state container.
+func encodeState(kind string, v interface{}) ([]byte, error) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(v); err != nil {
+		return nil, fmt.Errorf("unable to encode %s: %v", kind, err)
+	}
+	buf := bytes.NewBuffer(append([]byte{}, stateMagic...))
+	container := stateContainer{Kind: kind, Version: stateVersion, Data: data.Bytes()}
+	if err := gob.NewEncoder(buf).Encode(container); err != nil {
+		return nil, fmt.Errorf("unable to encode %s: %v", kind, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeState decodes state of kind that was saved by encodeState, in any version up to the
+// current one, into v.  Older versions are migrated to the current version first.
+func decodeState(kind string, data []byte, v interface{}) error {
+	version := 0
+	if bytes.HasPrefix(data, stateMagic) {
+		var container stateContainer
+		if err := gob.NewDecoder(bytes.NewReader(data[len(stateMagic):])).Decode(&container); err != nil {
+			return fmt.Errorf("%s container is malformed: %v", kind, err)
+		}
+		if container.Kind != kind {
+			return fmt.Errorf("expected %s but found %s", kind, container.Kind)
+		}
+		if container.Version < 1 {
+			return fmt.Errorf("%s container has invalid version %d", kind, container.Version)
+		}
+		if container.Version > stateVersion {
+			return fmt.Errorf("%s were saved by a newer version of xault (version %d, this is version %d)", kind, container.Version, stateVersion)
+		}
+		version, data = container.Version, container.Data
+	}
+	for ; version < stateVersion; version++ {
+		var err error
+		if data, err = stateMigrations[version](kind, data); err != nil {
+			return fmt.Errorf("unable to migrate %s from version %d: %v", kind, version, err)
+		}
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", kind, err)
+	}
+	return nil
+}
+
+// saveState atomically saves v as the state of kind in the file name under rootDir.
+func (ls *LifetimeState) saveState(name, kind string, v interface{}) error {
+	data, err := encodeState(kind, v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ls.rootDir, name), data, 0600)
+}
+
+// loadState loads the state of kind saved by saveState in the file name under rootDir into v.  If
+// the file can't be read then the error is the one from reading it, so os.IsNotExist can be used to
+// tell whether it was ever saved.
+func (ls *LifetimeState) loadState(name, kind string, v interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(ls.rootDir, name))
+	if err != nil {
+		return err
+	}
+	return decodeState(kind, data, v)
+}
@@ -0,0 +1,147 @@
+package xault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fixtureId is the id of the keys in every fixture under testdata/state, once they're loaded.  The
+// first release saved them with the random id fixtureV0Id instead.
+const (
+	fixtureId   = "D7Ubg3vtkxQ5osCv7SpS1d_qv6y0lYfVJK93AmSgdGo="
+	fixtureV0Id = "AwoRGB8mLTQ7QklQV15lbHN6gYiPlp2kq7K5wMfO1dw="
+)
+
+// fixtureFriendId is the only contact in the fixtures under testdata/state from version 2 on.
+const fixtureFriendId = "LfsRS4Ds_WnGrett3FdflFHzVryFSlQUFicSeXL2BmM=@thisisaserver.com"
+
+func TestStateFixtures(t *testing.T) {
+	Convey("state saved by every previous version can be loaded", t, func() {
+		So(len(stateMigrations), ShouldEqual, stateVersion)
+		for _, fixture := range []struct {
+			dir, passphrase string
+			hasShare        bool
+		}{
+			{"v0", "", false},
+			{"v1", "1234", true},
+			{"v2", "1234", true},
+		} {
+			var ls LifetimeState
+			dir := filepath.Join("testdata", "state", fixture.dir)
+			So(ls.SetRootDir(dir), ShouldBeNil)
+			So(ls.LoadKeys(), ShouldBeNil)
+			So(ls.IsLocked(), ShouldEqual, fixture.passphrase != "")
+			So(ls.LoadKeysWithPassphrase(fixture.passphrase), ShouldBeNil)
+			So(ls.info.Id, ShouldEqual, fixtureId)
+			So(ls.info.Name, ShouldEqual, "fixture name")
+			So(base64.URLEncoding.EncodeToString(ls.public.Fingerprint()), ShouldEqual, fixtureId)
+			ls.setAutoLock(0)
+
+			if fixture.hasShare {
+				data, err := ioutil.ReadFile(ls.heldSharePath("owner@thisisaserver.com"))
+				So(err, ShouldBeNil)
+				var held heldShare
+				So(decodeState(stateShare, data, &held), ShouldBeNil)
+				So(held.OwnerKey, ShouldEqual, ls.public.String())
+				So(string(held.Envelope), ShouldEqual, "this is an envelope")
+			}
+		}
+
+		// The first release's random id is replaced by the id of its key.
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "state", "v0", "keys"))
+		So(err, ShouldBeNil)
+		var v0 keyFileV0
+		So(gob.NewDecoder(bytes.NewReader(data)).Decode(&v0), ShouldBeNil)
+		So(v0.Info.Id, ShouldEqual, fixtureV0Id)
+		_, err = migrateKeysV0([]byte("not keys"))
+		So(err, ShouldNotBeNil)
+
+		// Contacts and settings were first saved in version 1, when contacts were only keys.
+		var ls LifetimeState
+		So(ls.SetRootDir(filepath.Join("testdata", "state", "v1")), ShouldBeNil)
+		So(ls.phraseLanguage, ShouldEqual, "de")
+		So(ls.autoLock, ShouldEqual, 300*time.Second)
+		So(ls.LoadKeysWithPassphrase("1234"), ShouldBeNil)
+		ls.setAutoLock(0)
+		So(ls.contacts, ShouldHaveLength, 1)
+		c := ls.contacts["friend@thisisaserver.com"]
+		So(c, ShouldNotBeNil)
+		So(c.Key, ShouldEqual, ls.public.String())
+		So(c.Fingerprint, ShouldEqual, hex.EncodeToString(ls.public.Fingerprint()))
+		So(c.Name, ShouldEqual, "")
+		So(c.Verified, ShouldEqual, VerifiedNone)
+		So(c.Added.IsZero(), ShouldBeTrue)
+		_, err = migrateContactsV1([]byte("not contacts"))
+		So(err, ShouldNotBeNil)
+
+		// Contacts got names and verification in version 2.
+		ls = LifetimeState{}
+		So(ls.SetRootDir(filepath.Join("testdata", "state", "v2")), ShouldBeNil)
+		So(ls.LoadKeysWithPassphrase("1234"), ShouldBeNil)
+		friend, err := ls.contactKey(fixtureFriendId)
+		So(err, ShouldBeNil)
+		So(checkContactId(fixtureFriendId, friend), ShouldBeNil)
+		c = ls.contacts[fixtureFriendId]
+		So(c.Name, ShouldEqual, "fixture friend")
+		So(c.Fingerprint, ShouldEqual, hex.EncodeToString(friend.Fingerprint()))
+		So(c.Verified, ShouldEqual, VerifiedNone)
+		ls.setAutoLock(0)
+	})
+}
+
+func TestStateContainer(t *testing.T) {
+	Convey("state containers check their kind and version", t, func() {
+		sf := settingsFile{PhraseLanguage: "es", AutoLockSeconds: 10}
+		data, err := encodeState(stateSettings, sf)
+		So(err, ShouldBeNil)
+		So(bytes.HasPrefix(data, stateMagic), ShouldBeTrue)
+		var decoded settingsFile
+		So(decodeState(stateSettings, data, &decoded), ShouldBeNil)
+		So(decoded, ShouldResemble, sf)
+		So(decodeState(stateContacts, data, &decoded), ShouldNotBeNil)
+		So(decodeState(stateSettings, data[:len(data)-3], &decoded), ShouldNotBeNil)
+
+		var buf bytes.Buffer
+		buf.Write(stateMagic)
+		So(gob.NewEncoder(&buf).Encode(stateContainer{Kind: stateSettings, Version: stateVersion + 1}), ShouldBeNil)
+		err = decodeState(stateSettings, buf.Bytes(), &decoded)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "newer version")
+
+		// Only keys were saved before there was a container.
+		buf.Reset()
+		So(gob.NewEncoder(&buf).Encode(sf), ShouldBeNil)
+		So(decodeState(stateSettings, buf.Bytes(), &decoded), ShouldNotBeNil)
+	})
+
+	Convey("contacts are saved", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		So(ls0.AddContactKey(ls0.info.ContactId(), ls0.public.String()), ShouldBeNil)
+
+		var ls1 LifetimeState
+		So(ls1.SetRootDir(dir), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldBeNil)
+		friend, err := ls1.contactKey(ls0.info.ContactId())
+		So(err, ShouldBeNil)
+		So(friend.String(), ShouldEqual, ls0.public.String())
+
+		So(ioutil.WriteFile(filepath.Join(dir, "contacts"), []byte("not contacts"), 0600), ShouldBeNil)
+		var ls2 LifetimeState
+		So(ls2.SetRootDir(dir), ShouldNotBeNil)
+		So(ls2.rootDir, ShouldEqual, "")
+	})
+}
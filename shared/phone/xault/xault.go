@@ -2,12 +2,19 @@ package xault
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
 )
@@ -19,12 +26,48 @@ import (
 var ls LifetimeState
 
 type LifetimeState struct {
-	// TODO: Hide keys in memory with a boojum when not in use.
-	key *xcrypt.DualKey
+	// key is this user's key, sealed in a boojum so that its private values are only in memory in
+	// the clear while withKey is using them.  It's nil while the keys are locked.  public is the
+	// public half of key, it isn't secret so Lock leaves it alone.
+	key    *xcrypt.Boojum
+	public *xcrypt.DualPublicKey
+
+	// autoLock is how long the keys can go unused before they're locked automatically, or zero if
+	// they never are.  autoLockTimer is the countdown to that, it's only running while keys that
+	// have a passphrase are unlocked.  The timer locks the keys from its own goroutine, so key and
+	// autoLockTimer are guarded by keyMu.
+	keyMu         sync.Mutex
+	autoLock      time.Duration
+	autoLockTimer *time.Timer
 
 	info *publicInfo
 
+	// contacts is the contact book, it maps contact ids to contacts.
+	contacts map[string]*contact
+
 	rootDir string
+
+	// hasPassphrase is true if the key file is protected by a passphrase.  If it is then key is
+	// only set while the keys are unlocked.
+	hasPassphrase bool
+
+	// phraseLanguage is the language of recovery phrases made by MakeKeys, or empty for the
+	// default language.
+	phraseLanguage string
+
+	// cancelMakeKeys cancels the call to MakeKeys that is in progress, if there is one.  It's
+	// guarded by mu because CancelMakeKeys is called from a different thread than MakeKeys.
+	mu             sync.Mutex
+	cancelMakeKeys context.CancelFunc
+
+	// recovery is the recovery from backup shares that's in progress, if there is one.
+	recovery *recoveryState
+
+	// exchange is the contact exchange that's in progress or that just completed, if there is one.
+	// seenHellos maps the nonces of recently handled exchange hellos to when they were signed, so
+	// that they can't be replayed.
+	exchange   *exchangeState
+	seenHellos map[string]time.Time
 }
 
 type publicInfo struct {
@@ -38,6 +81,11 @@ type publicInfo struct {
 	Server string
 }
 
+// ContactId returns the id that other users know this user by, foo@bar.com.
+func (pi *publicInfo) ContactId() string {
+	return pi.Id + "@" + pi.Server
+}
+
 // SetRootDir sets the directory under which all files will be read/written.  It should be called
 // before any other function, and it should be called exactly once.
 func (ls *LifetimeState) SetRootDir(path string) error {
@@ -45,6 +93,14 @@ func (ls *LifetimeState) SetRootDir(path string) error {
 		return fmt.Errorf("SetRootDir has already been called")
 	}
 	ls.rootDir = path
+	if err := ls.loadSettings(); err != nil {
+		ls.rootDir = ""
+		return err
+	}
+	if err := ls.loadContacts(); err != nil {
+		ls.rootDir = ""
+		return err
+	}
 	return nil
 }
 
@@ -54,68 +110,395 @@ func SetRootDir(path string) error {
 
 // This is the structure that is actually gobbed to disk to save a user's keys and id.
 type keyFile struct {
-	Key  *xcrypt.DualKey
+	// Key is the user's key, unless it's protected by a passphrase.  Then Key is nil and
+	// EncryptedKey is the key's binary encoding sealed with xcrypt.SealWithPassphrase.
+	Key          *xcrypt.DualKey
+	EncryptedKey []byte
+
+	// Info isn't secret, so it's never encrypted and can be loaded while the key is locked.
 	Info publicInfo
 }
 
-// MakeKeys generates an id and keys for that id and saves them to disk.
-func (ls *LifetimeState) MakeKeys(name string) error {
+// keyFileV0 is how the first release of xault saved keys, before there was a state container or a
+// binary encoding of keys, so gob encoded the key's fields.
+type keyFileV0 struct {
+	Key  *dualKeyV0
+	Info publicInfo
+}
+
+// dualKeyV0 has the fields that xcrypt.DualKey had in the first release.
+type dualKeyV0 struct {
+	D0, D1, P, Q *big.Int
+}
+
+// migrateKeysV0 converts keys saved by the first release to state version 1.  The first release
+// gave users a random id rather than one derived from their key, see idFromKey, but it never
+// registered or shared its ids, so the id is replaced with the one that the key would have now.
+func migrateKeysV0(data []byte) ([]byte, error) {
+	var v0 keyFileV0
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v0); err != nil {
+		return nil, err
+	}
+	if v0.Key == nil {
+		return nil, fmt.Errorf("it does not contain a key")
+	}
+	v1 := keyFile{
+		Key:  &xcrypt.DualKey{D0: v0.Key.D0, D1: v0.Key.D1, P: v0.Key.P, Q: v0.Key.Q},
+		Info: v0.Info,
+	}
+	id, err := idFromKey(v1.Key)
+	if err != nil {
+		return nil, err
+	}
+	v1.Info.Id = id
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v1); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// settingsFile is how settings are saved to disk.
+type settingsFile struct {
+	PhraseLanguage  string
+	AutoLockSeconds int
+}
+
+// loadSettings loads the settings saved by saveSettings, if there are any.
+func (ls *LifetimeState) loadSettings() error {
+	var sf settingsFile
+	if err := ls.loadState("settings", stateSettings, &sf); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	ls.phraseLanguage = sf.PhraseLanguage
+	ls.setAutoLock(time.Duration(sf.AutoLockSeconds) * time.Second)
+	return nil
+}
+
+func (ls *LifetimeState) saveSettings() error {
+	return ls.saveState("settings", stateSettings, settingsFile{
+		PhraseLanguage:  ls.phraseLanguage,
+		AutoLockSeconds: int(ls.autoLock / time.Second),
+	})
+}
+
+// KeyProgress is implemented by the UI to find out how far along MakeKeysWithProgress is.
+type KeyProgress interface {
+	// Progress is called with the current stage of key generation, one of the xcrypt Stage
+	// constants, and the fraction of that stage that is complete.
+	Progress(stage string, frac float64)
+}
+
+// phraseBits is the amount of entropy in the recovery phrase made by MakeKeys.
+const phraseBits = 128
+
+// MakeKeys generates keys, a recovery phrase for those keys, and an id derived from those keys, and
+// saves the keys and id to disk.  The phrase is returned so that it can be shown to the user to
+// write down.  It isn't saved anywhere, so this is the only chance to show it.  RecoverKeys can use
+// the phrase to get the same keys and id back.
+func (ls *LifetimeState) MakeKeys(name string) (string, error) {
+	return ls.MakeKeysWithProgress(name, nil)
+}
+
+func MakeKeys(name string) (string, error) {
+	return ls.MakeKeys(name)
+}
+
+// MakeKeysWithProgress is like MakeKeys, but it reports progress to progress, if it isn't nil, and
+// it can be aborted by calling CancelMakeKeys from another thread.
+func (ls *LifetimeState) MakeKeysWithProgress(name string, progress KeyProgress) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	km := xcrypt.DefaultKeyMaker()
+	if ls.phraseLanguage != "" {
+		var err error
+		if km, err = km.InLanguage(ls.phraseLanguage); err != nil {
+			return "", err
+		}
+	}
+	var phrase []string
+	dk, err := ls.generateKey(progress, func(ctx context.Context, report func(string, float64)) (xcrypt.PrivateKey, error) {
+		key, generated, err := km.GenerateKeyAndPhraseContext(ctx, rand.Reader, phraseBits, report)
+		phrase = generated
+		return key, err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := ls.saveNewKeys(name, dk); err != nil {
+		return "", err
+	}
+	return strings.Join(phrase, " "), nil
+}
+
+func MakeKeysWithProgress(name string, progress KeyProgress) (string, error) {
+	return ls.MakeKeysWithProgress(name, progress)
+}
+
+// SetPhraseLanguage sets the language of the recovery phrases made by MakeKeys, for example "es" or
+// "de".  Phrases in any supported language can be given to RecoverKeys regardless of this setting.
+// The setting is saved, so it only needs to be set once.
+func (ls *LifetimeState) SetPhraseLanguage(language string) error {
 	if err := ls.checkInitted(); err != nil {
 		return err
 	}
-	// Make sure the name is reasonable.
+	if _, err := xcrypt.DefaultKeyMaker().InLanguage(language); err != nil {
+		return err
+	}
+	old := ls.phraseLanguage
+	ls.phraseLanguage = language
+	if err := ls.saveSettings(); err != nil {
+		ls.phraseLanguage = old
+		return err
+	}
+	return nil
+}
+
+func SetPhraseLanguage(language string) error {
+	return ls.SetPhraseLanguage(language)
+}
+
+// RecoverKeys regenerates the keys and id that MakeKeys made along with phrase, and saves them to
+// disk.  Minor misspellings in phrase are corrected automatically, the corrected phrase is returned
+// so that the user can see which words were corrected and fix their copy.  The phrase's language is
+// detected automatically.
+func (ls *LifetimeState) RecoverKeys(name, phrase string) (string, error) {
+	return ls.RecoverKeysWithProgress(name, phrase, nil)
+}
+
+func RecoverKeys(name, phrase string) (string, error) {
+	return ls.RecoverKeys(name, phrase)
+}
+
+// RecoverKeysWithProgress is like RecoverKeys, but it reports progress like MakeKeysWithProgress,
+// and it can also be aborted by calling CancelMakeKeys.
+func (ls *LifetimeState) RecoverKeysWithProgress(name, phrase string, progress KeyProgress) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	km := xcrypt.DefaultKeyMaker()
+	var corrected []string
+	dk, err := ls.generateKey(progress, func(ctx context.Context, report func(string, float64)) (xcrypt.PrivateKey, error) {
+		key, words, err := km.RegenerateKeyFromPhraseContext(ctx, strings.Fields(phrase), report)
+		corrected = words
+		return key, err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := ls.saveNewKeys(name, dk); err != nil {
+		return "", err
+	}
+	return strings.Join(corrected, " "), nil
+}
+
+func RecoverKeysWithProgress(name, phrase string, progress KeyProgress) (string, error) {
+	return ls.RecoverKeysWithProgress(name, phrase, progress)
+}
+
+// CancelMakeKeys aborts the call to MakeKeys, RecoverKeys, or their WithProgress variants that is in
+// progress, which will then return an error without saving anything.  It does nothing if no keys
+// are being made.
+func (ls *LifetimeState) CancelMakeKeys() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.cancelMakeKeys != nil {
+		ls.cancelMakeKeys()
+	}
+}
+
+func CancelMakeKeys() {
+	ls.CancelMakeKeys()
+}
+
+// checkName makes sure the name is reasonable.
+func checkName(name string) error {
 	minNameLen := 5
 	if len(name) < minNameLen {
 		return fmt.Errorf("name must be at least %d characters long", minNameLen)
 	}
+	return nil
+}
+
+// generateKey calls generate to make a key in a way that can be cancelled by CancelMakeKeys, and
+// passes progress on to it.
+func (ls *LifetimeState) generateKey(progress KeyProgress, generate func(ctx context.Context, report func(string, float64)) (xcrypt.PrivateKey, error)) (*xcrypt.DualKey, error) {
+	if err := ls.checkInitted(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ls.mu.Lock()
+	if ls.cancelMakeKeys != nil {
+		ls.mu.Unlock()
+		return nil, fmt.Errorf("keys are already being made")
+	}
+	ls.cancelMakeKeys = cancel
+	ls.mu.Unlock()
+	defer func() {
+		ls.mu.Lock()
+		ls.cancelMakeKeys = nil
+		ls.mu.Unlock()
+	}()
+	var report func(string, float64)
+	if progress != nil {
+		report = progress.Progress
+	}
+	key, err := generate(ctx, report)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("making keys was cancelled")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The server and the key file only know how to handle DualKeys so far, which is why versions.txt
+	// only has versions that make DualKeys.
+	dk, ok := key.(*xcrypt.DualKey)
+	if !ok {
+		return nil, fmt.Errorf("%s keys are not supported yet", key.Algorithm())
+	}
+	return dk, nil
+}
 
-	// Create a random id.
-	idBits := make([]byte, 32)
-	if n, err := rand.Read(idBits); n != len(idBits) || err != nil {
-		return fmt.Errorf("unable to generate an id")
+// idFromKey derives a user's id from their key, so that recovering the key also recovers the id.
+// The id is the fingerprint of the public key in base64 so it's human 'readable'.
+func idFromKey(dk *xcrypt.DualKey) (string, error) {
+	dpk, err := dk.MakePublicKey()
+	if err != nil {
+		return "", err
 	}
-	// Convert the id to base64 so it's human 'readable'.
-	idBuf := bytes.NewBuffer(nil)
-	enc := base64.NewEncoder(base64.URLEncoding, idBuf)
-	enc.Write(idBits)
-	enc.Close()
+	return base64.URLEncoding.EncodeToString(dpk.Fingerprint()), nil
+}
 
-	// Create a new dual key
-	dk, err := xcrypt.MakeDualKey(rand.Reader, 2048)
+// saveNewKeys saves dk to disk along with name and the id derived from dk, then makes them the
+// current keys and info.
+func (ls *LifetimeState) saveNewKeys(name string, dk *xcrypt.DualKey) error {
+	id, err := idFromKey(dk)
 	if err != nil {
 		return err
 	}
+	return ls.saveKeys(dk, publicInfo{Name: name, Id: id, Server: "thisisaserver.com"})
+}
 
+// saveKeys saves dk and info to disk, then makes them the current keys and info.
+func (ls *LifetimeState) saveKeys(dk *xcrypt.DualKey, info publicInfo) error {
 	// Put all this file into a single struct so we can gob it to disk.
 	fileData := keyFile{
-		Key: dk,
-		Info: publicInfo{
-			Name:   name,
-			Id:     string(idBuf.Bytes()),
-			Server: "thisisaserver.com",
-		},
+		Key:  dk,
+		Info: info,
+	}
+	if err := ls.writeKeyFile(&fileData, true); err != nil {
+		return err
+	}
+
+	// Everything was successful, so set the global state and return successfully.
+	ls.hasPassphrase = false
+	if err := ls.setKey(dk); err != nil {
+		return err
 	}
+	ls.info = &fileData.Info
+
+	return nil
+}
+
+// keyFilePath returns the path of the key file.  The previous generation of the key file is kept
+// at backupPath(keyFilePath()).
+func (ls *LifetimeState) keyFilePath() string {
+	return filepath.Join(ls.rootDir, "keys")
+}
+
+// ErrKeysFromBackup is returned by LoadKeys and Unlock when the key file is corrupt and the keys
+// were loaded from the backup instead.  The keys can be used, but the backup is the previous
+// generation of the key file, so they might be an older identity than the one the user last made,
+// and the user needs to be told.  ChangePassphrase refuses to save keys loaded from the backup, call
+// RestoreKeysFromBackup to keep them for good, or MakeKeys to start over.
+var ErrKeysFromBackup = fmt.Errorf("the key file is corrupt, the keys were loaded from the backup of the previous keys")
 
-	// Save it to disk.
-	path := filepath.Join(ls.rootDir, "keys")
-	f, err := os.Create(path)
+// readKeyFile reads the key file without decrypting or validating the key, migrating it from an
+// older version if necessary.  If the key file is corrupt then the backup of the previous
+// generation is read instead, and fromBackup is true.
+func (ls *LifetimeState) readKeyFile() (kf *keyFile, fromBackup bool, err error) {
+	path := ls.keyFilePath()
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("unable to open %q: %v", path, err)
+		return nil, false, fmt.Errorf("unable to open %q: %v", path, err)
 	}
-	defer f.Close()
-	if err := gob.NewEncoder(f).Encode(fileData); err != nil {
-		return fmt.Errorf("unable to save keys to disk: %v", err)
+	kf, err = decodeKeyFile(data)
+	if err == nil {
+		return kf, false, nil
+	}
+	data, backupErr := ioutil.ReadFile(backupPath(path))
+	if backupErr == nil {
+		if kf, backupErr = decodeKeyFile(data); backupErr == nil {
+			return kf, true, nil
+		}
 	}
+	return nil, false, fmt.Errorf("key file %q is corrupt (%v) and so is its backup (%v)", path, err, backupErr)
+}
 
-	// Everything was successful, so set the global state and return successfully.
-	ls.key = fileData.Key
-	ls.info = &fileData.Info
+// decodeKeyFile decodes a key file saved by writeKeyFile, or by any earlier version of xault.
+func decodeKeyFile(data []byte) (*keyFile, error) {
+	var kf keyFile
+	if err := decodeState(stateKeys, data, &kf); err != nil {
+		return nil, err
+	}
+	if kf.Key == nil && kf.EncryptedKey == nil {
+		return nil, fmt.Errorf("it does not contain a key")
+	}
+	return &kf, nil
+}
 
+// writeKeyFile atomically saves kf as the key file.  If keepOld is true then the key file that's
+// being replaced becomes the backup, as long as it isn't corrupt, so that a mistake like making new
+// keys over the top of the old ones can be undone.  Otherwise the backup is replaced with kf too,
+// which is what ChangePassphrase needs so that the key doesn't stay on disk under the old
+// passphrase, or under none at all.
+func (ls *LifetimeState) writeKeyFile(kf *keyFile, keepOld bool) error {
+	data, err := encodeState(stateKeys, kf)
+	if err != nil {
+		return fmt.Errorf("unable to save keys to disk: %v", err)
+	}
+	path := ls.keyFilePath()
+	if keepOld {
+		if old, err := ioutil.ReadFile(path); err == nil {
+			if _, err := decodeKeyFile(old); err == nil {
+				if err := writeFileAtomic(backupPath(path), old, 0600); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	if !keepOld {
+		return writeFileAtomic(backupPath(path), data, 0600)
+	}
 	return nil
 }
 
-func MakeKeys(name string) error {
-	return ls.MakeKeys(name)
+// decryptKey returns the key in kf, decrypting it with passphrase if it's encrypted, and checks that
+// it's valid.
+func decryptKey(kf *keyFile, passphrase string) (*xcrypt.DualKey, error) {
+	dk := kf.Key
+	if kf.EncryptedKey != nil {
+		data, err := xcrypt.OpenWithPassphrase(passphrase, kf.EncryptedKey)
+		if err != nil {
+			return nil, err
+		}
+		dk = &xcrypt.DualKey{}
+		if err := dk.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("encrypted key is malformed: %v", err)
+		}
+	}
+	if err := dk.Validate(); err != nil {
+		return nil, fmt.Errorf("key is invalid: %v", err)
+	}
+	return dk, nil
 }
 
 func (ls *LifetimeState) checkInitted() error {
@@ -125,41 +508,436 @@ func (ls *LifetimeState) checkInitted() error {
 	return nil
 }
 
+var errKeysLocked = fmt.Errorf("keys are locked, call Unlock() first")
+
+func (ls *LifetimeState) checkKeys() error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	if ls.IsLocked() {
+		return errKeysLocked
+	}
+	if ls.public == nil {
+		return fmt.Errorf("must call MakeKeys() or LoadKeys() first")
+	}
+	return nil
+}
+
+// checkPublicKey is like checkKeys, but it only needs this user's public key, which stays loaded
+// while the keys are locked once they've been unlocked.
+func (ls *LifetimeState) checkPublicKey() error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	if ls.public == nil {
+		if ls.IsLocked() {
+			return errKeysLocked
+		}
+		return fmt.Errorf("must call MakeKeys() or LoadKeys() first")
+	}
+	return nil
+}
+
+// withKey calls f with this user's key, which is only decrypted for as long as f runs and is zeroed
+// as soon as f returns, so f must not hold on to it.  Using the key restarts the auto-lock countdown.
+func (ls *LifetimeState) withKey(f func(dk *xcrypt.DualKey) error) error {
+	if err := ls.checkKeys(); err != nil {
+		return err
+	}
+	ls.keyMu.Lock()
+	b := ls.key
+	ls.resetAutoLock()
+	ls.keyMu.Unlock()
+	if b == nil {
+		// The keys were locked automatically since checkKeys.
+		return errKeysLocked
+	}
+	err := b.With(func(key xcrypt.PrivateKey) error {
+		dk, ok := key.(*xcrypt.DualKey)
+		if !ok {
+			return fmt.Errorf("%s keys are not supported yet", key.Algorithm())
+		}
+		return f(dk)
+	})
+	if err == xcrypt.ErrBoojumZeroed {
+		return errKeysLocked
+	}
+	return err
+}
+
+// setKey seals dk in a boojum and makes it the current key.  dk is zeroed, so the caller can't use
+// it afterwards.
+func (ls *LifetimeState) setKey(dk *xcrypt.DualKey) error {
+	defer dk.Zero()
+	dpk, err := dk.MakePublicKey()
+	if err != nil {
+		return err
+	}
+	b, err := xcrypt.MakeBoojum(rand.Reader, dk)
+	if err != nil {
+		return err
+	}
+	ls.keyMu.Lock()
+	defer ls.keyMu.Unlock()
+	ls.forgetKey()
+	ls.key = b
+	ls.public = dpk
+	ls.resetAutoLock()
+	return nil
+}
+
+// forgetKey zeroes the key and stops the auto-lock countdown.  keyMu must be held.
+func (ls *LifetimeState) forgetKey() {
+	if ls.key != nil {
+		ls.key.Zero()
+		ls.key = nil
+	}
+	ls.resetAutoLock()
+}
+
+// resetAutoLock restarts the auto-lock countdown, or stops it if the keys shouldn't be locked
+// automatically.  keyMu must be held.
+func (ls *LifetimeState) resetAutoLock() {
+	if ls.autoLockTimer != nil {
+		ls.autoLockTimer.Stop()
+		ls.autoLockTimer = nil
+	}
+	if ls.autoLock == 0 || ls.key == nil || !ls.hasPassphrase {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ls.autoLock, func() {
+		ls.keyMu.Lock()
+		defer ls.keyMu.Unlock()
+		// The countdown may have been restarted after this fired but before it got keyMu.
+		if ls.autoLockTimer == timer {
+			ls.forgetKey()
+		}
+	})
+	ls.autoLockTimer = timer
+}
+
+// SetAutoLock makes the keys lock themselves after they've gone unused for the given number of
+// seconds, so that they aren't left unlocked if the phone is.  Zero turns auto-locking off, which is
+// the default.  Only keys that are protected by a passphrase are ever locked.  The setting is saved,
+// so it only needs to be set once.
+func (ls *LifetimeState) SetAutoLock(seconds int) error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	if seconds < 0 {
+		return fmt.Errorf("auto-lock timeout can't be negative")
+	}
+	old := ls.autoLock
+	ls.setAutoLock(time.Duration(seconds) * time.Second)
+	if err := ls.saveSettings(); err != nil {
+		ls.setAutoLock(old)
+		return err
+	}
+	return nil
+}
+
+func SetAutoLock(seconds int) error {
+	return ls.SetAutoLock(seconds)
+}
+
+func (ls *LifetimeState) setAutoLock(timeout time.Duration) {
+	ls.keyMu.Lock()
+	defer ls.keyMu.Unlock()
+	ls.autoLock = timeout
+	ls.resetAutoLock()
+}
+
+// LoadKeys loads the keys and id saved by MakeKeys.  If the keys are protected by a passphrase then
+// only the id is loaded, and the keys stay locked until Unlock is called.  If they had to be loaded
+// from the backup then they're loaded but ErrKeysFromBackup is returned.
 func (ls *LifetimeState) LoadKeys() error {
 	if err := ls.checkInitted(); err != nil {
 		return err
 	}
-	var kf keyFile
-	path := filepath.Join(ls.rootDir, "keys")
-	f, err := os.Open(path)
+	kf, fromBackup, err := ls.readKeyFile()
 	if err != nil {
-		return fmt.Errorf("unable to open %q: %v", path, err)
+		return err
+	}
+	if kf.EncryptedKey != nil {
+		ls.hasPassphrase = true
+		ls.keyMu.Lock()
+		ls.forgetKey()
+		ls.public = nil
+		ls.keyMu.Unlock()
+		ls.info = &kf.Info
+	} else {
+		dk, err := decryptKey(kf, "")
+		if err != nil {
+			return err
+		}
+		ls.hasPassphrase = false
+		if err := ls.setKey(dk); err != nil {
+			return err
+		}
+		ls.info = &kf.Info
+	}
+	if fromBackup {
+		return ErrKeysFromBackup
+	}
+	return nil
+}
+
+func LoadKeys() error {
+	return ls.LoadKeys()
+}
+
+// LoadKeysWithPassphrase is LoadKeys followed by Unlock.  passphrase is ignored if the keys aren't
+// protected by a passphrase.
+func (ls *LifetimeState) LoadKeysWithPassphrase(passphrase string) error {
+	err := ls.LoadKeys()
+	if err != nil && err != ErrKeysFromBackup {
+		return err
 	}
-	defer f.Close()
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(&kf); err != nil {
+	if !ls.hasPassphrase {
+		return err
+	}
+	return ls.Unlock(passphrase)
+}
+
+func LoadKeysWithPassphrase(passphrase string) error {
+	return ls.LoadKeysWithPassphrase(passphrase)
+}
+
+// Unlock decrypts the keys with passphrase so that they can be used until Lock is called.  Like
+// LoadKeys, it returns ErrKeysFromBackup if the keys it unlocked came from the backup.
+func (ls *LifetimeState) Unlock(passphrase string) error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	kf, fromBackup, err := ls.readKeyFile()
+	if err != nil {
+		return err
+	}
+	dk, err := decryptKey(kf, passphrase)
+	if err != nil {
+		return err
+	}
+	ls.hasPassphrase = kf.EncryptedKey != nil
+	if err := ls.setKey(dk); err != nil {
 		return err
 	}
-	ls.key = kf.Key
 	ls.info = &kf.Info
+	if fromBackup {
+		return ErrKeysFromBackup
+	}
 	return nil
 }
 
-func LoadKeys() error {
+func Unlock(passphrase string) error {
+	return ls.Unlock(passphrase)
+}
+
+// Lock forgets the keys, so that they aren't in memory until Unlock is called again.  The id is
+// still available while the keys are locked.  Only keys that are protected by a passphrase can be
+// locked.
+func (ls *LifetimeState) Lock() error {
+	if !ls.hasPassphrase {
+		return fmt.Errorf("keys without a passphrase can't be locked, call ChangePassphrase() first")
+	}
+	ls.keyMu.Lock()
+	defer ls.keyMu.Unlock()
+	ls.forgetKey()
+	return nil
+}
+
+func Lock() error {
+	return ls.Lock()
+}
+
+// IsLocked returns true if the keys have been loaded but are locked.
+func (ls *LifetimeState) IsLocked() bool {
+	ls.keyMu.Lock()
+	defer ls.keyMu.Unlock()
+	return ls.hasPassphrase && ls.key == nil && ls.info != nil
+}
+
+func IsLocked() bool {
+	return ls.IsLocked()
+}
+
+// ChangePassphrase changes the passphrase that protects the key file from oldPassphrase to
+// newPassphrase.  An empty passphrase means no passphrase, so this is also how a passphrase is added
+// to keys that don't have one, or removed from keys that do.  Removing the passphrase unlocks the
+// keys, otherwise this doesn't change whether they're locked.  The key file replaces its backup,
+// so this fails if the key file is corrupt rather than overwrite the backup with itself.
+func (ls *LifetimeState) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	kf, fromBackup, err := ls.readKeyFile()
+	if err != nil {
+		return err
+	}
+	if fromBackup {
+		return fmt.Errorf("the key file is corrupt, call RestoreKeysFromBackup() or MakeKeys() first")
+	}
+	if kf.EncryptedKey == nil && oldPassphrase != "" {
+		return fmt.Errorf("keys are not protected by a passphrase")
+	}
+	dk, err := decryptKey(kf, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	defer dk.Zero()
+	updated := keyFile{Info: kf.Info}
+	if newPassphrase == "" {
+		updated.Key = dk
+	} else {
+		data, err := dk.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if updated.EncryptedKey, err = xcrypt.SealWithPassphrase(rand.Reader, newPassphrase, data); err != nil {
+			return err
+		}
+	}
+	if err := ls.writeKeyFile(&updated, false); err != nil {
+		return err
+	}
+	ls.hasPassphrase = newPassphrase != ""
+	if !ls.hasPassphrase {
+		return ls.setKey(dk)
+	}
+	// Keys that just got a passphrase can be locked automatically now.
+	ls.keyMu.Lock()
+	ls.resetAutoLock()
+	ls.keyMu.Unlock()
+	return nil
+}
+
+func ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	return ls.ChangePassphrase(oldPassphrase, newPassphrase)
+}
+
+// RestoreKeysFromBackup replaces a corrupt key file with its backup, once the user has agreed to
+// keep the keys that LoadKeys returned ErrKeysFromBackup for, and then loads them.
+func (ls *LifetimeState) RestoreKeysFromBackup() error {
+	if err := ls.checkInitted(); err != nil {
+		return err
+	}
+	path := ls.keyFilePath()
+	data, err := ioutil.ReadFile(backupPath(path))
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %v", backupPath(path), err)
+	}
+	if _, err := decodeKeyFile(data); err != nil {
+		return fmt.Errorf("backup %q is corrupt: %v", backupPath(path), err)
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
 	return ls.LoadKeys()
 }
 
+func RestoreKeysFromBackup() error {
+	return ls.RestoreKeysFromBackup()
+}
+
 func (ls *LifetimeState) DestroyKeys() error {
 	if err := ls.checkInitted(); err != nil {
 		return err
 	}
-	path := filepath.Join(ls.rootDir, "keys")
+	path := ls.keyFilePath()
 	if err := os.Remove(path); err != nil {
 		return fmt.Errorf("Unable to remove %q: %v", path, err)
 	}
+	if err := os.Remove(backupPath(path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove %q: %v", backupPath(path), err)
+	}
 	return nil
 }
 
 func DestroyKeys() error {
 	return ls.DestroyKeys()
 }
+
+// Sign returns a detached signature of data made with this user's keys.
+func (ls *LifetimeState) Sign(data []byte) ([]byte, error) {
+	if err := ls.checkKeys(); err != nil {
+		return nil, err
+	}
+	var sig []byte
+	err := ls.withKey(func(dk *xcrypt.DualKey) error {
+		var err error
+		sig, err = dk.Sign(rand.Reader, data, "")
+		return err
+	})
+	return sig, err
+}
+
+func Sign(data []byte) ([]byte, error) {
+	return ls.Sign(data)
+}
+
+// Verify checks that sig is a signature of data made by contactId with Sign.
+func (ls *LifetimeState) Verify(contactId string, data, sig []byte) error {
+	if err := ls.checkPublicKey(); err != nil {
+		return err
+	}
+	dpk, err := ls.contactKey(contactId)
+	if err != nil {
+		return err
+	}
+	_, err = dpk.Verify(data, sig)
+	return err
+}
+
+func Verify(contactId string, data, sig []byte) error {
+	return ls.Verify(contactId, data, sig)
+}
+
+// Fingerprint returns the fingerprint of this user's public key in hex.
+func (ls *LifetimeState) Fingerprint() (string, error) {
+	if err := ls.checkPublicKey(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ls.public.Fingerprint()), nil
+}
+
+func Fingerprint() (string, error) {
+	return ls.Fingerprint()
+}
+
+// FingerprintWords returns the fingerprint of contactId's public key, which may be this user's own
+// id, as a space-separated list of words that can be read aloud.
+func (ls *LifetimeState) FingerprintWords(contactId string) (string, error) {
+	if err := ls.checkPublicKey(); err != nil {
+		return "", err
+	}
+	km := xcrypt.DefaultKeyMaker()
+	dpk, err := ls.contactKey(contactId)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(km.FingerprintWords(dpk.Fingerprint(), xcrypt.DefaultFingerprintWords), " "), nil
+}
+
+func FingerprintWords(contactId string) (string, error) {
+	return ls.FingerprintWords(contactId)
+}
+
+// SafetyWords returns a space-separated list of words that depends on both this user's key and
+// contactId's key.  If contactId gets the same words for this user then both users have the right
+// keys for each other.
+func (ls *LifetimeState) SafetyWords(contactId string) (string, error) {
+	if err := ls.checkPublicKey(); err != nil {
+		return "", err
+	}
+	km := xcrypt.DefaultKeyMaker()
+	mine := ls.public
+	theirs, err := ls.contactKey(contactId)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(km.SafetyWords(mine, theirs, xcrypt.DefaultFingerprintWords), " "), nil
+}
+
+func SafetyWords(contactId string) (string, error) {
+	return ls.SafetyWords(contactId)
+}
@@ -1,7 +1,16 @@
 package xault
 
 import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/runningwild/xault/shared/phone/xault/xcrypt"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -9,20 +18,417 @@ import (
 func TestDualKeys(t *testing.T) {
 	Convey("something", t, func() {
 		var ls0, ls1 LifetimeState
-		So(ls0.SetRootDir("."), ShouldBeNil)
-		So(ls0.MakeKeys("this is a name"), ShouldBeNil)
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		phrase, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		So(len(strings.Fields(phrase)), ShouldBeGreaterThanOrEqualTo, 10)
 		defer func() {
 			So(ls0.DestroyKeys(), ShouldBeNil)
 		}()
-		So(ls1.SetRootDir("."), ShouldBeNil)
+		So(ls1.SetRootDir(dir), ShouldBeNil)
 		So(ls1.LoadKeys(), ShouldBeNil)
 
 		So(ls1.info.Id, ShouldEqual, ls0.info.Id)
 		So(ls1.info.Name, ShouldEqual, ls0.info.Name)
 		So(ls1.info.Server, ShouldEqual, ls0.info.Server)
-		So(ls1.key.D0.Cmp(ls0.key.D0), ShouldEqual, 0)
-		So(ls1.key.D1.Cmp(ls0.key.D1), ShouldEqual, 0)
-		So(ls1.key.P.Cmp(ls0.key.P), ShouldEqual, 0)
-		So(ls1.key.Q.Cmp(ls0.key.Q), ShouldEqual, 0)
+		So(testKeyString(&ls1), ShouldEqual, testKeyString(&ls0))
+
+		Convey("the phrase recovers the same keys and id", func() {
+			var ls2 LifetimeState
+			dir2 := makeTestRootDir()
+			defer os.RemoveAll(dir2)
+			So(ls2.SetRootDir(dir2), ShouldBeNil)
+
+			// Misspell the first word by swapping its first two letters.
+			words := strings.Fields(phrase)
+			first := []byte(words[0])
+			first[0], first[1] = first[1], first[0]
+			words[0] = string(first)
+			corrected, err := ls2.RecoverKeys("this is a name", strings.Join(words, " "))
+			So(err, ShouldBeNil)
+			So(corrected, ShouldEqual, phrase)
+			So(ls2.info.Id, ShouldEqual, ls0.info.Id)
+			So(testKeyString(&ls2), ShouldEqual, testKeyString(&ls0))
+
+			var ls3 LifetimeState
+			So(ls3.SetRootDir(dir2), ShouldBeNil)
+			So(ls3.LoadKeys(), ShouldBeNil)
+			So(ls3.info.Id, ShouldEqual, ls0.info.Id)
+
+			_, err = ls2.RecoverKeys("this is a name", "not a valid phrase")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("signatures can be verified by contact id", func() {
+			data := []byte("some data to sign")
+			sig, err := ls0.Sign(data)
+			So(err, ShouldBeNil)
+			So(ls1.Verify(ls0.info.ContactId(), data, sig), ShouldBeNil)
+			So(ls1.Verify(ls0.info.ContactId(), []byte("some other data"), sig), ShouldNotBeNil)
+			So(ls1.Verify("nobody@thisisaserver.com", data, sig), ShouldNotBeNil)
+
+			So(ls1.AddContactKey("friend@thisisaserver.com", ls0.public.String()), ShouldNotBeNil)
+			So(ls1.Verify("friend@thisisaserver.com", data, sig), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPassphrase(t *testing.T) {
+	Convey("keys protected by a passphrase are only available while unlocked", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		key := testKeyString(&ls0)
+		var p []byte
+		So(ls0.withKey(func(dk *xcrypt.DualKey) error {
+			p = dk.P.Bytes()
+			return nil
+		}), ShouldBeNil)
+		So(ls0.Lock(), ShouldNotBeNil)
+		So(ls0.ChangePassphrase("1234", "5678"), ShouldNotBeNil)
+		So(ls0.ChangePassphrase("", "1234"), ShouldBeNil)
+		So(ls0.IsLocked(), ShouldBeFalse)
+
+		// The key isn't anywhere in the key file any more.
+		data, err := ioutil.ReadFile(filepath.Join(dir, "keys"))
+		So(err, ShouldBeNil)
+		So(bytes.Contains(data, p), ShouldBeFalse)
+		So(bytes.Contains(data, []byte(ls0.info.Id)), ShouldBeTrue)
+
+		sig, err := ls0.Sign([]byte("data"))
+		So(err, ShouldBeNil)
+		So(ls0.Lock(), ShouldBeNil)
+		So(ls0.IsLocked(), ShouldBeTrue)
+		So(ls0.key, ShouldBeNil)
+		_, err = ls0.Sign([]byte("data"))
+		So(err, ShouldNotBeNil)
+		// Checking signatures only needs public keys.
+		So(ls0.Verify(ls0.info.ContactId(), []byte("data"), sig), ShouldBeNil)
+		So(ls0.Verify(ls0.info.ContactId(), []byte("other data"), sig), ShouldNotBeNil)
+		So(ls0.Unlock("4321"), ShouldEqual, xcrypt.ErrWrongPassphrase)
+		So(ls0.IsLocked(), ShouldBeTrue)
+		So(ls0.Unlock("1234"), ShouldBeNil)
+		So(ls0.IsLocked(), ShouldBeFalse)
+		So(testKeyString(&ls0), ShouldEqual, key)
+		_, err = ls0.Sign([]byte("data"))
+		So(err, ShouldBeNil)
+
+		var ls1 LifetimeState
+		So(ls1.SetRootDir(dir), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldBeNil)
+		So(ls1.IsLocked(), ShouldBeTrue)
+		So(ls1.info.Id, ShouldEqual, ls0.info.Id)
+		So(ls1.checkKeys(), ShouldNotBeNil)
+		// The public key isn't saved outside of the encrypted key, so it needs unlocking once.
+		So(ls1.Verify(ls0.info.ContactId(), []byte("data"), sig), ShouldEqual, errKeysLocked)
+		So(ls1.LoadKeysWithPassphrase("wrong"), ShouldNotBeNil)
+		So(ls1.LoadKeysWithPassphrase("1234"), ShouldBeNil)
+		So(testKeyString(&ls1), ShouldEqual, key)
+
+		So(ls1.ChangePassphrase("wrong", "5678"), ShouldNotBeNil)
+		So(ls1.ChangePassphrase("1234", "5678"), ShouldBeNil)
+		So(ls1.Lock(), ShouldBeNil)
+		So(ls1.Unlock("1234"), ShouldNotBeNil)
+		So(ls1.Unlock("5678"), ShouldBeNil)
+
+		// Removing the passphrase leaves the keys unlocked for good.
+		So(ls1.Lock(), ShouldBeNil)
+		So(ls1.ChangePassphrase("5678", ""), ShouldBeNil)
+		So(ls1.IsLocked(), ShouldBeFalse)
+		So(testKeyString(&ls1), ShouldEqual, key)
+		So(ls1.Lock(), ShouldNotBeNil)
+		var ls2 LifetimeState
+		So(ls2.SetRootDir(dir), ShouldBeNil)
+		So(ls2.LoadKeysWithPassphrase("anything"), ShouldBeNil)
+		So(testKeyString(&ls2), ShouldEqual, key)
+	})
+}
+
+func TestKeyFileBackup(t *testing.T) {
+	Convey("a corrupt key file falls back to the previous generation", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		oldId := ls0.info.Id
+		oldKey := testKeyString(&ls0)
+		_, err = ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		So(ls0.info.Id, ShouldNotEqual, oldId)
+
+		// Nothing is left behind by the atomic writes.
+		names, err := filepath.Glob(filepath.Join(dir, "*"))
+		So(err, ShouldBeNil)
+		So(names, ShouldResemble, []string{filepath.Join(dir, "keys"), filepath.Join(dir, "keys.bak")})
+
+		path := filepath.Join(dir, "keys")
+		So(ioutil.WriteFile(path, []byte("this is not a key file"), 0600), ShouldBeNil)
+		var ls1 LifetimeState
+		So(ls1.SetRootDir(dir), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldEqual, ErrKeysFromBackup)
+		So(ls1.info.Id, ShouldEqual, oldId)
+		So(testKeyString(&ls1), ShouldEqual, oldKey)
+		So(ls1.Unlock(""), ShouldEqual, ErrKeysFromBackup)
+
+		// Keys loaded from the backup aren't written back over it without asking.
+		backup, err := ioutil.ReadFile(path + ".bak")
+		So(err, ShouldBeNil)
+		So(ls1.ChangePassphrase("", "1234"), ShouldNotBeNil)
+		data, err := ioutil.ReadFile(path + ".bak")
+		So(err, ShouldBeNil)
+		So(data, ShouldResemble, backup)
+		data, err = ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "this is not a key file")
+
+		So(ls1.RestoreKeysFromBackup(), ShouldBeNil)
+		So(ls1.info.Id, ShouldEqual, oldId)
+		So(ls1.LoadKeys(), ShouldBeNil)
+		So(testKeyString(&ls1), ShouldEqual, oldKey)
+
+		// Saving new keys doesn't replace a good backup with a corrupt key file.
+		_, err = ls1.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile(path, nil, 0600), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldEqual, ErrKeysFromBackup)
+		So(ls1.info.Id, ShouldEqual, oldId)
+
+		So(ioutil.WriteFile(path+".bak", []byte("neither is this"), 0600), ShouldBeNil)
+		err = ls1.LoadKeys()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "corrupt")
+
+		So(ls1.DestroyKeys(), ShouldBeNil)
+		names, err = filepath.Glob(filepath.Join(dir, "*"))
+		So(err, ShouldBeNil)
+		So(names, ShouldBeEmpty)
+	})
+
+	Convey("changing the passphrase replaces the backup too", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		var p []byte
+		So(ls0.withKey(func(dk *xcrypt.DualKey) error {
+			p = dk.P.Bytes()
+			return nil
+		}), ShouldBeNil)
+		So(ls0.ChangePassphrase("", "1234"), ShouldBeNil)
+		for _, name := range []string{"keys", "keys.bak"} {
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			So(err, ShouldBeNil)
+			So(bytes.Contains(data, p), ShouldBeFalse)
+		}
+	})
+}
+
+func TestSetPhraseLanguage(t *testing.T) {
+	Convey("only supported phrase languages can be set", t, func() {
+		var ls LifetimeState
+		So(ls.SetPhraseLanguage("es"), ShouldNotBeNil)
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls.SetRootDir(dir), ShouldBeNil)
+		So(ls.SetPhraseLanguage("es"), ShouldBeNil)
+		So(ls.phraseLanguage, ShouldEqual, "es")
+		So(ls.SetPhraseLanguage("klingon"), ShouldNotBeNil)
+		So(ls.phraseLanguage, ShouldEqual, "es")
+
+		// The language is saved.
+		var ls1 LifetimeState
+		So(ls1.SetRootDir(dir), ShouldBeNil)
+		So(ls1.phraseLanguage, ShouldEqual, "es")
+	})
+}
+
+func TestAutoLock(t *testing.T) {
+	Convey("keys with a passphrase lock themselves when they go unused", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+		So(ls0.SetAutoLock(-1), ShouldNotBeNil)
+		ls0.setAutoLock(50 * time.Millisecond)
+
+		// Keys without a passphrase are never locked.
+		time.Sleep(100 * time.Millisecond)
+		_, err = ls0.Sign([]byte("data"))
+		So(err, ShouldBeNil)
+
+		So(ls0.ChangePassphrase("", "1234"), ShouldBeNil)
+		time.Sleep(100 * time.Millisecond)
+		So(ls0.IsLocked(), ShouldBeTrue)
+		_, err = ls0.Sign([]byte("data"))
+		So(err, ShouldEqual, errKeysLocked)
+
+		// Using the keys postpones the lock.
+		So(ls0.Unlock("1234"), ShouldBeNil)
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			_, err = ls0.Sign([]byte("data"))
+			So(err, ShouldBeNil)
+		}
+		So(ls0.IsLocked(), ShouldBeFalse)
+
+		ls0.setAutoLock(0)
+		time.Sleep(100 * time.Millisecond)
+		So(ls0.IsLocked(), ShouldBeFalse)
+	})
+}
+
+// testKeyString returns the String of ls's key.
+func testKeyString(ls *LifetimeState) string {
+	var str string
+	err := ls.withKey(func(dk *xcrypt.DualKey) error {
+		str = dk.String()
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return str
+}
+
+// makeTestRootDir makes a temporary directory to use as a root dir.
+func makeTestRootDir() string {
+	dir, err := ioutil.TempDir("", "xault")
+	if err != nil {
+		panic(err)
+	}
+	return dir
+}
+
+func TestFingerprintWords(t *testing.T) {
+	Convey("users can compare keys by reading words aloud", t, func() {
+		var ls0, ls1 LifetimeState
+		for _, ls := range []*LifetimeState{&ls0, &ls1} {
+			dir := makeTestRootDir()
+			defer os.RemoveAll(dir)
+			So(ls.SetRootDir(dir), ShouldBeNil)
+			_, err := ls.MakeKeys("this is a name")
+			So(err, ShouldBeNil)
+		}
+		So(ls0.AddContactKey(ls1.info.ContactId(), ls1.public.String()), ShouldBeNil)
+		So(ls1.AddContactKey(ls0.info.ContactId(), ls0.public.String()), ShouldBeNil)
+
+		fingerprint, err := ls0.Fingerprint()
+		So(err, ShouldBeNil)
+		So(len(fingerprint), ShouldEqual, 64)
+
+		mine, err := ls0.FingerprintWords(ls0.info.ContactId())
+		So(err, ShouldBeNil)
+		theirs, err := ls1.FingerprintWords(ls0.info.ContactId())
+		So(err, ShouldBeNil)
+		So(mine, ShouldEqual, theirs)
+		So(len(strings.Fields(mine)), ShouldEqual, xcrypt.DefaultFingerprintWords)
+
+		safety0, err := ls0.SafetyWords(ls1.info.ContactId())
+		So(err, ShouldBeNil)
+		safety1, err := ls1.SafetyWords(ls0.info.ContactId())
+		So(err, ShouldBeNil)
+		So(safety0, ShouldEqual, safety1)
+
+		// None of it needs the keys to be unlocked.
+		So(ls0.ChangePassphrase("", "1234"), ShouldBeNil)
+		So(ls0.Lock(), ShouldBeNil)
+		locked, err := ls0.Fingerprint()
+		So(err, ShouldBeNil)
+		So(locked, ShouldEqual, fingerprint)
+		locked, err = ls0.FingerprintWords(ls0.info.ContactId())
+		So(err, ShouldBeNil)
+		So(locked, ShouldEqual, mine)
+		locked, err = ls0.SafetyWords(ls1.info.ContactId())
+		So(err, ShouldBeNil)
+		So(locked, ShouldEqual, safety0)
+	})
+}
+
+func TestOldKeyFile(t *testing.T) {
+	Convey("keys saved before keys had a binary encoding can still be loaded", t, func() {
+		var ls0 LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls0.SetRootDir(dir), ShouldBeNil)
+		_, err := ls0.MakeKeys("this is a name")
+		So(err, ShouldBeNil)
+
+		var buf bytes.Buffer
+		So(ls0.withKey(func(dk *xcrypt.DualKey) error {
+			old := keyFileV0{
+				Key:  &dualKeyV0{D0: dk.D0, D1: dk.D1, P: dk.P, Q: dk.Q},
+				Info: *ls0.info,
+			}
+			return gob.NewEncoder(&buf).Encode(old)
+		}), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(dir, "keys"), buf.Bytes(), 0600), ShouldBeNil)
+
+		var ls1 LifetimeState
+		So(ls1.SetRootDir(dir), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldBeNil)
+		So(ls1.info.Id, ShouldEqual, ls0.info.Id)
+		So(testKeyString(&ls1), ShouldEqual, testKeyString(&ls0))
+
+		So(ioutil.WriteFile(filepath.Join(dir, "keys"), []byte("not keys"), 0600), ShouldBeNil)
+		So(ls1.LoadKeys(), ShouldNotBeNil)
+	})
+}
+
+type testProgress struct {
+	stages []string
+	fracs  []float64
+	cancel func()
+}
+
+func (tp *testProgress) Progress(stage string, frac float64) {
+	tp.stages = append(tp.stages, stage)
+	tp.fracs = append(tp.fracs, frac)
+	if tp.cancel != nil {
+		tp.cancel()
+	}
+}
+
+func TestMakeKeysWithProgress(t *testing.T) {
+	Convey("making keys reports progress and can be cancelled", t, func() {
+		var ls LifetimeState
+		dir := makeTestRootDir()
+		defer os.RemoveAll(dir)
+		So(ls.SetRootDir(dir), ShouldBeNil)
+
+		Convey("progress is reported until the keys are done", func() {
+			var tp testProgress
+			_, err := ls.MakeKeysWithProgress("this is a name", &tp)
+			So(err, ShouldBeNil)
+			So(len(tp.stages), ShouldBeGreaterThanOrEqualTo, 3)
+			So(tp.stages[0], ShouldEqual, xcrypt.StagePrimes)
+			So(tp.stages[len(tp.stages)-1], ShouldEqual, xcrypt.StageDone)
+			So(tp.fracs[len(tp.fracs)-1], ShouldEqual, 1)
+			So(ls.checkKeys(), ShouldBeNil)
+		})
+
+		Convey("cancelled keys are not saved", func() {
+			tp := testProgress{cancel: ls.CancelMakeKeys}
+			_, err := ls.MakeKeysWithProgress("this is a name", &tp)
+			So(err, ShouldNotBeNil)
+			So(len(tp.stages), ShouldEqual, 1)
+			So(ls.checkKeys(), ShouldNotBeNil)
+			So(ls.LoadKeys(), ShouldNotBeNil)
+
+			// Cancelling when nothing is in progress doesn't affect the next call.
+			ls.CancelMakeKeys()
+			_, err = ls.MakeKeys("this is a name")
+			So(err, ShouldBeNil)
+		})
 	})
 }
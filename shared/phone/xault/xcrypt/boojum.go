@@ -0,0 +1,94 @@
+package xcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// boojumKeySize is the size of the ephemeral AES-256 key that a Boojum seals its key with.
+const boojumKeySize = 32
+
+var ErrBoojumZeroed = fmt.Errorf("boojum has been zeroed")
+
+// Boojum keeps a private key encrypted in memory under an ephemeral key that is never saved
+// anywhere, and only decrypts it for as long as it's being used.  This doesn't stop anyone who can
+// read all of the process's memory, they can find the ephemeral key too, but it means that the
+// private values don't sit in memory in the clear where a partial dump or a stray copy would find
+// them.  A Boojum is safe to use from multiple goroutines.
+type Boojum struct {
+	mu sync.Mutex
+
+	// ephemeral is the AES key that sealed is encrypted with, sealed is the key's binary encoding.
+	// Both are nil once the boojum has been zeroed.
+	ephemeral, sealed []byte
+}
+
+// MakeBoojum encrypts key into a new Boojum.  key is left alone, so the caller should call its Zero
+// method once it's no longer needed.
+func MakeBoojum(random io.Reader, key PrivateKey) (*Boojum, error) {
+	data, err := key.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(data)
+	b := &Boojum{ephemeral: make([]byte, boojumKeySize)}
+	if _, err := io.ReadFull(random, b.ephemeral); err != nil {
+		return nil, fmt.Errorf("unable to make ephemeral key: %v", err)
+	}
+	gcm, err := b.gcm()
+	if err != nil {
+		return nil, err
+	}
+	// Notice that the nonce here is all zeroes, this is ok because the ephemeral key is random and
+	// only ever seals this one key.
+	b.sealed = gcm.Seal(nil, make([]byte, gcm.NonceSize()), data, nil)
+	return b, nil
+}
+
+// With decrypts the key and calls f with it.  The key is zeroed as soon as f returns, so f must not
+// keep it or anything made from its private values.  With returns the error returned by f, or
+// ErrBoojumZeroed if Zero has been called.
+func (b *Boojum) With(f func(key PrivateKey) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sealed == nil {
+		return ErrBoojumZeroed
+	}
+	gcm, err := b.gcm()
+	if err != nil {
+		return err
+	}
+	data, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), b.sealed, nil)
+	if err != nil {
+		return fmt.Errorf("unable to open boojum: %v", err)
+	}
+	defer zeroBytes(data)
+	key, err := UnmarshalPrivateKey(data)
+	if err != nil {
+		return err
+	}
+	defer key.Zero()
+	return f(key)
+}
+
+// Zero forgets the key by overwriting the ephemeral key and the sealed key.  If a call to With is in
+// progress then Zero waits for it to finish.
+func (b *Boojum) Zero() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	zeroBytes(b.ephemeral)
+	zeroBytes(b.sealed)
+	b.ephemeral = nil
+	b.sealed = nil
+}
+
+func (b *Boojum) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(b.ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,67 @@
+package xcrypt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBoojum(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+
+	Convey("a boojum gives back the key it was made with", t, func() {
+		dk, err := MakeDualKey(c, 1024)
+		So(err, ShouldBeNil)
+		data, err := dk.MarshalBinary()
+		So(err, ShouldBeNil)
+		b, err := MakeBoojum(c, dk)
+		So(err, ShouldBeNil)
+		So(bytes.Contains(b.sealed, dk.P.Bytes()), ShouldBeFalse)
+
+		var used PrivateKey
+		So(b.With(func(key PrivateKey) error {
+			used = key
+			got, err := key.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data)
+			_, err = key.Sign(c, []byte("data"), "")
+			return err
+		}), ShouldBeNil)
+
+		// The key passed to f is zeroed once f returns.
+		udk := used.(*DualKey)
+		So(udk.P.Sign(), ShouldEqual, 0)
+		So(udk.D0.Sign(), ShouldEqual, 0)
+		So(udk.encKey, ShouldBeNil)
+		So(udk.sigKey, ShouldBeNil)
+
+		expected := fmt.Errorf("expected")
+		So(b.With(func(key PrivateKey) error { return expected }), ShouldEqual, expected)
+
+		b.Zero()
+		So(b.With(func(key PrivateKey) error { return nil }), ShouldEqual, ErrBoojumZeroed)
+	})
+
+	Convey("zeroing a key overwrites its private values", t, func() {
+		dk, err := MakeDualKey(c, 1024)
+		So(err, ShouldBeNil)
+		words := dk.D1.Bits()
+		sigKey := dk.GetRSASigniatureKey()
+		dk.Zero()
+		for _, word := range words {
+			So(word, ShouldEqual, 0)
+		}
+		So(sigKey.D.Sign(), ShouldEqual, 0)
+		So(sigKey.Precomputed.Dp.Sign(), ShouldEqual, 0)
+
+		ck, err := MakeCurveKey(c)
+		So(err, ShouldBeNil)
+		identity := ck.Identity
+		ck.Zero()
+		So(identity, ShouldResemble, make([]byte, curveKeySize))
+	})
+}
@@ -0,0 +1,325 @@
+package xcrypt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// maxChecksumWords bounds the number of checksum words a version can use.
+const maxChecksumWords = 4
+
+// minFixMarginBits is how many more bits the checksum needs than the log2 of the number of phrases
+// that were tried while looking for a fix, before the fix is trusted without asking the user.  Each
+// phrase that was tried matches the checksum by chance with probability 2^-checksum bits, so with
+// this margin a phrase with a mistake is fixed into the wrong phrase less than once in 2^16 tries.
+const minFixMarginBits = 16
+
+// PhraseError is returned when a phrase can't be turned back into a key.  It says where in the
+// phrase the problem seems to be, so that the user can be asked to check that part of their copy.
+type PhraseError struct {
+	// Index is the index of the word that looks wrong, or -1 if the problem can't be pinned on a
+	// single word.  If Missing is true it's the index that the missing word belongs at instead.
+	Index int
+
+	// Missing is true if the phrase looks like it's missing a word.
+	Missing bool
+
+	// Reason describes the problem.
+	Reason string
+
+	// Suggestion is the only phrase with a valid checksum that's one mistake away from the phrase,
+	// when the checksum is too short for that to mean it's the right phrase.  It must not be used
+	// unless the user confirms that it's what they wrote down, and then it can be regenerated from
+	// like any other phrase.
+	Suggestion []string
+}
+
+func (pe *PhraseError) Error() string {
+	var msg string
+	switch {
+	case pe.Missing && pe.Index >= 0:
+		msg = fmt.Sprintf("the phrase has a word missing at position %d", pe.Index+1)
+	case pe.Missing:
+		msg = "the phrase has a word missing"
+	case pe.Index >= 0:
+		msg = fmt.Sprintf("word %d looks wrong: %s", pe.Index+1, pe.Reason)
+	default:
+		msg = pe.Reason
+	}
+	if pe.Suggestion != nil {
+		msg += fmt.Sprintf(", did you mean %q?", strings.Join(pe.Suggestion, " "))
+	}
+	return msg
+}
+
+// phraseChecksum returns the n checksum words from list for the given words, which are every word of
+// a phrase except for the checksum words themselves.
+func phraseChecksum(list, words []string, n int) []string {
+	h := sha256.New()
+	h.Write([]byte("checksum:"))
+	for _, word := range words {
+		h.Write([]byte(word + ":"))
+	}
+	return fingerprintWords(list, h.Sum(nil), n)
+}
+
+// checkPhrase returns the version of phrase if it contains exactly one version word and, if that
+// version uses checksum words, it ends with the right checksum words from the version's language.
+func (km *KeyMaker) checkPhrase(phrase []string) (string, bool) {
+	versions := km.phraseVersions(phrase)
+	if len(versions) != 1 {
+		return "", false
+	}
+	info := km.versions.Words[versions[0]]
+	n := info.ChecksumWords
+	if len(phrase) <= n {
+		return "", false
+	}
+	words := phrase[:len(phrase)-n]
+	for i, word := range phraseChecksum(km.languages[info.language()], words, n) {
+		if phrase[len(words)+i] != word {
+			return "", false
+		}
+	}
+	return versions[0], true
+}
+
+// phraseVersions returns every version word in phrase.  Version words for languages that km doesn't
+// have a word list for are ignored.
+func (km *KeyMaker) phraseVersions(phrase []string) []string {
+	var versions []string
+	for _, word := range phrase {
+		if info, ok := km.versions.Words[word]; ok {
+			if _, ok := km.languages[info.language()]; ok {
+				versions = append(versions, word)
+			}
+		}
+	}
+	return versions
+}
+
+// phraseFix is a phrase that is one mistake away from the phrase that the user gave.
+type phraseFix struct {
+	phrase []string
+
+	// index is the index of the word that was changed, or where a word was added if missing is
+	// true.  For a swap it's the index of the first of the two words.
+	index   int
+	missing bool
+}
+
+// searchPhrase looks for phrases in language with a valid checksum that are a single mistake away
+// from phrase.  The mistakes it considers are a wrong word, a missing word, an extra word, and two
+// adjacent words in the wrong order.  If only isn't -1 then only mistakes involving the word at
+// that index are considered.  The search is bounded by the length of the phrase times the number of
+// words, so it's quick enough to do whenever a checksum doesn't match.  It also returns the number
+// of phrases that were tried, which is how many chances there were for a wrong phrase to match its
+// checksum by accident.
+func (km *KeyMaker) searchPhrase(language string, phrase []string, only int) ([]phraseFix, int) {
+	// Version words are included so that a mistake in the version word can be fixed too, but only
+	// versions with checksums can be recovered this way.
+	candidates := append([]string{}, km.languages[language]...)
+	for word, info := range km.versions.Words {
+		if info.ChecksumWords > 0 && info.language() == language {
+			candidates = append(candidates, word)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var fixes []phraseFix
+	try := func(fixed []string, index int, missing bool) {
+		key := strings.Join(fixed, " ")
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if version, ok := km.checkPhrase(fixed); ok && km.versions.Words[version].ChecksumWords > 0 {
+			fixes = append(fixes, phraseFix{phrase: fixed, index: index, missing: missing})
+		}
+	}
+	for i := range phrase {
+		if only != -1 && i != only {
+			continue
+		}
+		// A wrong word
+		for _, word := range candidates {
+			if word == phrase[i] {
+				continue
+			}
+			fixed := append([]string{}, phrase...)
+			fixed[i] = word
+			try(fixed, i, false)
+		}
+		// An extra word
+		fixed := append(append([]string{}, phrase[:i]...), phrase[i+1:]...)
+		try(fixed, i, false)
+	}
+	if only != -1 {
+		return fixes, len(seen)
+	}
+	// Two words in the wrong order
+	for i := 0; i+1 < len(phrase); i++ {
+		if phrase[i] == phrase[i+1] {
+			continue
+		}
+		fixed := append([]string{}, phrase...)
+		fixed[i], fixed[i+1] = fixed[i+1], fixed[i]
+		try(fixed, i, false)
+	}
+	// A missing word
+	for i := 0; i <= len(phrase); i++ {
+		for _, word := range candidates {
+			fixed := append(append(append([]string{}, phrase[:i]...), word), phrase[i:]...)
+			try(fixed, i, true)
+		}
+	}
+	return fixes, len(seen)
+}
+
+// checksumBits returns how many bits of checksum the phrases of version have.
+func (km *KeyMaker) checksumBits(version string) float64 {
+	info := km.versions.Words[version]
+	return float64(info.ChecksumWords) * math.Log2(float64(len(km.languages[info.language()])))
+}
+
+// fixPhrase corrects minor misspellings in phrase and checks that it's a valid phrase.  If the
+// phrase's version uses checksum words then a single larger mistake, like a wrong or missing word,
+// is also fixed as long as there's only one way to fix it and the checksum is long enough that the
+// fix can't be a coincidence.  If it's too short then the fix is only suggested in the PhraseError.
+// It returns the fixed phrase along with its version, or a *PhraseError.  The phrase can be in any
+// of km's languages.
+func (km *KeyMaker) fixPhrase(phrase []string) ([]string, string, error) {
+	language := km.detectLanguage(phrase)
+	corrected := make([]string, len(phrase))
+	var invalid []int
+	for i := range phrase {
+		corrected[i] = strings.ToLower(phrase[i])
+		if word, ok := km.closestWord(language, corrected[i]); ok {
+			corrected[i] = word
+		} else {
+			invalid = append(invalid, i)
+		}
+	}
+	notAWord := func(i int) error {
+		return &PhraseError{Index: i, Reason: fmt.Sprintf("%q is not a valid word", phrase[i])}
+	}
+
+	versions := km.phraseVersions(corrected)
+	if len(versions) == 1 && km.versions.Words[versions[0]].ChecksumWords == 0 {
+		// Without a checksum all we can do is check each word on its own.
+		if len(invalid) > 0 {
+			return nil, "", notAWord(invalid[0])
+		}
+		return corrected, versions[0], nil
+	}
+	if len(invalid) > 1 {
+		return nil, "", notAWord(invalid[0])
+	}
+	if len(invalid) == 0 {
+		if version, ok := km.checkPhrase(corrected); ok {
+			return corrected, version, nil
+		}
+	}
+
+	only := -1
+	if len(invalid) == 1 {
+		only = invalid[0]
+	}
+	fixes, tried := km.searchPhrase(language, corrected, only)
+	if len(fixes) == 1 {
+		version, _ := km.checkPhrase(fixes[0].phrase)
+		if km.checksumBits(version) >= math.Log2(float64(tried))+minFixMarginBits {
+			return fixes[0].phrase, version, nil
+		}
+		return nil, "", &PhraseError{
+			Index:      fixes[0].index,
+			Missing:    fixes[0].missing,
+			Reason:     "only one word fits here, but the checksum is too short to be sure of it",
+			Suggestion: fixes[0].phrase,
+		}
+	}
+
+	// Either nothing fixed the phrase or too many things did, either way we can't tell what the
+	// phrase was supposed to be, but we might be able to tell where the mistake is.
+	if len(fixes) > 1 {
+		sameIndex, allMissing := true, true
+		for _, fix := range fixes {
+			sameIndex = sameIndex && fix.index == fixes[0].index && fix.missing == fixes[0].missing
+			allMissing = allMissing && fix.missing
+		}
+		if sameIndex {
+			return nil, "", &PhraseError{Index: fixes[0].index, Missing: fixes[0].missing, Reason: "more than one word fits here"}
+		}
+		if allMissing {
+			return nil, "", &PhraseError{Index: -1, Missing: true}
+		}
+	}
+	if only != -1 {
+		return nil, "", notAWord(only)
+	}
+	if len(versions) == 0 {
+		return nil, "", &PhraseError{Index: -1, Reason: "phrase did not encode a version"}
+	}
+	if len(versions) > 1 {
+		return nil, "", &PhraseError{Index: -1, Reason: fmt.Sprintf("%q and %q should not both be in the phrase", versions[0], versions[1])}
+	}
+	return nil, "", &PhraseError{Index: -1, Reason: "phrase checksum does not match, check that every word is correct and in the right order"}
+}
+
+// detectLanguage returns the language that phrase seems to be in.  That's the language with the most
+// words in phrase that are within edit distance one of one of its words, since a few words are
+// shared between languages.  Ties go to the language of a version word in the phrase, then to
+// DefaultLanguage.
+func (km *KeyMaker) detectLanguage(phrase []string) string {
+	var order []string
+	for _, word := range phrase {
+		if info, ok := km.versions.Words[strings.ToLower(word)]; ok {
+			order = append(order, info.language())
+		}
+	}
+	order = append(append(order, DefaultLanguage), km.Languages()...)
+	best, bestCount := DefaultLanguage, -1
+	for _, language := range order {
+		if _, ok := km.languages[language]; !ok {
+			continue
+		}
+		count := 0
+		for _, word := range phrase {
+			if _, ok := km.closestWord(language, strings.ToLower(word)); ok {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = language, count
+		}
+	}
+	return best
+}
+
+// closestWord returns the word or version word in language that is within edit distance one of
+// word, if there is one.
+func (km *KeyMaker) closestWord(language, word string) (string, bool) {
+	var bestWord string
+	bestScore := 1000
+	check := func(candidate string) bool {
+		ed := EditDistance(word, candidate)
+		if ed < bestScore {
+			bestScore = ed
+			bestWord = candidate
+		}
+		return ed == 0
+	}
+	for _, candidate := range km.languages[language] {
+		if check(candidate) {
+			return word, true
+		}
+	}
+	for candidate, info := range km.versions.Words {
+		if info.language() == language && check(candidate) {
+			return word, true
+		}
+	}
+	return bestWord, bestScore < 2
+}
@@ -0,0 +1,170 @@
+package xcrypt
+
+import (
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPhraseChecksum(t *testing.T) {
+	Convey("phrases with checksums can be recovered from larger mistakes", t, func() {
+		// Seed here so that every Convey below sees the same phrase.
+		c := cmwc.MakeGoodCmwc()
+		c.Seed(1)
+		km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+		So(err, ShouldBeNil)
+		key, phrase, err := km.GenerateKeyAndPhrase(c, 128)
+		So(err, ShouldBeNil)
+		So(km.versions.Words["oreo"].ChecksumWords, ShouldEqual, 4)
+		version, ok := km.checkPhrase(phrase)
+		So(ok, ShouldBeTrue)
+		So(version, ShouldEqual, "oreo")
+
+		// Find a word that isn't the version word to make mistakes with.
+		i := 3
+		if phrase[i] == "oreo" {
+			i++
+		}
+		other := km.words[0]
+		if phrase[i] == other {
+			other = km.words[1]
+		}
+		mistakes := map[string][]string{
+			"a wrong word":      replaceWord(phrase, i, other),
+			"a missing word":    append(append([]string{}, phrase[:i]...), phrase[i+1:]...),
+			"an extra word":     append(append(append([]string{}, phrase[:i]...), other), phrase[i:]...),
+			"two swapped words": swapWords(phrase, i),
+			"a wrong checksum":  replaceWord(phrase, len(phrase)-1, other),
+			"an unknown word":   replaceWord(phrase, i, "xyzzyxyzzy"),
+		}
+		for name, mistake := range mistakes {
+			Convey("phrases with "+name+" are fixed", func() {
+				regenerated, corrected, err := km.RegenerateKeyFromPhrase(mistake)
+				So(err, ShouldBeNil)
+				So(corrected, ShouldResemble, phrase)
+				So(regenerated.String(), ShouldEqual, key.String())
+			})
+		}
+
+		Convey("phrases with two mistakes can't be fixed, but say where the problem is", func() {
+			_, _, err := km.RegenerateKeyFromPhrase(replaceWord(replaceWord(phrase, i, "xyzzyxyzzy"), i+2, "qwertyuiop"))
+			So(err, ShouldNotBeNil)
+			pe, ok := err.(*PhraseError)
+			So(ok, ShouldBeTrue)
+			So(pe.Index, ShouldEqual, i)
+
+			_, _, err = km.RegenerateKeyFromPhrase(replaceWord(replaceWord(phrase, i, other), len(phrase)-2, other))
+			So(err, ShouldNotBeNil)
+			_, ok = err.(*PhraseError)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("phrases without a version can't be fixed", func() {
+			var words []string
+			for _, word := range phrase {
+				if word != "oreo" {
+					words = append(words, word)
+				}
+			}
+			_, _, err := km.RegenerateKeyFromPhrase(words[:len(words)-3])
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("phrases from versions without checksum words still work", t, func() {
+		km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+		So(err, ShouldBeNil)
+		So(km.versions.Words["nougat"].ChecksumWords, ShouldEqual, 0)
+		c := cmwc.MakeGoodCmwc()
+		c.Seed(1)
+		_, checked, err := km.GenerateKeyAndPhrase(c, 128)
+		So(err, ShouldBeNil)
+		km.versions.Current = "nougat"
+		c.Seed(1)
+		key, phrase, err := km.GenerateKeyAndPhrase(c, 128)
+		So(err, ShouldBeNil)
+		So(len(phrase), ShouldEqual, len(checked)-4)
+		version, ok := km.checkPhrase(phrase)
+		So(ok, ShouldBeTrue)
+		So(version, ShouldEqual, "nougat")
+		regenerated, corrected, err := km.RegenerateKeyFromPhrase(phrase)
+		So(err, ShouldBeNil)
+		So(corrected, ShouldResemble, phrase)
+		So(regenerated.String(), ShouldEqual, key.String())
+
+		Convey("but their mistakes can't be found", func() {
+			i := 3
+			if phrase[i] == "nougat" {
+				i++
+			}
+			other := km.words[0]
+			if phrase[i] == other {
+				other = km.words[1]
+			}
+			regenerated, _, err := km.RegenerateKeyFromPhrase(replaceWord(phrase, i, other))
+			So(err, ShouldBeNil)
+			So(regenerated.String(), ShouldNotEqual, key.String())
+		})
+	})
+
+	Convey("phrases with too few checksum words are never fixed without asking", t, func() {
+		km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+		So(err, ShouldBeNil)
+		info := km.versions.Words["oreo"]
+		info.ChecksumWords = 2
+		km.versions.Words["short"] = info
+		km.versions.Current = "short"
+		c := cmwc.MakeGoodCmwc()
+		suggested := 0
+		for seed := int64(1); seed <= 5; seed++ {
+			c.Seed(seed)
+			key, phrase, err := km.GenerateKeyAndPhrase(c, 128)
+			So(err, ShouldBeNil)
+			i := 3
+			if phrase[i] == "short" {
+				i++
+			}
+			other := km.words[0]
+			if phrase[i] == other {
+				other = km.words[1]
+			}
+			_, _, err = km.RegenerateKeyFromPhrase(replaceWord(phrase, i, other))
+			So(err, ShouldNotBeNil)
+			pe, ok := err.(*PhraseError)
+			So(ok, ShouldBeTrue)
+			if pe.Suggestion == nil {
+				// Another phrase one mistake away also matched the checksum.
+				continue
+			}
+			suggested++
+			So(pe.Index, ShouldEqual, i)
+			So(pe.Suggestion, ShouldResemble, phrase)
+			So(pe.Error(), ShouldContainSubstring, "did you mean")
+			regenerated, _, err := km.RegenerateKeyFromPhrase(pe.Suggestion)
+			So(err, ShouldBeNil)
+			So(regenerated.String(), ShouldEqual, key.String())
+		}
+		So(suggested, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("phrase errors describe where the problem is", t, func() {
+		So((&PhraseError{Index: 6, Reason: "bad"}).Error(), ShouldEqual, "word 7 looks wrong: bad")
+		So((&PhraseError{Index: 2, Missing: true}).Error(), ShouldEqual, "the phrase has a word missing at position 3")
+		So((&PhraseError{Index: -1, Missing: true}).Error(), ShouldEqual, "the phrase has a word missing")
+		So((&PhraseError{Index: -1, Reason: "bad"}).Error(), ShouldEqual, "bad")
+		So((&PhraseError{Index: 0, Reason: "bad", Suggestion: []string{"a", "b"}}).Error(), ShouldEqual, `word 1 looks wrong: bad, did you mean "a b"?`)
+	})
+}
+
+func replaceWord(phrase []string, i int, word string) []string {
+	replaced := append([]string{}, phrase...)
+	replaced[i] = word
+	return replaced
+}
+
+func swapWords(phrase []string, i int) []string {
+	swapped := append([]string{}, phrase...)
+	swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+	return swapped
+}
@@ -0,0 +1,253 @@
+package xcrypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// curveKeySize is the size of every key and seed used by a CurveKey.
+const curveKeySize = 32
+
+// CurveKey is an Ed25519 key used for signatures along with an X25519 key used for encryption.
+type CurveKey struct {
+	// Identity is the seed of the Ed25519 key, Encryption is the X25519 private key.
+	Identity, Encryption []byte
+}
+
+func (ck *CurveKey) String() string {
+	data, _ := json.MarshalIndent(ck, "", "  ")
+	return string(data)
+}
+
+// CurveKeyFromString parses a key produced by String() and validates it.
+func CurveKeyFromString(str string) (*CurveKey, error) {
+	var ck CurveKey
+	if err := json.Unmarshal([]byte(str), &ck); err != nil {
+		return nil, err
+	}
+	if err := ck.Validate(); err != nil {
+		return nil, err
+	}
+	return &ck, nil
+}
+
+type CurvePublicKey struct {
+	// Identity is the Ed25519 public key, Encryption is the X25519 public key.
+	Identity, Encryption []byte
+}
+
+func (cpk *CurvePublicKey) String() string {
+	data, _ := json.MarshalIndent(cpk, "", "  ")
+	return string(data)
+}
+
+// CurvePublicKeyFromString parses a key produced by String() and validates it.
+func CurvePublicKeyFromString(str string) (*CurvePublicKey, error) {
+	var cpk CurvePublicKey
+	if err := json.Unmarshal([]byte(str), &cpk); err != nil {
+		return nil, err
+	}
+	if err := cpk.Validate(); err != nil {
+		return nil, err
+	}
+	return &cpk, nil
+}
+
+// MakeCurveKey creates a new CurveKey.  Exactly 64 bytes are read from random, so the same random
+// bytes always make the same key.
+func MakeCurveKey(random io.Reader) (*CurveKey, error) {
+	ck := &CurveKey{
+		Identity:   make([]byte, curveKeySize),
+		Encryption: make([]byte, curveKeySize),
+	}
+	for _, key := range [][]byte{ck.Identity, ck.Encryption} {
+		if _, err := io.ReadFull(random, key); err != nil {
+			return nil, fmt.Errorf("unable to read enough random bytes to make a key: %v", err)
+		}
+	}
+	return ck, nil
+}
+
+func (ck *CurveKey) MakePublicKey() (*CurvePublicKey, error) {
+	if err := ck.Validate(); err != nil {
+		return nil, err
+	}
+	enc, err := ecdh.X25519().NewPrivateKey(ck.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	cpk := &CurvePublicKey{
+		Identity:   []byte(ck.identityKey().Public().(ed25519.PublicKey)),
+		Encryption: enc.PublicKey().Bytes(),
+	}
+	return cpk, nil
+}
+
+// Validate checks that ck has keys of the right size.
+func (ck *CurveKey) Validate() error {
+	if len(ck.Identity) != curveKeySize || len(ck.Encryption) != curveKeySize {
+		return fmt.Errorf("curve keys must be %d bytes", curveKeySize)
+	}
+	return nil
+}
+
+// Validate checks that cpk has keys of the right size and that its encryption key is usable.
+func (cpk *CurvePublicKey) Validate() error {
+	if len(cpk.Identity) != curveKeySize || len(cpk.Encryption) != curveKeySize {
+		return fmt.Errorf("curve keys must be %d bytes", curveKeySize)
+	}
+	if bytes.Equal(cpk.Encryption, make([]byte, curveKeySize)) {
+		return fmt.Errorf("encryption key is the identity point")
+	}
+	return nil
+}
+
+// Zero overwrites the private keys of ck with zeroes, see DualKey.Zero.
+func (ck *CurveKey) Zero() {
+	zeroBytes(ck.Identity)
+	zeroBytes(ck.Encryption)
+}
+
+// Algorithm returns AlgorithmX25519Ed25519.
+func (ck *CurveKey) Algorithm() string {
+	return AlgorithmX25519Ed25519
+}
+
+// Public is the same as MakePublicKey, but it returns a PublicKey.
+func (ck *CurveKey) Public() (PublicKey, error) {
+	cpk, err := ck.MakePublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return cpk, nil
+}
+
+// Algorithm returns AlgorithmX25519Ed25519.
+func (cpk *CurvePublicKey) Algorithm() string {
+	return AlgorithmX25519Ed25519
+}
+
+// Sign makes a detached signature of data, see DualKey.Sign for details.
+func (ck *CurveKey) Sign(random io.Reader, data []byte, context string) ([]byte, error) {
+	return sign(random, ck, data, context)
+}
+
+// Verify checks that sig is a signature of data made by Sign with the private half of cpk.
+func (cpk *CurvePublicKey) Verify(data, sig []byte) (*Signature, error) {
+	return verify(cpk, data, sig)
+}
+
+// SealEnvelope seals plaintext so that only dst can open it, see DualKey.SealEnvelope for details.
+func (ck *CurveKey) SealEnvelope(random io.Reader, dst PublicKey, plaintext []byte) ([]byte, error) {
+	return sealEnvelope(random, ck, []PublicKey{dst}, envelopeV2, encryptV2, plaintext)
+}
+
+// SealEnvelopeMulti seals plaintext so that any of dsts can open it, see DualKey.SealEnvelopeMulti
+// for details.
+func (ck *CurveKey) SealEnvelopeMulti(random io.Reader, dsts []PublicKey, plaintext []byte) ([]byte, error) {
+	return sealEnvelopeMulti(random, ck, dsts, plaintext)
+}
+
+// OpenEnvelope opens an envelope sealed by src, see DualKey.OpenEnvelope for details.
+func (ck *CurveKey) OpenEnvelope(random io.Reader, src PublicKey, envelope []byte) ([]byte, error) {
+	return openEnvelope(random, ck, src, envelope)
+}
+
+// SealEnvelopeStream is like SealEnvelope but for streams, see DualKey.SealEnvelopeStream for
+// details.
+func (ck *CurveKey) SealEnvelopeStream(random io.Reader, dst PublicKey, r io.Reader, w io.Writer) error {
+	return sealEnvelopeStream(random, ck, dst, r, w)
+}
+
+// OpenEnvelopeStream opens a stream sealed by src, see DualKey.OpenEnvelopeStream for details.
+func (ck *CurveKey) OpenEnvelopeStream(random io.Reader, src PublicKey, r io.Reader, w io.Writer) error {
+	return openEnvelopeStream(random, ck, src, r, w)
+}
+
+func (ck *CurveKey) identityKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(ck.Identity)
+}
+
+func (ck *CurveKey) signDigest(random io.Reader, digest []byte) ([]byte, error) {
+	if err := ck.Validate(); err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(ck.identityKey(), digest), nil
+}
+
+func (cpk *CurvePublicKey) verifyDigest(digest, sig []byte) error {
+	if len(cpk.Identity) != ed25519.PublicKeySize || !ed25519.Verify(cpk.Identity, digest, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// An otk is encrypted for a CurvePublicKey by making an ephemeral X25519 key, doing a key exchange
+// with the recipient's encryption key, and using a hash of the result as an AES-256-GCM key to
+// encrypt the otk.  The encrypted otk is the ephemeral public key followed by the ciphertext.
+func (cpk *CurvePublicKey) encryptOtk(random io.Reader, otk []byte) ([]byte, error) {
+	dst, err := ecdh.X25519().NewPublicKey(cpk.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
+	}
+	ephemeralBytes := make([]byte, curveKeySize)
+	if _, err := io.ReadFull(random, ephemeralBytes); err != nil {
+		return nil, fmt.Errorf("unable to read enough random bytes to encrypt otk: %v", err)
+	}
+	defer zeroBytes(ephemeralBytes)
+	ephemeral, err := ecdh.X25519().NewPrivateKey(ephemeralBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
+	}
+	shared, err := ephemeral.ECDH(dst)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
+	}
+	defer zeroBytes(shared)
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	kek := curveKek(shared, ephemeralPublic, cpk.Encryption)
+	defer zeroBytes(kek)
+	ciphertext, err := encryptV2(kek, nil, otk)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
+	}
+	return append(ephemeralPublic, ciphertext...), nil
+}
+
+func (ck *CurveKey) decryptOtk(random io.Reader, encryptedOtk []byte) ([]byte, error) {
+	if len(encryptedOtk) < curveKeySize {
+		return nil, ErrVerifiedBufMalformed
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(ck.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(encryptedOtk[:curveKeySize])
+	if err != nil {
+		return nil, ErrVerifiedBufMalformed
+	}
+	shared, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrVerifiedBufMalformed
+	}
+	defer zeroBytes(shared)
+	kek := curveKek(shared, encryptedOtk[:curveKeySize], priv.PublicKey().Bytes())
+	defer zeroBytes(kek)
+	return decryptV2(kek, nil, encryptedOtk[curveKeySize:])
+}
+
+// curveKek derives the key used to encrypt an otk from the result of a key exchange.  Both public
+// keys are included so that the encrypted otk is bound to the exchange that produced it.
+func curveKek(shared, ephemeralPublic, recipientPublic []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("otk"))
+	h.Write(shared)
+	h.Write(ephemeralPublic)
+	h.Write(recipientPublic)
+	return h.Sum(nil)
+}
@@ -0,0 +1,126 @@
+package xcrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCurveKeys(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("can make curve keys successfully", t, func() {
+		ck, err := MakeCurveKey(c)
+		So(err, ShouldBeNil)
+		So(ck.Validate(), ShouldBeNil)
+		So(ck.Algorithm(), ShouldEqual, AlgorithmX25519Ed25519)
+		cpk, err := ck.MakePublicKey()
+		So(err, ShouldBeNil)
+		So(cpk.Validate(), ShouldBeNil)
+
+		Convey("the same random bytes make the same key", func() {
+			data, err := ck.MarshalBinary()
+			So(err, ShouldBeNil)
+			seed := append(append([]byte{}, ck.Identity...), ck.Encryption...)
+			ck2, err := MakeCurveKey(bytes.NewReader(seed))
+			So(err, ShouldBeNil)
+			data2, err := ck2.MarshalBinary()
+			So(err, ShouldBeNil)
+			So(data2, ShouldResemble, data)
+		})
+
+		Convey("can convert keys to and from strings and binary", func() {
+			ck2, err := CurveKeyFromString(ck.String())
+			So(err, ShouldBeNil)
+			So(ck2.String(), ShouldEqual, ck.String())
+			cpk2, err := CurvePublicKeyFromString(cpk.String())
+			So(err, ShouldBeNil)
+			So(cpk2.Fingerprint(), ShouldResemble, cpk.Fingerprint())
+
+			data, err := ck.MarshalBinary()
+			So(err, ShouldBeNil)
+			key, err := UnmarshalPrivateKey(data)
+			So(err, ShouldBeNil)
+			So(key.String(), ShouldEqual, ck.String())
+			data, err = cpk.MarshalBinary()
+			So(err, ShouldBeNil)
+			pub, err := UnmarshalPublicKey(data)
+			So(err, ShouldBeNil)
+			So(pub.String(), ShouldEqual, cpk.String())
+			_, err = UnmarshalPrivateKey(data)
+			So(err, ShouldNotBeNil)
+
+			_, err = CurvePublicKeyFromString(`{"Identity": "AAAA", "Encryption": "AAAA"}`)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("curve keys can sign and verify", func() {
+			data := []byte("some data to sign")
+			sig, err := ck.Sign(c, data, "context")
+			So(err, ShouldBeNil)
+			s, err := cpk.Verify(data, sig)
+			So(err, ShouldBeNil)
+			So(s.Context, ShouldEqual, "context")
+			_, err = cpk.Verify([]byte("some other data"), sig)
+			So(err, ShouldEqual, ErrBadSignature)
+		})
+
+		Convey("curve keys and dual keys can seal envelopes for each other", func() {
+			dk, err := MakeDualKey(c, 1024)
+			So(err, ShouldBeNil)
+			dpk, err := dk.MakePublicKey()
+			So(err, ShouldBeNil)
+			other, err := MakeCurveKey(c)
+			So(err, ShouldBeNil)
+			otherPublic, err := other.MakePublicKey()
+			So(err, ShouldBeNil)
+
+			plaintext := []byte("this plaintext goes between algorithms")
+			for _, pair := range []struct {
+				src, dst       PrivateKey
+				srcPub, dstPub PublicKey
+			}{
+				{ck, other, cpk, otherPublic},
+				{ck, dk, cpk, dpk},
+				{dk, ck, dpk, cpk},
+			} {
+				envelope, err := pair.src.SealEnvelope(c, pair.dstPub, plaintext)
+				So(err, ShouldBeNil)
+				decoded, err := pair.dst.OpenEnvelope(c, pair.srcPub, envelope)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, plaintext)
+				_, err = pair.dst.OpenEnvelope(c, pair.dstPub, envelope)
+				So(err, ShouldEqual, ErrUnableToVerify)
+			}
+
+			envelope, err := ck.SealEnvelopeMulti(c, []PublicKey{dpk, otherPublic}, plaintext)
+			So(err, ShouldBeNil)
+			for _, recipient := range []PrivateKey{dk, other} {
+				decoded, err := recipient.OpenEnvelope(c, cpk, envelope)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, plaintext)
+			}
+			_, err = ck.OpenEnvelope(c, cpk, envelope)
+			So(err, ShouldEqual, ErrNotARecipient)
+
+			var sealed, opened bytes.Buffer
+			So(ck.SealEnvelopeStream(c, otherPublic, bytes.NewReader(plaintext), &sealed), ShouldBeNil)
+			So(other.OpenEnvelopeStream(c, cpk, &sealed, &opened), ShouldBeNil)
+			So(opened.Bytes(), ShouldResemble, plaintext)
+		})
+
+		Convey("phrases can regenerate curve keys", func() {
+			km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+			So(err, ShouldBeNil)
+			km.versions.Current = "elliptic"
+			key, phrase, err := km.GenerateKeyAndPhrase(c, 128)
+			So(err, ShouldBeNil)
+			So(key.Algorithm(), ShouldEqual, AlgorithmX25519Ed25519)
+			regenerated, _, err := km.RegenerateKeyFromPhrase(phrase)
+			So(err, ShouldBeNil)
+			So(regenerated.String(), ShouldEqual, key.String())
+		})
+	})
+}
@@ -0,0 +1,188 @@
+package xcrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Every binary encoded key starts with a one byte type tag followed by a one byte version.
+const (
+	keyTypeDualPublic  = 1
+	keyTypeDual        = 2
+	keyTypeCurvePublic = 3
+	keyTypeCurve       = 4
+
+	// keyEncodingV1 is followed by a sequence of fields, each of which is a 4 byte big-endian
+	// length followed by that many bytes.  Integers are encoded as their big-endian magnitude, with
+	// no leading zeroes.  For a DualPublicKey the fields are the integers N, E0, and E1, for a
+	// DualKey they are P, Q, D0, and D1.  For a CurvePublicKey and a CurveKey they are the 32 byte
+	// Identity and Encryption keys.
+	keyEncodingV1 = 1
+)
+
+var ErrKeyEncodingMalformed = fmt.Errorf("key encoding is malformed")
+
+// MarshalBinary returns the canonical binary encoding of dpk.  Unlike the encoding returned by
+// String(), this encoding only depends on the values in the key, so it is suitable for hashing, and
+// it's small enough to fit in a QR code or NFC message.
+func (dpk *DualPublicKey) MarshalBinary() ([]byte, error) {
+	if dpk.N == nil {
+		return nil, fmt.Errorf("key is missing its modulus")
+	}
+	return marshalKeyInts(keyTypeDualPublic, dpk.N, big.NewInt(int64(dpk.E0)), big.NewInt(int64(dpk.E1)))
+}
+
+// UnmarshalBinary sets dpk to the key encoded in data by MarshalBinary.  It doesn't validate the
+// key, keys from untrusted sources should be checked with Validate.
+func (dpk *DualPublicKey) UnmarshalBinary(data []byte) error {
+	ints, err := unmarshalKeyInts(keyTypeDualPublic, data, 3)
+	if err != nil {
+		return err
+	}
+	for _, e := range ints[1:] {
+		if e.BitLen() > 31 {
+			return ErrKeyEncodingMalformed
+		}
+	}
+	*dpk = DualPublicKey{
+		N:  ints[0],
+		E0: int(ints[1].Int64()),
+		E1: int(ints[2].Int64()),
+	}
+	return nil
+}
+
+// MarshalBinary returns the canonical binary encoding of dk.
+func (dk *DualKey) MarshalBinary() ([]byte, error) {
+	if dk.P == nil || dk.Q == nil || dk.D0 == nil || dk.D1 == nil {
+		return nil, fmt.Errorf("key is missing values")
+	}
+	return marshalKeyInts(keyTypeDual, dk.P, dk.Q, dk.D0, dk.D1)
+}
+
+// UnmarshalBinary sets dk to the key encoded in data by MarshalBinary.  It doesn't validate the
+// key, keys from untrusted sources should be checked with Validate.
+func (dk *DualKey) UnmarshalBinary(data []byte) error {
+	ints, err := unmarshalKeyInts(keyTypeDual, data, 4)
+	if err != nil {
+		return err
+	}
+	*dk = DualKey{
+		P:  ints[0],
+		Q:  ints[1],
+		D0: ints[2],
+		D1: ints[3],
+	}
+	return nil
+}
+
+// MarshalBinary returns the canonical binary encoding of cpk.
+func (cpk *CurvePublicKey) MarshalBinary() ([]byte, error) {
+	if err := cpk.Validate(); err != nil {
+		return nil, err
+	}
+	return marshalKeyFields(keyTypeCurvePublic, cpk.Identity, cpk.Encryption), nil
+}
+
+// UnmarshalBinary sets cpk to the key encoded in data by MarshalBinary.
+func (cpk *CurvePublicKey) UnmarshalBinary(data []byte) error {
+	fields, err := unmarshalCurveKeyFields(keyTypeCurvePublic, data)
+	if err != nil {
+		return err
+	}
+	*cpk = CurvePublicKey{Identity: fields[0], Encryption: fields[1]}
+	return nil
+}
+
+// MarshalBinary returns the canonical binary encoding of ck.
+func (ck *CurveKey) MarshalBinary() ([]byte, error) {
+	if err := ck.Validate(); err != nil {
+		return nil, err
+	}
+	return marshalKeyFields(keyTypeCurve, ck.Identity, ck.Encryption), nil
+}
+
+// UnmarshalBinary sets ck to the key encoded in data by MarshalBinary.
+func (ck *CurveKey) UnmarshalBinary(data []byte) error {
+	fields, err := unmarshalCurveKeyFields(keyTypeCurve, data)
+	if err != nil {
+		return err
+	}
+	*ck = CurveKey{Identity: fields[0], Encryption: fields[1]}
+	return nil
+}
+
+func marshalKeyInts(keyType byte, ints ...*big.Int) ([]byte, error) {
+	var fields [][]byte
+	for _, val := range ints {
+		if val.Sign() < 0 {
+			return nil, fmt.Errorf("key contains a negative value")
+		}
+		fields = append(fields, val.Bytes())
+	}
+	return marshalKeyFields(keyType, fields...), nil
+}
+
+func unmarshalKeyInts(keyType byte, data []byte, count int) ([]*big.Int, error) {
+	fields, err := unmarshalKeyFields(keyType, data, count)
+	if err != nil {
+		return nil, err
+	}
+	var ints []*big.Int
+	for _, val := range fields {
+		if len(val) > 0 && val[0] == 0 {
+			// Leading zeroes would mean that the same key has more than one encoding.
+			return nil, ErrKeyEncodingMalformed
+		}
+		ints = append(ints, big.NewInt(0).SetBytes(val))
+	}
+	return ints, nil
+}
+
+func unmarshalCurveKeyFields(keyType byte, data []byte) ([][]byte, error) {
+	fields, err := unmarshalKeyFields(keyType, data, 2)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if len(field) != curveKeySize {
+			return nil, ErrKeyEncodingMalformed
+		}
+	}
+	return fields, nil
+}
+
+func marshalKeyFields(keyType byte, fields ...[]byte) []byte {
+	buf := bytes.NewBuffer([]byte{keyType, keyEncodingV1})
+	for _, field := range fields {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
+
+func unmarshalKeyFields(keyType byte, data []byte, count int) ([][]byte, error) {
+	if len(data) < 2 || data[0] != keyType {
+		return nil, ErrKeyEncodingMalformed
+	}
+	if data[1] != keyEncodingV1 {
+		return nil, fmt.Errorf("unknown key encoding version %d", data[1])
+	}
+	buf := bytes.NewBuffer(data[2:])
+	var fields [][]byte
+	for len(fields) < count {
+		var length uint32
+		if err := binary.Read(buf, binary.BigEndian, &length); err != nil || int(length) > buf.Len() {
+			return nil, ErrKeyEncodingMalformed
+		}
+		field := make([]byte, int(length))
+		copy(field, buf.Next(int(length)))
+		fields = append(fields, field)
+	}
+	if buf.Len() != 0 {
+		return nil, ErrKeyEncodingMalformed
+	}
+	return fields, nil
+}
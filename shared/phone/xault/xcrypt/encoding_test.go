@@ -0,0 +1,67 @@
+package xcrypt
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBinaryEncoding(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("keys can be converted to and from their binary encoding", t, func() {
+		dk, err := MakeDualKey(c, 1024)
+		So(err, ShouldBeNil)
+		dpk, err := dk.MakePublicKey()
+		So(err, ShouldBeNil)
+
+		data, err := dk.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(data[0:2], ShouldResemble, []byte{keyTypeDual, keyEncodingV1})
+		var dk2 DualKey
+		So(dk2.UnmarshalBinary(data), ShouldBeNil)
+		So(dk2.String(), ShouldEqual, dk.String())
+
+		data, err = dpk.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(data[0:2], ShouldResemble, []byte{keyTypeDualPublic, keyEncodingV1})
+		So(len(data), ShouldBeLessThan, len(dpk.String()))
+		var dpk2 DualPublicKey
+		So(dpk2.UnmarshalBinary(data), ShouldBeNil)
+		So(dpk2.String(), ShouldEqual, dpk.String())
+		So(dpk2.Fingerprint(), ShouldResemble, dpk.Fingerprint())
+
+		Convey("gob uses the binary encoding", func() {
+			var buf bytes.Buffer
+			So(gob.NewEncoder(&buf).Encode(dpk), ShouldBeNil)
+			So(bytes.Contains(buf.Bytes(), data), ShouldBeTrue)
+			var dpk3 DualPublicKey
+			So(gob.NewDecoder(&buf).Decode(&dpk3), ShouldBeNil)
+			So(dpk3.String(), ShouldEqual, dpk.String())
+		})
+
+		Convey("malformed encodings are rejected", func() {
+			var dpk3 DualPublicKey
+			So(dpk3.UnmarshalBinary(nil), ShouldNotBeNil)
+			So(dpk3.UnmarshalBinary(data[:len(data)-1]), ShouldNotBeNil)
+			So(dpk3.UnmarshalBinary(append(data, 0)), ShouldNotBeNil)
+
+			// Public and private keys can't be confused for one another.
+			var dk3 DualKey
+			So(dk3.UnmarshalBinary(data), ShouldNotBeNil)
+
+			// Unknown versions are rejected.
+			data[1]++
+			So(dpk3.UnmarshalBinary(data), ShouldNotBeNil)
+			data[1]--
+
+			// Leading zeroes aren't canonical.
+			padded := []byte{data[0], data[1], 0, 0, 0, byte(len(dpk.N.Bytes()) + 1), 0}
+			padded = append(padded, data[6:]...)
+			So(dpk3.UnmarshalBinary(padded), ShouldNotBeNil)
+		})
+	})
+}
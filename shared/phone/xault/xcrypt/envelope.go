@@ -0,0 +1,327 @@
+package xcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The info section of every envelope names the format used to encrypt its contents, OpenEnvelope
+// uses it to decide how to decrypt the ciphertext.
+const (
+	// envelopeV1 uses AES-256 in CBC mode with an all-zero IV and relies entirely on the signiature
+	// for integrity.  Envelopes of this version can still be opened, but they are no longer sealed.
+	envelopeV1 = "version 1"
+
+	// envelopeV2 uses AES-256-GCM with the info and encrypted otk as additional data, so the
+	// ciphertext is authenticated independently of the signiature.
+	envelopeV2 = "version 2"
+
+	// envelopeV3 is like envelopeV2, but the encrypted otk section holds a copy of the otk for each
+	// recipient, each encrypted with that recipient's encryption key.
+	envelopeV3 = "version 3"
+)
+
+// envelopeCipher encrypts or decrypts the contents of an envelope with a one-time-key.  ad is
+// additional data that must be authenticated along with the contents, if the mode supports it.
+type envelopeCipher func(otk, ad, text []byte) ([]byte, error)
+
+type envelopeFormat struct {
+	// multi is true if the encrypted otk section holds an encrypted otk for each recipient rather
+	// than just a single encrypted otk.
+	multi bool
+
+	decrypt envelopeCipher
+}
+
+var envelopeFormats = map[string]envelopeFormat{
+	envelopeV1: {decrypt: decryptV1},
+	envelopeV2: {decrypt: decryptV2},
+	envelopeV3: {multi: true, decrypt: decryptV2},
+}
+
+// Encrypts a large plaintext by using the recipient's encryption key to encrypt a one-time-key that
+// is used as an AES-256-GCM key to encrypt the plaintext.  The encrypted key, ciphertext, and info
+// are also signed with the sender's identity key.
+// Format of the final envelope is:
+// L3, 4 bytes, length of signiature
+// L0, 4 bytes, length of internal info
+// L1, 4 bytes, length of encrypted otk
+// L2, 4 bytes, length of ciphertext
+// internal info, L0 bytes
+// encrypted otk, L1 bytes
+// ciphertext, L2 bytes
+// signiature, L3 bytes, the signiature covers everything from L0 through the ciphertext
+func (dk *DualKey) SealEnvelope(random io.Reader, dst PublicKey, plaintext []byte) (envelope []byte, err error) {
+	return sealEnvelope(random, dk, []PublicKey{dst}, envelopeV2, encryptV2, plaintext)
+}
+
+// SealEnvelopeMulti is like SealEnvelope, except that the envelope can be opened by any of dsts.
+// The ciphertext is only stored once, along with a copy of the otk encrypted for each recipient.
+// Recipients aren't identified in the envelope, each one finds its otk by trying to decrypt them
+// all, so the only thing a third party can learn about the recipients is how many there are.
+// The encrypted otk section of the envelope has the following format:
+// L0, 4 bytes, number of encrypted otks
+// L1, 4 bytes, length of the first encrypted otk
+// first encrypted otk, L1 bytes
+// and so on for each remaining encrypted otk
+func (dk *DualKey) SealEnvelopeMulti(random io.Reader, dsts []PublicKey, plaintext []byte) (envelope []byte, err error) {
+	return sealEnvelopeMulti(random, dk, dsts, plaintext)
+}
+
+// OpenEnvelope opens an envelope created with SealEnvelope or SealEnvelopeMulti.  It verifies that
+// the message is signed by src, then decrypts it using the enclosed key and the method named in the
+// envelope's info.
+func (dk *DualKey) OpenEnvelope(random io.Reader, src PublicKey, envelope []byte) (plaintext []byte, err error) {
+	return openEnvelope(random, dk, src, envelope)
+}
+
+func sealEnvelopeMulti(random io.Reader, key PrivateKey, dsts []PublicKey, plaintext []byte) ([]byte, error) {
+	if len(dsts) == 0 {
+		return nil, fmt.Errorf("must specify at least one recipient")
+	}
+	return sealEnvelope(random, key, dsts, envelopeV3, encryptV2, plaintext)
+}
+
+func sealEnvelope(random io.Reader, key PrivateKey, dsts []PublicKey, version string, encrypt envelopeCipher, plaintext []byte) (envelope []byte, err error) {
+	info := []byte(version)
+	multi := envelopeFormats[version].multi
+	if !multi && len(dsts) != 1 {
+		return nil, fmt.Errorf("%q envelopes must have exactly one recipient", version)
+	}
+
+	// otk is a one-time-key, it will only ever be used to encrypt this plaintext
+	otk, err := makeOtk(random)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(otk)
+
+	// Encrypt the otk with each recipient's encryption key
+	var encryptedOtks [][]byte
+	for _, dst := range dsts {
+		encryptedOtk, err := dst.encryptOtk(random, otk)
+		if err != nil {
+			return nil, err
+		}
+		encryptedOtks = append(encryptedOtks, encryptedOtk)
+	}
+	encryptedOtk := encryptedOtks[0]
+	if multi {
+		encryptedOtk = packEncryptedOtks(encryptedOtks)
+	}
+
+	ciphertext, err := encrypt(otk, envelopeAdditionalData(info, encryptedOtk), plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the buffer with 4 empty bytes, we'll fill these in later with the length of the signiature
+	buf := bytes.NewBuffer(make([]byte, 4))
+	chunks := [][]byte{info, encryptedOtk, ciphertext}
+	for _, chunk := range chunks {
+		if err := binary.Write(buf, binary.LittleEndian, uint32(len(chunk))); err != nil {
+			return nil, fmt.Errorf("unable to finish writing the envelope")
+		}
+	}
+	for _, chunk := range chunks {
+		if n, err := buf.Write(chunk); n != len(chunk) || err != nil {
+			return nil, fmt.Errorf("unable to finish writing the envelope")
+		}
+	}
+
+	// Now we hash and sign the envelope that we have so far so that it can't be tampered with.
+	h := sha256.Sum256(buf.Bytes()[4:])
+	signiature, err := key.signDigest(random, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign envelope: %v", err)
+	}
+	if n, err := buf.Write(signiature); n != len(signiature) || err != nil {
+		return nil, fmt.Errorf("unable to sign envelope: %v", err)
+	}
+	envelope = buf.Bytes()
+	buf.Truncate(0)
+	binary.Write(buf, binary.LittleEndian, uint32(len(signiature)))
+
+	return envelope, nil
+}
+
+// makeOtk makes a new one-time-key suitable for AES-256.
+func makeOtk(random io.Reader) ([]byte, error) {
+	otk := make([]byte, 32)
+	if n, err := io.ReadFull(random, otk); n != len(otk) || err != nil {
+		return nil, fmt.Errorf("unable to read enough random bytes to make a otk: %v", err)
+	}
+	return otk, nil
+}
+
+func packEncryptedOtks(encryptedOtks [][]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(encryptedOtks)))
+	for _, encryptedOtk := range encryptedOtks {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(encryptedOtk)))
+		buf.Write(encryptedOtk)
+	}
+	return buf.Bytes()
+}
+
+// findOtk finds and decrypts the otk that was encrypted for key in a section packed by
+// packEncryptedOtks.
+func findOtk(random io.Reader, key PrivateKey, packed []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(packed)
+	var count uint32
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return nil, ErrVerifiedBufMalformed
+	}
+	for i := uint32(0); i < count; i++ {
+		var length uint32
+		if err := binary.Read(buf, binary.LittleEndian, &length); err != nil || int(length) > buf.Len() {
+			return nil, ErrVerifiedBufMalformed
+		}
+		if otk, err := key.decryptOtk(random, buf.Next(int(length))); err == nil {
+			return otk, nil
+		}
+	}
+	return nil, ErrNotARecipient
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// envelopeAdditionalData returns the data that an AEAD mode authenticates along with the contents
+// of an envelope: its info followed by the encrypted otk, each preceded by its length in 4 bytes
+// so that moving bytes from one to the other changes the additional data.
+func envelopeAdditionalData(info, encryptedOtk []byte) []byte {
+	var ad bytes.Buffer
+	for _, field := range [][]byte{info, encryptedOtk} {
+		binary.Write(&ad, binary.LittleEndian, uint32(len(field)))
+		ad.Write(field)
+	}
+	return ad.Bytes()
+}
+
+func newEnvelopeGCM(otk []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(otk)
+	if err != nil {
+		return nil, fmt.Errorf("unable to make cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptV2(otk, ad, plaintext []byte) ([]byte, error) {
+	gcm, err := newEnvelopeGCM(otk)
+	if err != nil {
+		return nil, err
+	}
+	// Notice that the nonce here is all zeroes, this is ok because this otk will never be used
+	// again.
+	return gcm.Seal(nil, make([]byte, gcm.NonceSize()), plaintext, ad), nil
+}
+
+func decryptV2(otk, ad, ciphertext []byte) ([]byte, error) {
+	gcm, err := newEnvelopeGCM(otk)
+	if err != nil {
+		return nil, ErrVerifiedBufMalformed
+	}
+	plaintext, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), ciphertext, ad)
+	if err != nil {
+		return nil, ErrVerifiedBufMalformed
+	}
+	return plaintext, nil
+}
+
+func decryptV1(otk, ad, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(otk)
+	if err != nil || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, ErrVerifiedBufMalformed
+	}
+	plaintext := ciphertext
+	cipher.NewCBCDecrypter(block, make([]byte, block.BlockSize())).CryptBlocks(plaintext, ciphertext)
+	// The plaintext was padded by adding a 1, then adding 0s until the length was a multiple of
+	// blocks.
+	for len(plaintext) > 0 {
+		b := plaintext[len(plaintext)-1]
+		plaintext = plaintext[0 : len(plaintext)-1]
+		if b == 1 {
+			break
+		}
+		if b != 0 {
+			return nil, ErrVerifiedBufMalformed
+		}
+	}
+	return plaintext, nil
+}
+
+var ErrUnableToVerify = fmt.Errorf("unable to verify envelope")
+var ErrVerifiedBufMalformed = fmt.Errorf("envelope verified, but contents are malformed")
+var ErrUnknownEnvelopeVersion = fmt.Errorf("envelope verified, but its version is not supported")
+var ErrNotARecipient = fmt.Errorf("envelope verified, but it was not sealed for this key")
+
+func openEnvelope(random io.Reader, key PrivateKey, src PublicKey, envelope []byte) (plaintext []byte, err error) {
+	if len(envelope) < 32 {
+		return nil, ErrUnableToVerify
+	}
+
+	// Strip off the length of the signiature from the front of the envelope
+	var siglen uint32
+	if err := binary.Read(bytes.NewBuffer(envelope[0:4]), binary.LittleEndian, &siglen); err != nil {
+		return nil, ErrUnableToVerify
+	}
+	envelope = envelope[4:]
+	if uint64(siglen) > uint64(len(envelope)) {
+		return nil, ErrUnableToVerify
+	}
+	// Strip the signiature itself off the back of the envelope
+	sig := envelope[len(envelope)-int(siglen):]
+	envelope = envelope[0 : len(envelope)-int(siglen)]
+	h := sha256.Sum256(envelope)
+	if err := src.verifyDigest(h[:], sig); err != nil {
+		return nil, ErrUnableToVerify
+	}
+
+	// We can now trust that the envelope is from who we thought it was from.
+	var infoLen, eotkLen, cipherLen uint32
+	buf := bytes.NewBuffer(envelope)
+	for _, val := range []*uint32{&infoLen, &eotkLen, &cipherLen} {
+		if err := binary.Read(buf, binary.LittleEndian, val); err != nil {
+			return nil, ErrVerifiedBufMalformed
+		}
+	}
+	if int64(infoLen)+int64(eotkLen)+int64(cipherLen) != int64(len(buf.Bytes())) {
+		return nil, ErrVerifiedBufMalformed
+	}
+
+	info := make([]byte, int(infoLen))
+	eotk := make([]byte, int(eotkLen))
+	ciphertext := make([]byte, int(cipherLen))
+	for _, chunk := range [][]byte{info, eotk, ciphertext} {
+		if n, err := buf.Read(chunk); n != len(chunk) || err != nil {
+			return nil, ErrVerifiedBufMalformed
+		}
+	}
+	format, ok := envelopeFormats[string(info)]
+	if !ok {
+		return nil, ErrUnknownEnvelopeVersion
+	}
+
+	var otk []byte
+	if format.multi {
+		if otk, err = findOtk(random, key, eotk); err != nil {
+			return nil, err
+		}
+	} else {
+		if otk, err = key.decryptOtk(random, eotk); err != nil {
+			return nil, ErrVerifiedBufMalformed
+		}
+	}
+	defer zeroBytes(otk)
+
+	return format.decrypt(otk, envelopeAdditionalData(info, eotk), ciphertext)
+}
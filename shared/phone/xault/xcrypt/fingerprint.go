@@ -0,0 +1,69 @@
+package xcrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"math/big"
+	"sort"
+)
+
+// DefaultFingerprintWords is the number of words that FingerprintWords and SafetyWords should be
+// asked for unless there's a reason to use more or fewer.  With the default word list this is a
+// little more than 70 bits.
+const DefaultFingerprintWords = 8
+
+// Fingerprint returns a SHA-256 hash of the canonical binary encoding of dpk.  Two keys have the
+// same fingerprint if and only if they are the same key.
+func (dpk *DualPublicKey) Fingerprint() []byte {
+	return fingerprint(dpk)
+}
+
+// Fingerprint returns a SHA-256 hash of the canonical binary encoding of cpk.
+func (cpk *CurvePublicKey) Fingerprint() []byte {
+	return fingerprint(cpk)
+}
+
+func fingerprint(key encoding.BinaryMarshaler) []byte {
+	data, err := key.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// FingerprintWords renders fingerprint as numWords words from km's word list, so that it can be
+// read aloud and compared by two people.  Each word adds about 9 bits with the default word list.
+// The words are in km's language, so both people need to use the same language.
+func (km *KeyMaker) FingerprintWords(fingerprint []byte, numWords int) []string {
+	return fingerprintWords(km.words, fingerprint, numWords)
+}
+
+// fingerprintWords renders fingerprint as numWords words from list.
+func fingerprintWords(list []string, fingerprint []byte, numWords int) []string {
+	val := big.NewInt(0).SetBytes(fingerprint)
+	base := big.NewInt(int64(len(list)))
+	mod := big.NewInt(0)
+	var words []string
+	for len(words) < numWords {
+		val.DivMod(val, base, mod)
+		words = append(words, list[int(mod.Int64())])
+	}
+	return words
+}
+
+// SafetyWords renders the pair of keys a and b as numWords words from km's word list.  The words
+// don't depend on the order of a and b, so two users can each compute them for their own key and
+// the key they have for the other, then read them aloud to confirm that both keys are correct.
+func (km *KeyMaker) SafetyWords(a, b PublicKey, numWords int) []string {
+	fingerprints := [][]byte{a.Fingerprint(), b.Fingerprint()}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return bytes.Compare(fingerprints[i], fingerprints[j]) < 0
+	})
+	h := sha256.New()
+	for _, fingerprint := range fingerprints {
+		h.Write(fingerprint)
+	}
+	return km.FingerprintWords(h.Sum(nil), numWords)
+}
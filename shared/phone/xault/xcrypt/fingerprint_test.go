@@ -0,0 +1,45 @@
+package xcrypt
+
+import (
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFingerprint(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("public keys have stable fingerprints", t, func() {
+		var keys []*DualPublicKey
+		for i := 0; i < 2; i++ {
+			dk, err := MakeDualKey(c, 1024)
+			So(err, ShouldBeNil)
+			dpk, err := dk.MakePublicKey()
+			So(err, ShouldBeNil)
+			keys = append(keys, dpk)
+		}
+		So(len(keys[0].Fingerprint()), ShouldEqual, 32)
+		So(keys[0].Fingerprint(), ShouldNotResemble, keys[1].Fingerprint())
+		dpk, err := DualPublicKeyFromString(keys[0].String())
+		So(err, ShouldBeNil)
+		So(dpk.Fingerprint(), ShouldResemble, keys[0].Fingerprint())
+
+		Convey("fingerprints can be rendered as words", func() {
+			km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+			So(err, ShouldBeNil)
+			words := km.FingerprintWords(keys[0].Fingerprint(), DefaultFingerprintWords)
+			So(len(words), ShouldEqual, DefaultFingerprintWords)
+			So(km.FingerprintWords(dpk.Fingerprint(), DefaultFingerprintWords), ShouldResemble, words)
+			So(km.FingerprintWords(keys[1].Fingerprint(), DefaultFingerprintWords), ShouldNotResemble, words)
+			for _, word := range words {
+				So(km.words, ShouldContain, word)
+			}
+
+			safety := km.SafetyWords(keys[0], keys[1], DefaultFingerprintWords)
+			So(len(safety), ShouldEqual, DefaultFingerprintWords)
+			So(km.SafetyWords(keys[1], keys[0], DefaultFingerprintWords), ShouldResemble, safety)
+			So(km.SafetyWords(keys[0], keys[0], DefaultFingerprintWords), ShouldNotResemble, safety)
+		})
+	})
+}
@@ -0,0 +1,164 @@
+package xcrypt
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Names of the key algorithms that xcrypt supports.  These are the values used in the Algorithm
+// field of a version in versions.txt.
+const (
+	// AlgorithmDualRSA is a DualKey, a single RSA key with one exponent for encryption and another
+	// for signing.
+	AlgorithmDualRSA = "dual-rsa"
+
+	// AlgorithmX25519Ed25519 is a CurveKey, an Ed25519 key for signing and an X25519 key for
+	// encryption.  These are much faster to generate and much smaller than a DualKey.
+	AlgorithmX25519Ed25519 = "x25519-ed25519"
+)
+
+// PublicIdentityKey is the part of a public key that verifies signatures.
+type PublicIdentityKey interface {
+	// Verify checks a detached signature made by the corresponding private key's Sign.
+	Verify(data, sig []byte) (*Signature, error)
+
+	// verifyDigest checks a signiature of a SHA-256 digest made by signDigest.
+	verifyDigest(digest, sig []byte) error
+}
+
+// PublicEncryptionKey is the part of a public key that envelopes are sealed to.
+type PublicEncryptionKey interface {
+	// encryptOtk encrypts a one-time-key so that only the corresponding private key can decrypt it.
+	encryptOtk(random io.Reader, otk []byte) ([]byte, error)
+}
+
+// PublicKey is the public half of a key pair of any algorithm.
+type PublicKey interface {
+	PublicIdentityKey
+	PublicEncryptionKey
+
+	// Algorithm returns the name of the key's algorithm, one of the Algorithm constants.
+	Algorithm() string
+
+	// Fingerprint returns a SHA-256 hash of the key's canonical binary encoding.
+	Fingerprint() []byte
+
+	MarshalBinary() ([]byte, error)
+	Validate() error
+	String() string
+}
+
+// IdentityKey is the part of a private key that makes signatures.
+type IdentityKey interface {
+	// Sign makes a detached signature of data, see DualKey.Sign.
+	Sign(random io.Reader, data []byte, context string) ([]byte, error)
+
+	// signDigest signs a SHA-256 digest.
+	signDigest(random io.Reader, digest []byte) ([]byte, error)
+}
+
+// EncryptionKey is the part of a private key that seals and opens envelopes.  Envelopes are signed
+// with the sender's identity key, so sealing an envelope uses both parts of the private key.
+type EncryptionKey interface {
+	SealEnvelope(random io.Reader, dst PublicKey, plaintext []byte) ([]byte, error)
+	OpenEnvelope(random io.Reader, src PublicKey, envelope []byte) ([]byte, error)
+
+	// decryptOtk decrypts a one-time-key encrypted by the corresponding public key's encryptOtk.
+	decryptOtk(random io.Reader, encryptedOtk []byte) ([]byte, error)
+}
+
+// PrivateKey is a key pair of any algorithm.  Keys of different algorithms can be used together,
+// for example a DualKey can seal an envelope to a CurvePublicKey.
+type PrivateKey interface {
+	IdentityKey
+	EncryptionKey
+
+	// Algorithm returns the name of the key's algorithm, one of the Algorithm constants.
+	Algorithm() string
+
+	// Public returns the public half of the key.
+	Public() (PublicKey, error)
+
+	MarshalBinary() ([]byte, error)
+	Validate() error
+	String() string
+
+	// Zero overwrites the key's private values so that they don't linger in memory.  The key can't
+	// be used afterwards.
+	Zero()
+}
+
+// UnmarshalPublicKey parses a public key of any algorithm from the binary encoding produced by its
+// MarshalBinary.  Like UnmarshalBinary, it doesn't validate the key.
+func UnmarshalPublicKey(data []byte) (PublicKey, error) {
+	if len(data) == 0 {
+		return nil, ErrKeyEncodingMalformed
+	}
+	switch data[0] {
+	case keyTypeDualPublic:
+		var dpk DualPublicKey
+		if err := dpk.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return &dpk, nil
+	case keyTypeCurvePublic:
+		var cpk CurvePublicKey
+		if err := cpk.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return &cpk, nil
+	}
+	return nil, fmt.Errorf("unknown public key type %d", data[0])
+}
+
+// UnmarshalPrivateKey parses a private key of any algorithm from the binary encoding produced by
+// its MarshalBinary.  Like UnmarshalBinary, it doesn't validate the key.
+func UnmarshalPrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) == 0 {
+		return nil, ErrKeyEncodingMalformed
+	}
+	switch data[0] {
+	case keyTypeDual:
+		var dk DualKey
+		if err := dk.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return &dk, nil
+	case keyTypeCurve:
+		var ck CurveKey
+		if err := ck.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return &ck, nil
+	}
+	return nil, fmt.Errorf("unknown private key type %d", data[0])
+}
+
+// makeKey makes a new key of the named algorithm.  As long as findPrime is deterministic, keys are
+// generated deterministically from random, so the same bytes always give the same key.  bits and
+// findPrime are only used by algorithms that need them.  ctx and progress are used as they are by
+// MakeDualKeyContext.
+func makeKey(ctx context.Context, random io.Reader, algorithm string, bits int, findPrime primeFunc, progress func(stage string, frac float64)) (PrivateKey, error) {
+	switch algorithm {
+	case AlgorithmDualRSA:
+		dk, err := makeDualKey(ctx, random, bits, findPrime, progress)
+		if err != nil {
+			return nil, err
+		}
+		return dk, nil
+	case AlgorithmX25519Ed25519:
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ck, err := MakeCurveKey(random)
+		if err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(StageDone, 1)
+		}
+		return ck, nil
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", algorithm)
+}
@@ -0,0 +1,115 @@
+package xcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The scrypt parameters used by SealWithPassphrase.  N = 2^15 takes around 100ms and 32MB on a
+// phone, which is about as much as is reasonable to spend every time the keys are unlocked.  The
+// parameters are stored with the ciphertext, so they can be raised later without breaking anything
+// that was already sealed.
+const (
+	passphraseLogN = 15
+	passphraseR    = 8
+	passphraseP    = 1
+
+	// passphraseMaxLogN, passphraseMaxR, and passphraseMaxP bound the parameters that
+	// OpenWithPassphrase will use, so that a corrupted header can't make it run for minutes or run
+	// out of memory.  scrypt needs N*r*128 bytes of memory, so this keeps it to at most 256MiB, 8
+	// times the default, and p adds time but not memory, so at most 32 times the default.
+	passphraseMaxLogN = 18
+	passphraseMaxR    = 8
+	passphraseMaxP    = 4
+
+	passphraseVersion  = 1
+	passphraseSaltSize = 16
+	passphraseKeySize  = 32
+)
+
+var (
+	ErrWrongPassphrase         = fmt.Errorf("the passphrase is wrong or the data has been corrupted")
+	ErrPassphraseDataMalformed = fmt.Errorf("passphrase protected data is malformed")
+)
+
+// passphraseHeader is the header of data sealed by SealWithPassphrase.  It's encoded in little
+// endian order and is also used as the additional data of the ciphertext.
+type passphraseHeader struct {
+	Version    uint32
+	LogN, R, P uint32
+	Salt       [passphraseSaltSize]byte
+}
+
+// SealWithPassphrase encrypts plaintext with a key derived from passphrase with scrypt, so that it
+// can only be decrypted by OpenWithPassphrase with the same passphrase.
+// Format of the sealed data is:
+// version, 4 bytes
+// scrypt parameters log2(N), r, and p, 4 bytes each
+// salt, 16 bytes
+// ciphertext, AES-256-GCM with the header above as additional data
+func SealWithPassphrase(random io.Reader, passphrase string, plaintext []byte) ([]byte, error) {
+	header := passphraseHeader{
+		Version: passphraseVersion,
+		LogN:    passphraseLogN,
+		R:       passphraseR,
+		P:       passphraseP,
+	}
+	if _, err := io.ReadFull(random, header.Salt[:]); err != nil {
+		return nil, fmt.Errorf("unable to make salt: %v", err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	gcm, err := passphraseGCM(passphrase, &header)
+	if err != nil {
+		return nil, err
+	}
+	// Notice that the nonce here is all zeroes, this is ok because the salt is random so this key
+	// will never be used again.
+	return gcm.Seal(buf.Bytes(), make([]byte, gcm.NonceSize()), plaintext, buf.Bytes()), nil
+}
+
+// OpenWithPassphrase decrypts data sealed by SealWithPassphrase.  It returns ErrWrongPassphrase if
+// passphrase is wrong.
+func OpenWithPassphrase(passphrase string, sealed []byte) ([]byte, error) {
+	var header passphraseHeader
+	size := binary.Size(header)
+	if len(sealed) < size {
+		return nil, ErrPassphraseDataMalformed
+	}
+	if err := binary.Read(bytes.NewReader(sealed), binary.LittleEndian, &header); err != nil {
+		return nil, ErrPassphraseDataMalformed
+	}
+	if header.Version != passphraseVersion {
+		return nil, fmt.Errorf("unknown passphrase data version %d", header.Version)
+	}
+	if header.LogN < 1 || header.LogN > passphraseMaxLogN || header.R < 1 || header.R > passphraseMaxR || header.P < 1 || header.P > passphraseMaxP {
+		return nil, ErrPassphraseDataMalformed
+	}
+	gcm, err := passphraseGCM(passphrase, &header)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), sealed[size:], sealed[:size])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func passphraseGCM(passphrase string, header *passphraseHeader) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), header.Salt[:], 1<<header.LogN, int(header.R), int(header.P), passphraseKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive key from passphrase: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,55 @@
+package xcrypt
+
+import (
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPassphrase(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("data sealed with a passphrase can only be opened with that passphrase", t, func() {
+		plaintext := []byte("this is the plaintext")
+		sealed, err := SealWithPassphrase(c, "1234", plaintext)
+		So(err, ShouldBeNil)
+		opened, err := OpenWithPassphrase("1234", sealed)
+		So(err, ShouldBeNil)
+		So(opened, ShouldResemble, plaintext)
+
+		again, err := SealWithPassphrase(c, "1234", plaintext)
+		So(err, ShouldBeNil)
+		So(again, ShouldNotResemble, sealed)
+
+		_, err = OpenWithPassphrase("1235", sealed)
+		So(err, ShouldEqual, ErrWrongPassphrase)
+		_, err = OpenWithPassphrase("", sealed)
+		So(err, ShouldEqual, ErrWrongPassphrase)
+		_, err = OpenWithPassphrase("1234", sealed[:10])
+		So(err, ShouldEqual, ErrPassphraseDataMalformed)
+
+		// The header is authenticated along with the ciphertext.
+		for _, i := range []int{5, 20, len(sealed) - 1} {
+			tampered := append([]byte{}, sealed...)
+			tampered[i] ^= 1
+			_, err = OpenWithPassphrase("1234", tampered)
+			So(err, ShouldNotBeNil)
+		}
+
+		// Parameters that would take too long or too much memory are rejected without deriving a
+		// key.
+		for _, i := range []int{4, 8, 12} {
+			tampered := append([]byte{}, sealed...)
+			tampered[i] = 40
+			_, err = OpenWithPassphrase("1234", tampered)
+			So(err, ShouldEqual, ErrPassphraseDataMalformed)
+		}
+		for i, max := range map[int]byte{4: passphraseMaxLogN, 8: passphraseMaxR, 12: passphraseMaxP} {
+			tampered := append([]byte{}, sealed...)
+			tampered[i] = max + 1
+			_, err = OpenWithPassphrase("1234", tampered)
+			So(err, ShouldEqual, ErrPassphraseDataMalformed)
+		}
+	})
+}
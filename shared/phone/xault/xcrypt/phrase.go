@@ -1,9 +1,11 @@
 package xcrypt
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/rand"
 	"crypto/sha256"
+	_ "embed"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,82 +18,267 @@ import (
 	"github.com/seehuhn/fortuna"
 )
 
+// DefaultLanguage is the language of the words in words.txt, and the language of new phrases unless
+// another language is chosen with InLanguage.
+const DefaultLanguage = "en"
+
 type KeyMaker struct {
-	// words is the set of words that can be used in the generated passphrase.  These words should
-	// be chosen such that all pairs of words are at least edit distance two apart.
-	words []string
+	// language is the language of new phrases and fingerprint words, and words is its word list.
+	// These words should be chosen such that all pairs of words are at least edit distance two
+	// apart.
+	language string
+	words    []string
+
+	// languages maps every supported language to its word list.  A phrase in any of these languages
+	// can regenerate its key.
+	languages map[string][]string
 
 	// versions is used to indicate the specs that were used to generate the key.  One of these
 	// words will be included in the phrase and that decides both the algorithm and the parameters.
-	// Right now only one, android, is used, but in the future these others might be used to
-	// indicate other parameters, like longer key length or keys generated in a different way.
+	// New phrases use the current version of their language, but a phrase with any version word can
+	// regenerate its key.
 	versions versions
 }
 
 type versions struct {
+	// Current is the version used for new phrases in DefaultLanguage.
 	Current string
-	Words   map[string]versionInfo
+
+	// Languages maps every other language to the version used for new phrases in that language.
+	Languages map[string]string
+
+	Words map[string]versionInfo
 }
 type versionInfo struct {
+	// Language is the language of the version word, and of every other word in phrases that use
+	// it.  It defaults to DefaultLanguage.
+	Language string
+
+	// Algorithm is the algorithm of the key, one of the Algorithm constants.  It defaults to
+	// AlgorithmDualRSA, which is what every version used before there was a choice.  versions.txt
+	// only has AlgorithmDualRSA versions, since xault can only save DualKeys so far, and a version
+	// can't be taken back once phrases have been made with it.
+	Algorithm string
+
+	// KeyBits is the size of the key, for algorithms whose key size can vary.
 	KeyBits int
+
+	// Derivation names the way that the key is derived from the phrase, see derivations.  It
+	// defaults to derivationLegacy, which is what every version used before there was a choice.
+	Derivation string
+
+	// ChecksumWords is the number of checksum words at the end of the phrase.  With a checksum a
+	// phrase with a wrong, missing, or misplaced word can be detected.  It takes four words for a
+	// fix to be trusted without asking, with fewer the fix is only suggested, see fixPhrase.
+	ChecksumWords int
 }
 
-// MakeKeyMaker makes a KeyMaker object that can be used to generate DualKeys with associated
-// phrases that can be used to regenerate those keys later.
-func MakeKeyMaker(wordsPath, versionPath string) (*KeyMaker, error) {
-	wordsData, err := ioutil.ReadFile(wordsPath)
+func (info versionInfo) algorithm() string {
+	if info.Algorithm == "" {
+		return AlgorithmDualRSA
+	}
+	return info.Algorithm
+}
+
+func (info versionInfo) language() string {
+	if info.Language == "" {
+		return DefaultLanguage
+	}
+	return info.Language
+}
+
+// current returns the version used for new phrases in language.
+func (vs *versions) current(language string) string {
+	if language == DefaultLanguage {
+		return vs.Current
+	}
+	return vs.Languages[language]
+}
+
+// The word lists used by DefaultKeyMaker are embedded so that they don't need to be copied out of
+// an app's assets before they can be used.
+var (
+	//go:embed words.txt
+	defaultWordsData []byte
+
+	//go:embed words_es.txt
+	defaultWordsDataEs []byte
+
+	//go:embed words_de.txt
+	defaultWordsDataDe []byte
+
+	//go:embed versions.txt
+	defaultVersionsData []byte
+
+	defaultKeyMaker *KeyMaker
+)
+
+func init() {
+	wordsData := map[string][]byte{
+		DefaultLanguage: defaultWordsData,
+		"es":            defaultWordsDataEs,
+		"de":            defaultWordsDataDe,
+	}
+	km, err := makeKeyMaker(wordsData, defaultVersionsData)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read words file %q: %v", wordsPath, err)
+		panic(fmt.Sprintf("embedded word lists are invalid: %v", err))
+	}
+	defaultKeyMaker = km
+}
+
+// DefaultKeyMaker returns a KeyMaker that uses the word lists and versions.txt that are built into
+// xcrypt.  These are checked when the package is initialized, so this can't fail.  It makes phrases
+// in DefaultLanguage, but can regenerate keys from phrases in any of its languages.
+func DefaultKeyMaker() *KeyMaker {
+	return defaultKeyMaker
+}
+
+// MakeKeyMaker makes a KeyMaker object that can be used to generate keys with associated
+// phrases that can be used to regenerate those keys later.  Most users should use DefaultKeyMaker,
+// this is for tests and alternate word lists.  wordsPath is the word list for DefaultLanguage, use
+// MakeMultilingualKeyMaker to support other languages too.
+func MakeKeyMaker(wordsPath, versionPath string) (*KeyMaker, error) {
+	return MakeMultilingualKeyMaker(map[string]string{DefaultLanguage: wordsPath}, versionPath)
+}
+
+// MakeMultilingualKeyMaker is like MakeKeyMaker, but supports phrases in several languages.
+// wordsPaths maps each language to the path of its word list, and must include DefaultLanguage.
+// Every language other than DefaultLanguage needs a current version in the versions file.
+func MakeMultilingualKeyMaker(wordsPaths map[string]string, versionPath string) (*KeyMaker, error) {
+	wordsData := make(map[string][]byte)
+	for language, wordsPath := range wordsPaths {
+		data, err := ioutil.ReadFile(wordsPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read words file %q: %v", wordsPath, err)
+		}
+		wordsData[language] = data
 	}
 	versionData, err := ioutil.ReadFile(versionPath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read versions file %q: %v", versionPath, err)
 	}
-	var km KeyMaker
-	if err := json.Unmarshal(versionData, &km.versions); err != nil {
-		return nil, fmt.Errorf("unable to read version file %q: %v", versionPath, err)
+	km, err := makeKeyMaker(wordsData, versionData)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use %q: %v", versionPath, err)
 	}
-	km.words = strings.Fields(string(wordsData))
-	if len(km.words) <= 1 {
-		return nil, fmt.Errorf("not enough words supplied")
+	return km, nil
+}
+
+func makeKeyMaker(wordsData map[string][]byte, versionData []byte) (*KeyMaker, error) {
+	km := KeyMaker{
+		language:  DefaultLanguage,
+		languages: make(map[string][]string),
 	}
-	for i := range km.words {
-		km.words[i] = strings.ToLower(km.words[i])
+	if err := json.Unmarshal(versionData, &km.versions); err != nil {
+		return nil, fmt.Errorf("unable to parse versions: %v", err)
 	}
-	for word := range km.versions.Words {
+	for word, info := range km.versions.Words {
 		if strings.ToLower(word) != word {
 			return nil, fmt.Errorf("versions contains %q which is not lower-cased", word)
 		}
+		switch info.algorithm() {
+		case AlgorithmDualRSA, AlgorithmX25519Ed25519:
+		default:
+			return nil, fmt.Errorf("version %q uses unknown algorithm %q", word, info.Algorithm)
+		}
+		if _, ok := derivations[info.Derivation]; !ok {
+			return nil, fmt.Errorf("version %q uses unknown derivation %q", word, info.Derivation)
+		}
+		if info.ChecksumWords < 0 || info.ChecksumWords > maxChecksumWords {
+			return nil, fmt.Errorf("version %q must use between 0 and %d checksum words", word, maxChecksumWords)
+		}
 	}
 
 	// Sanity checks
-	// Make sure that the current version is a valid version
-	if _, ok := km.versions.Words[km.versions.Current]; !ok {
-		return nil, fmt.Errorf("current version %q is not a valid version", km.versions.Current)
-	}
-	// Make sure that no version words are present in the word list
-	for _, word := range km.words {
-		if _, ok := km.versions.Words[word]; ok {
-			return nil, fmt.Errorf("%q was present in both the word list and in the version words", word)
+	// Make sure that the current version of each language is a valid version in that language
+	if _, ok := km.versions.Languages[DefaultLanguage]; ok {
+		return nil, fmt.Errorf("the current version of %q must be given by Current", DefaultLanguage)
+	}
+	if _, ok := wordsData[DefaultLanguage]; !ok {
+		return nil, fmt.Errorf("no words supplied for %q", DefaultLanguage)
+	}
+	for language := range wordsData {
+		current := km.versions.current(language)
+		info, ok := km.versions.Words[current]
+		if !ok {
+			return nil, fmt.Errorf("current version %q of %q is not a valid version", current, language)
+		}
+		if info.language() != language {
+			return nil, fmt.Errorf("current version %q of %q is a version for %q", current, language, info.language())
 		}
 	}
-	// Make sure that pair of words, including version words, have edit distance of one.
-	before := km.words
-	for versionWord := range km.versions.Words {
-		km.words = append(km.words, versionWord)
-	}
-	if worst, dist := findWorstCaseWords(km.words); dist <= 1 {
-		return nil, fmt.Errorf("these words have edit distance one or less: %v", worst)
+	for language, data := range wordsData {
+		words := strings.Fields(string(data))
+		if len(words) <= 1 {
+			return nil, fmt.Errorf("not enough words supplied for %q", language)
+		}
+		for i := range words {
+			words[i] = strings.ToLower(words[i])
+		}
+		// Make sure that no version words, in any language, are present in the word list
+		for _, word := range words {
+			if _, ok := km.versions.Words[word]; ok {
+				return nil, fmt.Errorf("%q was present in both the %q word list and in the version words", word, language)
+			}
+		}
+		// Make sure that pair of words, including the language's version words, have edit distance
+		// of more than one.
+		all := append([]string{}, words...)
+		for versionWord, info := range km.versions.Words {
+			if info.language() == language {
+				all = append(all, versionWord)
+			}
+		}
+		if err := CheckWordDistances(all); err != nil {
+			return nil, fmt.Errorf("%q: %v", language, err)
+		}
+		km.languages[language] = words
 	}
-	km.words = before
+	km.words = km.languages[km.language]
 
 	return &km, nil
 }
 
-// GenerateKeyAndPhrase generates a DualKey and an associated phrase that can be used to recreate
-// the key.  The phrase is chosen such that it contains worddBits bits of entropy.  The phrase is
-// used to seed a generator that will generate a DualKey.
-func (km *KeyMaker) GenerateKeyAndPhrase(random io.Reader, wordBits int) (*DualKey, []string, error) {
+// Languages returns every language that km can regenerate keys from phrases in, in sorted order.
+func (km *KeyMaker) Languages() []string {
+	var languages []string
+	for language := range km.languages {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Language returns the language of the phrases and fingerprint words made by km.
+func (km *KeyMaker) Language() string {
+	return km.language
+}
+
+// InLanguage returns a KeyMaker that is the same as km except that it makes phrases and fingerprint
+// words in language.  It can still regenerate keys from phrases in every language.  Note that
+// fingerprint and safety words are only comparable between KeyMakers in the same language.
+func (km *KeyMaker) InLanguage(language string) (*KeyMaker, error) {
+	words, ok := km.languages[language]
+	if !ok {
+		return nil, fmt.Errorf("language %q is not supported", language)
+	}
+	other := *km
+	other.language = language
+	other.words = words
+	return &other, nil
+}
+
+// GenerateKeyAndPhrase generates a key and an associated phrase that can be used to recreate the
+// key.  The phrase is chosen such that it contains worddBits bits of entropy.  The phrase is in km's
+// language and is used to seed a generator that will generate a key using the algorithm of that
+// language's current version.
+func (km *KeyMaker) GenerateKeyAndPhrase(random io.Reader, wordBits int) (PrivateKey, []string, error) {
+	return km.GenerateKeyAndPhraseContext(context.Background(), random, wordBits, nil)
+}
+
+// GenerateKeyAndPhraseContext is like GenerateKeyAndPhrase, but it can be cancelled and reports its
+// progress in the same way as MakeDualKeyContext.
+func (km *KeyMaker) GenerateKeyAndPhraseContext(ctx context.Context, random io.Reader, wordBits int, progress func(stage string, frac float64)) (PrivateKey, []string, error) {
 	bitsPerWord := math.Log2(float64(len(km.words)))
 	var phrase []string
 	for bits := 0.0; bits+math.Log2(float64(len(phrase)+1)) < float64(wordBits); bits += bitsPerWord {
@@ -106,12 +293,18 @@ func (km *KeyMaker) GenerateKeyAndPhrase(random io.Reader, wordBits int) (*DualK
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to select a random set of words")
 	}
-	phrase = append(phrase, km.versions.Current)
+	phrase = append(phrase, km.versions.current(km.language))
 	swap := int(num.Int64())
 	last := len(phrase) - 1
 	phrase[swap], phrase[last] = phrase[last], phrase[swap]
-	key, _, err := km.RegenerateKeyFromPhrase(phrase)
+	if n := km.versions.Words[km.versions.current(km.language)].ChecksumWords; n > 0 {
+		phrase = append(phrase, phraseChecksum(km.words, phrase, n)...)
+	}
+	key, _, err := km.RegenerateKeyFromPhraseContext(ctx, phrase, progress)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
 		return nil, nil, fmt.Errorf("failed to make key: %v", err)
 	}
 	return key, phrase, nil
@@ -134,148 +327,36 @@ func makeFortunaReader(seed []byte) *fortunaReader {
 	return &fortunaReader{gen: gen}
 }
 
-func loadWords(path string) ([]string, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	words := strings.Fields(string(data))
-	for i := range words {
-		words[i] = strings.ToLower(words[i])
-	}
-	return words, nil
-}
-
-// editDistance computes the edit distance between a and b, where adding or deleting a character
-// costs 1 and swapping two adjacent characters also costs 1.
-func editDistance(a, b string) int {
-	if len(b) < len(a) {
-		a, b = b, a
-	}
-	score := make([][]int, len(a)+1)
-	for i := range score {
-		score[i] = make([]int, len(b)+1)
-		for j := range score[i] {
-			score[i][j] = -1
-		}
-	}
-	return editDistanceHelper(a, b, 0, 0, score)
-}
-
-func editDistanceHelper(a, b string, i, j int, score [][]int) int {
-	if i == len(a) {
-		return len(b) - j
-	}
-	if j == len(b) {
-		return len(a) - i
-	}
-	if score[i][j] != -1 {
-		return score[i][j]
-	}
-	if a[i] == b[i] {
-		return editDistanceHelper(a, b, i+1, j+1, score)
-	}
-	opts := []int{
-		editDistanceHelper(a, b, i+1, j, score) + 1,
-		editDistanceHelper(a, b, i, j+1, score) + 1,
-		editDistanceHelper(a, b, i+1, j+1, score) + 1,
-	}
-	if i < len(a)-1 && j < len(b)-1 && a[i] == b[j+1] && b[j] == a[i+1] {
-		opts = append(opts, editDistanceHelper(a, b, i+2, j+2, score)+1)
-	}
-	sort.Ints(opts)
-	score[i][j] = opts[0]
-	return score[i][j]
-}
-
-func findWorstCaseWords(words []string) ([]string, int) {
-	m := make(map[string]int)
-	for i := range words {
-		a := words[i]
-		for j := i + 1; j < len(words); j++ {
-			b := words[j]
-			ed := editDistance(a, b)
-			if _, ok := m[a]; !ok {
-				m[a] = ed
-			}
-			if _, ok := m[b]; !ok {
-				m[b] = ed
-			}
-			if ed < m[a] {
-				m[a] = ed
-			}
-			if ed < m[b] {
-				m[b] = ed
-			}
-		}
-	}
-	m2 := make(map[int][]string)
-	for word, ed := range m {
-		m2[ed] = append(m2[ed], word)
-	}
-	worst := -1
-	for dist := range m2 {
-		if worst == -1 || dist < worst {
-			worst = dist
-		}
-	}
-	return m2[worst], worst
-}
-
 // RegenerateKeyFromPhrase takes a phrase that was returned from GenerateKeyAndPhrase and returns
 // the same key that was previously returned with this phrase.  The phrase must contain the words in
-// the same order, but minor misspellings will be corrected.  If successful, this function will
-// return the key and the phrase with any corrections that were applied to it.
-func (km *KeyMaker) RegenerateKeyFromPhrase(phrase []string) (dk *DualKey, corrected []string, err error) {
-	corrected = make([]string, len(phrase))
-	copy(corrected, phrase)
-	// Correct phrase words if necessary
-	for i := range corrected {
-		corrected[i] = strings.ToLower(corrected[i])
-	}
-	words := km.words
-	for versionWord := range km.versions.Words {
-		words = append(words, versionWord)
-	}
-	var version string
-	for i := range corrected {
-		var bestWord string
-		var bestScore int = 1000
-		for _, word := range words {
-			ed := editDistance(corrected[i], word)
-			if ed < bestScore {
-				bestScore = ed
-				bestWord = word
-				if ed == 0 {
-					break
-				}
-			}
-		}
-		if bestScore >= 2 {
-			return nil, nil, fmt.Errorf("%q is not a valid word", corrected[i])
-		}
-		if bestWord != corrected[i] {
-			corrected[i] = bestWord
-		}
-		if _, ok := km.versions.Words[corrected[i]]; ok {
-			if version != "" {
-				return nil, nil, fmt.Errorf("%q and %q should not both be in the phrase", version, corrected[i])
-			}
-			version = corrected[i]
-		}
-	}
-	if version == "" {
-		return nil, nil, fmt.Errorf("phrase did not encode a version")
+// the same order, but minor misspellings will be corrected.  If the phrase has checksum words then
+// one wrong, missing, extra, or misplaced word will also be corrected if there's only one way to do
+// so and there are enough checksum words to be sure of it, otherwise the *PhraseError has the fix
+// as a Suggestion that the user has to confirm.  The phrase can be in any of km's languages, which
+// is detected from its words.  If successful, this function will return the key and the phrase with
+// any corrections that were applied to it, otherwise the error will be a *PhraseError that says
+// where the problem is.
+func (km *KeyMaker) RegenerateKeyFromPhrase(phrase []string) (key PrivateKey, corrected []string, err error) {
+	return km.RegenerateKeyFromPhraseContext(context.Background(), phrase, nil)
+}
+
+// RegenerateKeyFromPhraseContext is like RegenerateKeyFromPhrase, but it can be cancelled and
+// reports its progress in the same way as MakeDualKeyContext.
+func (km *KeyMaker) RegenerateKeyFromPhraseContext(ctx context.Context, phrase []string, progress func(stage string, frac float64)) (key PrivateKey, corrected []string, err error) {
+	corrected, version, err := km.fixPhrase(phrase)
+	if err != nil {
+		return nil, nil, err
 	}
+	// Checksum words only depend on the rest of the phrase, so they aren't used for the key.
 	info := km.versions.Words[version]
 	hash := sha256.New()
-	for i := range corrected {
-		hash.Write([]byte(corrected[i] + ":"))
+	for _, word := range corrected[:len(corrected)-info.ChecksumWords] {
+		hash.Write([]byte(word + ":"))
 	}
-	reader := makeFortunaReader(hash.Sum(nil))
-	dk, err = MakeDualKey(reader, info.KeyBits)
+	d := derivations[info.Derivation]
+	key, err = makeKey(ctx, d.reader(hash.Sum(nil)), info.algorithm(), info.KeyBits, d.prime, progress)
 	if err != nil {
 		return nil, nil, err
 	}
-	return dk, corrected, nil
+	return key, corrected, nil
 }
@@ -15,7 +15,7 @@ func TestKeyMaker(t *testing.T) {
 		km, err := MakeKeyMaker("words.txt", "versions_test.txt")
 		So(err, ShouldBeNil)
 		So(km, ShouldNotBeNil)
-		var keys []*DualKey
+		var keys []PrivateKey
 		var phrases [][]string
 		for i := 0; i < 3; i++ {
 			key, phrase, err := km.GenerateKeyAndPhrase(c, 128)
@@ -62,3 +62,93 @@ func TestKeyMaker(t *testing.T) {
 		})
 	})
 }
+
+func TestDefaultKeyMaker(t *testing.T) {
+	Convey("the default KeyMaker uses the embedded word lists", t, func() {
+		km := DefaultKeyMaker()
+		So(km, ShouldNotBeNil)
+		fromFiles, err := MakeMultilingualKeyMaker(testWordsPaths, "versions.txt")
+		So(err, ShouldBeNil)
+		So(km.words, ShouldResemble, fromFiles.words)
+		So(km.languages, ShouldResemble, fromFiles.languages)
+		So(km.versions, ShouldResemble, fromFiles.versions)
+		So(km.Languages(), ShouldResemble, []string{"de", "en", "es"})
+
+		english := map[string][]byte{DefaultLanguage: defaultWordsData}
+		_, err = makeKeyMaker(english, []byte("not json"))
+		So(err, ShouldNotBeNil)
+		_, err = makeKeyMaker(map[string][]byte{DefaultLanguage: []byte("onlyone")}, defaultVersionsData)
+		So(err, ShouldNotBeNil)
+		_, err = makeKeyMaker(map[string][]byte{"es": defaultWordsDataEs}, defaultVersionsData)
+		So(err, ShouldNotBeNil)
+		_, err = makeKeyMaker(map[string][]byte{DefaultLanguage: defaultWordsData, "fr": defaultWordsDataEs}, defaultVersionsData)
+		So(err, ShouldNotBeNil)
+		// Words in one language may be version words of another, but never within edit distance one
+		// of a version word of the same language.
+		_, err = makeKeyMaker(map[string][]byte{DefaultLanguage: append([]byte("nougats "), defaultWordsData...)}, defaultVersionsData)
+		So(err, ShouldNotBeNil)
+		_, err = makeKeyMaker(map[string][]byte{DefaultLanguage: defaultWordsData, "es": append([]byte("strudel "), defaultWordsDataEs...)}, defaultVersionsData)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+var testWordsPaths = map[string]string{
+	DefaultLanguage: "words.txt",
+	"es":            "words_es.txt",
+	"de":            "words_de.txt",
+}
+
+func TestMultilingualPhrases(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("phrases in any supported language regenerate their keys", t, func() {
+		km, err := MakeMultilingualKeyMaker(testWordsPaths, "versions_test.txt")
+		So(err, ShouldBeNil)
+		english, err := MakeKeyMaker("words.txt", "versions_test.txt")
+		So(err, ShouldBeNil)
+		_, err = english.InLanguage("es")
+		So(err, ShouldNotBeNil)
+
+		for _, language := range []string{"es", "de"} {
+			local, err := km.InLanguage(language)
+			So(err, ShouldBeNil)
+			So(local.Language(), ShouldEqual, language)
+			So(km.Language(), ShouldEqual, DefaultLanguage)
+			key, phrase, err := local.GenerateKeyAndPhrase(c, 128)
+			So(err, ShouldBeNil)
+			So(phrase, ShouldContain, km.versions.Languages[language])
+			for _, word := range phrase {
+				So(append(append([]string{}, km.languages[language]...), km.versions.Languages[language]), ShouldContain, word)
+			}
+			So(km.detectLanguage(phrase), ShouldEqual, language)
+
+			// The phrase is detected by the KeyMaker in any language, even with a misspelled word.
+			misspelled := append([]string{}, phrase...)
+			misspelled[0] = misspelled[0] + "x"
+			regenerated, corrected, err := km.RegenerateKeyFromPhrase(misspelled)
+			So(err, ShouldBeNil)
+			So(corrected, ShouldResemble, phrase)
+			So(regenerated.String(), ShouldEqual, key.String())
+
+			// A wrong word is fixed using the checksum words of the phrase's language.
+			wrong := append([]string{}, phrase...)
+			i := 1
+			if wrong[i] == km.versions.Languages[language] {
+				i++
+			}
+			if wrong[i] == km.languages[language][0] {
+				wrong[i] = km.languages[language][1]
+			} else {
+				wrong[i] = km.languages[language][0]
+			}
+			regenerated, corrected, err = km.RegenerateKeyFromPhrase(wrong)
+			So(err, ShouldBeNil)
+			So(corrected, ShouldResemble, phrase)
+			So(regenerated.String(), ShouldEqual, key.String())
+
+			// A KeyMaker without the language's word list can't regenerate the key.
+			_, _, err = english.RegenerateKeyFromPhrase(phrase)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package xcrypt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// primeFunc returns a random prime with the given number of bits.  rand.Prime is a primeFunc.
+type primeFunc func(random io.Reader, bits int) (*big.Int, error)
+
+// derivation describes how a key is derived from the seed encoded by a phrase.  Every derivation
+// must always produce the same key from the same seed, so once a derivation has been used in a
+// version it must never be changed.
+type derivation struct {
+	reader func(seed []byte) io.Reader
+	prime  primeFunc
+}
+
+const (
+	// derivationLegacy uses fortuna as the random source and rand.Prime to find primes.  Newer
+	// versions of Go deliberately make rand.Prime non-deterministic, so keys from versions that
+	// use this derivation can't be reliably regenerated.
+	derivationLegacy = ""
+
+	// derivationV1 uses a hashReader as the random source and findPrimeV1 to find primes, both of
+	// which are fully specified here.
+	derivationV1 = "xcrypt-1"
+)
+
+var derivations = map[string]derivation{
+	derivationLegacy: {
+		reader: func(seed []byte) io.Reader { return makeFortunaReader(seed) },
+		prime:  rand.Prime,
+	},
+	derivationV1: {
+		reader: func(seed []byte) io.Reader { return makeHashReader(seed) },
+		prime:  findPrimeV1,
+	},
+}
+
+// hashReader is a deterministic random source.  Its output is the concatenation of
+// SHA-256(seed || counter) for counter = 0, 1, 2, ..., where counter is an 8 byte big-endian
+// integer.
+type hashReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func makeHashReader(seed []byte) *hashReader {
+	return &hashReader{seed: append([]byte{}, seed...)}
+}
+
+func (r *hashReader) Read(b []byte) (n int, err error) {
+	for n < len(b) {
+		if len(r.buf) == 0 {
+			h := sha256.New()
+			h.Write(r.seed)
+			binary.Write(h, binary.BigEndian, r.counter)
+			r.counter++
+			r.buf = h.Sum(nil)
+		}
+		copied := copy(b[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// findPrimeV1MaxCandidates bounds the number of candidates findPrimeV1 tries.  Primes are dense
+// enough that it's astronomically unlikely to be reached for any reasonable size.
+const findPrimeV1MaxCandidates = 1 << 20
+
+// findPrimeV1 finds a prime with exactly bits bits by trying candidates read from random until one
+// of them is prime.  Each candidate is made as follows:
+// 1. Read (bits+7)/8 bytes from random and interpret them as a big-endian integer.
+// 2. Clear any bits above bit bits-1.
+// 3. Set bits bits-1 and bits-2, so the product of two such primes has exactly 2*bits bits.
+// 4. Set bit 0.
+// The first candidate that isPrimeV1 accepts is returned.
+func findPrimeV1(random io.Reader, bits int) (*big.Int, error) {
+	if bits < 16 {
+		return nil, fmt.Errorf("primes must have at least 16 bits")
+	}
+	buf := make([]byte, (bits+7)/8)
+	candidate := big.NewInt(0)
+	for i := 0; i < findPrimeV1MaxCandidates; i++ {
+		if _, err := io.ReadFull(random, buf); err != nil {
+			return nil, err
+		}
+		// Clear the excess bits in the first byte, then set the top two bits.
+		excess := uint(len(buf)*8 - bits)
+		buf[0] &= 0xff >> excess
+		candidate.SetBytes(buf)
+		candidate.SetBit(candidate, bits-1, 1)
+		candidate.SetBit(candidate, bits-2, 1)
+		candidate.SetBit(candidate, 0, 1)
+		if isPrimeV1(candidate) {
+			return big.NewInt(0).Set(candidate), nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find a prime in %d candidates", findPrimeV1MaxCandidates)
+}
+
+// smallPrimes are all of the primes less than 1000.  They are used for trial division and the
+// first 20 are used as Miller-Rabin bases by isPrimeV1.
+var smallPrimes = func() []int64 {
+	var primes []int64
+	for n := int64(2); n < 1000; n++ {
+		prime := true
+		for _, p := range primes {
+			if n%p == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			primes = append(primes, n)
+		}
+	}
+	return primes
+}()
+
+// isPrimeV1MillerRabinRounds is the number of Miller-Rabin rounds done by isPrimeV1.
+const isPrimeV1MillerRabinRounds = 20
+
+// isPrimeV1 reports whether n is probably prime.  Unlike big.Int.ProbablyPrime its behavior is
+// fully specified here, so it can't change between versions of Go: n is checked by trial division
+// by every prime below 1000, then by Miller-Rabin using the first 20 primes as bases.
+func isPrimeV1(n *big.Int) bool {
+	if n.Sign() <= 0 {
+		return false
+	}
+	mod := big.NewInt(0)
+	for _, p := range smallPrimes {
+		bigP := big.NewInt(p)
+		if n.Cmp(bigP) == 0 {
+			return true
+		}
+		if mod.Mod(n, bigP).Sign() == 0 {
+			return false
+		}
+	}
+	if n.Cmp(big.NewInt(1000)) < 0 {
+		// n is less than 1000 and not divisible by any prime less than 1000, so n is 1.
+		return false
+	}
+
+	// Write n-1 as d*2^s with d odd.
+	nMinusOne := big.NewInt(0).Sub(n, bigOne)
+	s := nMinusOne.TrailingZeroBits()
+	d := big.NewInt(0).Rsh(nMinusOne, s)
+	x := big.NewInt(0)
+	for _, base := range smallPrimes[:isPrimeV1MillerRabinRounds] {
+		x.Exp(big.NewInt(base), d, n)
+		if x.Cmp(bigOne) == 0 || x.Cmp(nMinusOne) == 0 {
+			continue
+		}
+		witness := true
+		for r := uint(1); r < s; r++ {
+			x.Mul(x, x).Mod(x, n)
+			if x.Cmp(nMinusOne) == 0 {
+				witness = false
+				break
+			}
+		}
+		if witness {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package xcrypt
+
+import (
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrimeSearch(t *testing.T) {
+	Convey("isPrimeV1 agrees with ProbablyPrime", t, func() {
+		for n := int64(0); n < 5000; n++ {
+			So(isPrimeV1(big.NewInt(n)), ShouldEqual, big.NewInt(n).ProbablyPrime(20))
+		}
+		c := cmwc.MakeGoodCmwc()
+		c.Seed(123456789)
+		for i := 0; i < 200; i++ {
+			n, err := findPrimeV1(c, 128)
+			So(err, ShouldBeNil)
+			So(n.ProbablyPrime(20), ShouldBeTrue)
+			So(n.BitLen(), ShouldEqual, 128)
+			// Carmichael-like composites and products of large primes must be rejected too.
+			So(isPrimeV1(big.NewInt(0).Mul(n, n)), ShouldBeFalse)
+		}
+		So(isPrimeV1(big.NewInt(561)), ShouldBeFalse)
+		So(isPrimeV1(big.NewInt(3215031751)), ShouldBeFalse)
+	})
+
+	// These known answers must never change, if they do then phrases written down by users will no
+	// longer regenerate their keys.
+	Convey("derivationV1 matches known answers", t, func() {
+		r := makeHashReader([]byte("xault"))
+		buf := make([]byte, 40)
+		n, err := r.Read(buf[:7])
+		So(n, ShouldEqual, 7)
+		So(err, ShouldBeNil)
+		_, err = r.Read(buf[7:])
+		So(err, ShouldBeNil)
+		So(hex.EncodeToString(buf), ShouldEqual, "2c0d0d6f6fa8f4a8f4189fcadd87bee317cfdc07e8aa6319b31d5b88f4d6b213a2ce4a4eb693bb56")
+
+		prime, err := findPrimeV1(makeHashReader([]byte("xault")), 256)
+		So(err, ShouldBeNil)
+		So(prime.Text(16), ShouldEqual, "f545de37ec096dc232eb4edfe814f7218424e00569ee471ef1ab6dd789b1e0e1")
+
+		km, err := MakeKeyMaker("words.txt", "versions_test.txt")
+		So(err, ShouldBeNil)
+		for phrase, fingerprint := range map[string]string{
+			"nougat lizard wallaby albatross alpaca parrot alligator badger beaver bighorn bison buffalo goose": "22b1cc9def975826bb36b3b28557d0adf2dd6f586aac330851975686ebf185ed",
+			"elliptic egret squirrel fox lemming elephant tortoise lion panther puma tiger jackal turkey":       "f9ccf53893b398124acb89086e12ce4adb9073917b6c92dbedf979a95b343ce8",
+
+			// Phrases from versions with checksum words end with them.
+			"oreo lizard wallaby albatross alpaca parrot alligator badger beaver bighorn bison buffalo goose cleave lark magenta dolphin": "3aafb197cb7a4d0a341c5a73f513f800e7330203f48fbe7785883170735536ec",
+		} {
+			key, _, err := km.RegenerateKeyFromPhrase(strings.Fields(phrase))
+			So(err, ShouldBeNil)
+			pub, err := key.Public()
+			So(err, ShouldBeNil)
+			So(hex.EncodeToString(pub.Fingerprint()), ShouldEqual, fingerprint)
+		}
+	})
+}
@@ -1,17 +1,15 @@
 package xcrypt
 
 import (
-	"bytes"
+	"context"
 	"crypto"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 )
 
@@ -34,11 +32,15 @@ func (dk *DualKey) String() string {
 	return string(data)
 }
 
+// DualKeyFromString parses a key produced by String() and validates it.
 func DualKeyFromString(str string) (*DualKey, error) {
 	var dk DualKey
 	if err := json.Unmarshal([]byte(str), &dk); err != nil {
 		return nil, err
 	}
+	if err := dk.Validate(); err != nil {
+		return nil, err
+	}
 	return &dk, nil
 }
 
@@ -57,11 +59,15 @@ func (dpk *DualPublicKey) String() string {
 	return string(data)
 }
 
+// DualPublicKeyFromString parses a key produced by String() and validates it.
 func DualPublicKeyFromString(str string) (*DualPublicKey, error) {
 	var dpk DualPublicKey
 	if err := json.Unmarshal([]byte(str), &dpk); err != nil {
 		return nil, err
 	}
+	if err := dpk.Validate(); err != nil {
+		return nil, err
+	}
 	return &dpk, nil
 }
 
@@ -87,17 +93,63 @@ func (dpk *DualPublicKey) GetRSAVerificationKey() *rsa.PublicKey {
 	return &rsa.PublicKey{E: dpk.E1, N: dpk.N}
 }
 
+// Stages reported to the progress function passed to MakeDualKeyContext.
+const (
+	// StagePrimes is reported each time a prime is found, frac is the fraction of the primes
+	// needed for a key that have been found so far.  Occasionally a pair of primes can't be used,
+	// in which case more primes are needed and frac stays at 1 until the key is done.
+	StagePrimes = "primes"
+
+	// StageDone is reported once, with frac 1, when the key is complete.
+	StageDone = "done"
+)
+
 // MakeDualKey creates an RSA pair with two exponents, so that one set of keys can encrypt and sign
 // safely because each gets its own exponent.
 func MakeDualKey(random io.Reader, bits int) (*DualKey, error) {
+	return MakeDualKeyContext(context.Background(), random, bits, nil)
+}
+
+// MakeDualKeyContext is like MakeDualKey, but it stops early and returns ctx.Err() if ctx is
+// cancelled, and it reports its progress to progress, if it isn't nil.  Finding primes is most of
+// the work of making a key, so progress is reported each time a prime is found.
+func MakeDualKeyContext(ctx context.Context, random io.Reader, bits int, progress func(stage string, frac float64)) (*DualKey, error) {
+	return makeDualKey(ctx, random, bits, rand.Prime, progress)
+}
+
+// makeDualKey makes a DualKey from primes found by findPrime.  As long as findPrime is
+// deterministic, so is makeDualKey.
+func makeDualKey(ctx context.Context, random io.Reader, bits int, findPrime primeFunc, progress func(stage string, frac float64)) (*DualKey, error) {
 	if bits%2 == 1 || bits < 128 {
 		return nil, fmt.Errorf("bits must be even and greater than 128")
 	}
+	if progress == nil {
+		progress = func(string, float64) {}
+	}
+
+	// findPrime reads from random for every candidate it tries, so reading through ctxReader means
+	// that we usually stop shortly after ctx is cancelled, but ctx is also checked before and after
+	// each prime so that cancelling doesn't depend on how random is used.
+	random = &ctxReader{ctx: ctx, r: random}
+	makePrime := func(primes []*big.Int) (*big.Int, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		prime, err := findPrime(random, bits/2)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		progress(StagePrimes, math.Min(1, float64(len(primes)+1)/2))
+		return prime, nil
+	}
 
 	// We might generate a couple of primes that don't work on the first try, so we keep them around
 	// for future attempts with new primes to avoid doing more primaily tests than we need to.
 	var primes []*big.Int
-	if prime, err := rand.Prime(random, bits/2); err != nil {
+	if prime, err := makePrime(primes); err != nil {
 		return nil, err
 	} else {
 		primes = append(primes, prime)
@@ -105,7 +157,10 @@ func MakeDualKey(random io.Reader, bits int) (*DualKey, error) {
 	// Make a prime, then try pairing it with any prime in primes to make a valid RSA key with two
 	// exponents.  If that isn't possible then add that prime to primes and repeat.
 	for sanity := 10; sanity > 0; sanity-- {
-		Q, err := rand.Prime(random, bits/2)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		Q, err := makePrime(primes)
 		if err != nil {
 			return nil, err
 		}
@@ -115,7 +170,7 @@ func MakeDualKey(random io.Reader, bits int) (*DualKey, error) {
 			}
 			N := big.NewInt(0).Mul(P, Q)
 			if N.BitLen() != bits {
-				// We did our math wrong, or the behavior of rand.Prime() has changed.
+				// We did our math wrong, or the behavior of findPrime() has changed.
 				continue
 			}
 			pMinusOne := big.NewInt(0).Sub(P, bigOne)
@@ -147,6 +202,7 @@ func MakeDualKey(random io.Reader, bits int) (*DualKey, error) {
 					P:  P,
 					Q:  Q,
 				}
+				progress(StageDone, 1)
 				return dk, nil
 			}
 		}
@@ -165,6 +221,9 @@ func (dk *DualKey) makeRSAKey(D *big.Int) *rsa.PrivateKey {
 	totient := big.NewInt(0).Mul(pMinusOne, qMinusOne)
 	e := big.NewInt(0)
 	big.NewInt(0).GCD(e, big.NewInt(0), pk.D, totient)
+	if e.Sign() < 0 {
+		e.Add(e, totient)
+	}
 	pk.E = int(e.Int64())
 	pk.Precompute()
 	return &pk
@@ -184,148 +243,95 @@ func (dk *DualKey) GetRSASigniatureKey() *rsa.PrivateKey {
 	return dk.sigKey
 }
 
-// Encrypts a large plaintext by using RSA encryption to encrypt a one-time-key that is used as an
-// AES-256 key to encrypt the plaintext.  The encrypted key, ciphertext, and info are also signed.
-// Format of the final envelope is:
-// L3, 4 bytes, length of signiature
-// L0, 4 bytes, length of internal info
-// L1, 4 bytes, length of encrypted otk
-// L2, 4 bytes, length of ciphertext
-// internal info, L0 bytes
-// encrypted otk, L1 bytes
-// ciphertext, L2 bytes
-// signiature, L3 bytes, the signiature covers everything from L0 through the ciphertext
-func (dk *DualKey) SealEnvelope(random io.Reader, dst *DualPublicKey, plaintext []byte) (envelope []byte, err error) {
-	info := []byte("version 1") // Not sure what to do with this for now
-
-	// otk is a one-time-key, it will only ever be used to encrypt this plaintext
-	otk := make([]byte, 32)
-	if n, err := random.Read(otk); n != len(otk) || err != nil {
-		return nil, fmt.Errorf("unable to read enough random bytes to make a otk: %v", err)
-	}
-	block, err := aes.NewCipher(otk)
-	if err != nil {
-		fmt.Errorf("unable to make cipher: %v\n", err)
-		return
+// Zero overwrites the private values of dk, and of the rsa keys made from them, with zeroes so that
+// they don't linger in memory after the key is done with.  dk can't be used afterwards.  Go's rsa
+// package keeps some precomputed values of its own that can't be reached from here, so this only
+// zeroes what it can.
+func (dk *DualKey) Zero() {
+	for _, pk := range []*rsa.PrivateKey{dk.encKey, dk.sigKey} {
+		if pk == nil {
+			continue
+		}
+		zeroInt(pk.D)
+		for _, prime := range pk.Primes {
+			zeroInt(prime)
+		}
+		zeroInt(pk.Precomputed.Dp)
+		zeroInt(pk.Precomputed.Dq)
+		zeroInt(pk.Precomputed.Qinv)
+		for _, crt := range pk.Precomputed.CRTValues {
+			zeroInt(crt.Exp)
+			zeroInt(crt.Coeff)
+			zeroInt(crt.R)
+		}
 	}
-	// Pad the plaintext by adding a 1, then adding 0s until the length is a multiple of blocks.
-	plaintext = append(plaintext, 1)
-	for len(plaintext)%block.BlockSize() != 0 {
-		plaintext = append(plaintext, 0)
+	for _, n := range []*big.Int{dk.D0, dk.D1, dk.P, dk.Q} {
+		zeroInt(n)
 	}
+	dk.encKey = nil
+	dk.sigKey = nil
+}
 
-	// Notice that the IV here is all zeroes, this is ok because this otk will never be used again.
-	ciphertext := make([]byte, len(plaintext))
-	cipher.NewCBCEncrypter(block, make([]byte, block.BlockSize())).CryptBlocks(ciphertext, plaintext)
-
-	// Now encrypt the otk with the recipient's encryption key
-	encryptedOtk, err := rsa.EncryptOAEP(sha256.New(), random, dst.GetRSAEncryptionKey(), otk, []byte("otk"))
-	if err != nil {
-		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
+// zeroInt overwrites the backing array of n with zeroes and sets n to zero.
+func zeroInt(n *big.Int) {
+	if n == nil {
+		return
 	}
-	for i := range otk {
-		otk[i] = 0
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
 	}
+	n.SetInt64(0)
+}
 
-	// Start the buffer with 4 empty bytes, we'll fill these in later with the length of the signiature
-	buf := bytes.NewBuffer(make([]byte, 4))
-	chunks := [][]byte{info, encryptedOtk, ciphertext}
-	for _, chunk := range chunks {
-		if err := binary.Write(buf, binary.LittleEndian, uint32(len(chunk))); err != nil {
-			return nil, fmt.Errorf("unable to finish writing the envelope")
-		}
-	}
-	for _, chunk := range chunks {
-		if n, err := buf.Write(chunk); n != len(chunk) || err != nil {
-			return nil, fmt.Errorf("unable to finish writing the envelope")
-		}
-	}
+// Algorithm returns AlgorithmDualRSA.
+func (dk *DualKey) Algorithm() string {
+	return AlgorithmDualRSA
+}
 
-	// Now we hash and sign the envelope that we have so far so that it can't be tampered with.
-	h := sha256.Sum256(buf.Bytes()[4:])
-	signiature, err := rsa.SignPKCS1v15(random, dk.GetRSASigniatureKey(), crypto.SHA256, h[:])
+// Public is the same as MakePublicKey, but it returns a PublicKey.
+func (dk *DualKey) Public() (PublicKey, error) {
+	dpk, err := dk.MakePublicKey()
 	if err != nil {
-		return nil, fmt.Errorf("unable to sign envelope: %v", err)
-	}
-	if n, err := buf.Write(signiature); n != len(signiature) || err != nil {
-		return nil, fmt.Errorf("unable to sign envelope: %v", err)
+		return nil, err
 	}
-	envelope = buf.Bytes()
-	buf.Truncate(0)
-	binary.Write(buf, binary.LittleEndian, uint32(len(signiature)))
-
-	return envelope, nil
+	return dpk, nil
 }
 
-var ErrUnableToVerify = fmt.Errorf("unable to verify envelope")
-var ErrVerifiedBufMalformed = fmt.Errorf("envelope verified, but contents are malformed")
-
-// OpenEnvelope opens an envelope created with SealEnvelope.  It verifies that the message is signed
-// by src, then decrypts it using the enclosed key.
-func (dk *DualKey) OpenEnvelope(random io.Reader, src *DualPublicKey, envelope []byte) (plaintext []byte, err error) {
-	if len(envelope) < 32 {
-		return nil, ErrUnableToVerify
-	}
+func (dk *DualKey) signDigest(random io.Reader, digest []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(random, dk.GetRSASigniatureKey(), crypto.SHA256, digest)
+}
 
-	// Strip off the length of the signiature from the front of the envelope
-	var siglen uint32
-	if err := binary.Read(bytes.NewBuffer(envelope[0:4]), binary.LittleEndian, &siglen); err != nil {
-		return nil, ErrUnableToVerify
-	}
-	envelope = envelope[4:]
-	if int(siglen) > len(envelope)+24 {
-		return nil, ErrUnableToVerify
-	}
-	// Strip the signiature itself off the back of the envelope
-	sig := envelope[len(envelope)-int(siglen):]
-	envelope = envelope[0 : len(envelope)-int(siglen)]
-	h := sha256.Sum256(envelope)
-	if err := rsa.VerifyPKCS1v15(src.GetRSAVerificationKey(), crypto.SHA256, h[:], sig); err != nil {
-		return nil, ErrUnableToVerify
-	}
+func (dk *DualKey) decryptOtk(random io.Reader, encryptedOtk []byte) ([]byte, error) {
+	return rsa.DecryptOAEP(sha256.New(), random, dk.GetRSADecryptionKey(), encryptedOtk, []byte("otk"))
+}
 
-	// We can now trust that the envelope is from who we thought it was from.
-	var infoLen, eotkLen, cipherLen uint32
-	buf := bytes.NewBuffer(envelope)
-	for _, val := range []*uint32{&infoLen, &eotkLen, &cipherLen} {
-		if err := binary.Read(buf, binary.LittleEndian, val); err != nil {
-			return nil, ErrVerifiedBufMalformed
-		}
-	}
-	if int64(infoLen)+int64(eotkLen)+int64(cipherLen) != int64(len(buf.Bytes())) {
-		return nil, ErrVerifiedBufMalformed
-	}
+// Algorithm returns AlgorithmDualRSA.
+func (dpk *DualPublicKey) Algorithm() string {
+	return AlgorithmDualRSA
+}
 
-	info := make([]byte, int(infoLen))
-	eotk := make([]byte, int(eotkLen))
-	ciphertext := make([]byte, int(cipherLen))
-	for _, chunk := range [][]byte{info, eotk, ciphertext} {
-		if n, err := buf.Read(chunk); n != len(chunk) || err != nil {
-			return nil, ErrVerifiedBufMalformed
-		}
-	}
+func (dpk *DualPublicKey) verifyDigest(digest, sig []byte) error {
+	return rsa.VerifyPKCS1v15(dpk.GetRSAVerificationKey(), crypto.SHA256, digest, sig)
+}
 
-	otk, err := rsa.DecryptOAEP(sha256.New(), random, dk.GetRSADecryptionKey(), eotk, []byte("otk"))
+func (dpk *DualPublicKey) encryptOtk(random io.Reader, otk []byte) ([]byte, error) {
+	encryptedOtk, err := rsa.EncryptOAEP(sha256.New(), random, dpk.GetRSAEncryptionKey(), otk, []byte("otk"))
 	if err != nil {
-		return nil, ErrVerifiedBufMalformed
+		return nil, fmt.Errorf("unable to encrypt otk: %v", err)
 	}
+	return encryptedOtk, nil
+}
 
-	block, err := aes.NewCipher(otk)
-	if err != nil {
-		return nil, ErrVerifiedBufMalformed
-	}
-	plaintext = ciphertext
-	cipher.NewCBCDecrypter(block, make([]byte, block.BlockSize())).CryptBlocks(plaintext, ciphertext)
-	for len(plaintext) > 0 {
-		b := plaintext[len(plaintext)-1]
-		plaintext = plaintext[0 : len(plaintext)-1]
-		if b == 1 {
-			break
-		}
-		if b != 0 {
-			return nil, ErrVerifiedBufMalformed
-		}
-	}
+// ctxReader reads from r until ctx is cancelled, after which every read fails.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	return plaintext, nil
+func (cr *ctxReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
 }
@@ -1,9 +1,13 @@
 package xcrypt
 
 import (
+	"context"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/binary"
 	"testing"
 
 	"github.com/runningwild/cmwc"
@@ -60,6 +64,31 @@ func TestDualKeys(t *testing.T) {
 	})
 }
 
+func TestMakeDualKeyContext(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("making dual keys reports progress and can be cancelled", t, func() {
+		var stages []string
+		var fracs []float64
+		progress := func(stage string, frac float64) {
+			stages = append(stages, stage)
+			fracs = append(fracs, frac)
+		}
+		dk, err := MakeDualKeyContext(context.Background(), c, 1024, progress)
+		So(err, ShouldBeNil)
+		So(dk.Validate(), ShouldBeNil)
+		So(stages[0], ShouldEqual, StagePrimes)
+		So(fracs[0], ShouldEqual, 0.5)
+		So(stages[len(stages)-1], ShouldEqual, StageDone)
+		So(fracs[len(fracs)-1], ShouldEqual, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = MakeDualKeyContext(ctx, c, 1024, progress)
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
+
 func TestEnvelope(t *testing.T) {
 	c := cmwc.MakeGoodCmwc()
 	c.Seed(123456789)
@@ -103,10 +132,151 @@ func TestEnvelope(t *testing.T) {
 			_, err = localPrivate.OpenEnvelope(c, remotePublic, envelope)
 			So(err, ShouldEqual, ErrUnableToVerify)
 			envelope[50]--
+
+			// Shouldn't be able to verify if the signiature is longer than the envelope.
+			for _, siglen := range []uint32{uint32(len(envelope)), uint32(len(envelope)) + 20, 1 << 31, 1<<32 - 1} {
+				short := append([]byte(nil), envelope[0:40]...)
+				binary.LittleEndian.PutUint32(short, siglen)
+				_, err = localPrivate.OpenEnvelope(c, remotePublic, short)
+				So(err, ShouldEqual, ErrUnableToVerify)
+			}
+		})
+
+		Convey("envelopes sealed with version 1 can still be opened", func() {
+			envelope, err := sealEnvelope(c, remotePrivate, []PublicKey{localPublic}, envelopeV1, encryptV1, plaintext)
+			So(err, ShouldBeNil)
+			decoded, err := localPrivate.OpenEnvelope(c, remotePublic, envelope)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, plaintext)
+		})
+
+		Convey("version 2 ciphertext is authenticated even if the signiature is valid", func() {
+			corrupt := func(otk, ad, plaintext []byte) ([]byte, error) {
+				ciphertext, err := encryptV2(otk, ad, plaintext)
+				ciphertext[0]++
+				return ciphertext, err
+			}
+			envelope, err := sealEnvelope(c, remotePrivate, []PublicKey{localPublic}, envelopeV2, corrupt, plaintext)
+			So(err, ShouldBeNil)
+			_, err = localPrivate.OpenEnvelope(c, remotePublic, envelope)
+			So(err, ShouldEqual, ErrVerifiedBufMalformed)
+		})
+
+		Convey("the additional data can't be split differently", func() {
+			So(envelopeAdditionalData([]byte("ab"), []byte("c")), ShouldNotResemble, envelopeAdditionalData([]byte("a"), []byte("bc")))
+		})
+
+		Convey("envelopes with an unknown version are rejected", func() {
+			envelope, err := sealEnvelope(c, remotePrivate, []PublicKey{localPublic}, "version 0", encryptV2, plaintext)
+			So(err, ShouldBeNil)
+			_, err = localPrivate.OpenEnvelope(c, remotePublic, envelope)
+			So(err, ShouldEqual, ErrUnknownEnvelopeVersion)
+		})
+	})
+}
+
+func FuzzOpenEnvelope(f *testing.F) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	local, err := MakeDualKey(c, 1024)
+	if err != nil {
+		f.Fatal(err)
+	}
+	localPublic, err := local.MakePublicKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	remote, err := MakeDualKey(c, 1024)
+	if err != nil {
+		f.Fatal(err)
+	}
+	remotePublic, err := remote.MakePublicKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	envelope, err := remote.SealEnvelope(c, localPublic, []byte("fuzz"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(envelope)
+	f.Add(envelope[0:32])
+	f.Add(append([]byte{255, 255, 255, 255}, envelope[4:40]...))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, envelope []byte) {
+		// Malformed envelopes should fail to open, but they must never panic.
+		local.OpenEnvelope(c, remotePublic, envelope)
+	})
+}
+
+func TestMultiEnvelope(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	keySize := 2048
+	Convey("dualKeys can seal an envelope for several recipients at once", t, func() {
+		sender, err := MakeDualKey(c, keySize)
+		So(err, ShouldBeNil)
+		senderPublic, err := sender.MakePublicKey()
+		So(err, ShouldBeNil)
+		var recipients []*DualKey
+		var recipientsPublic []PublicKey
+		for i := 0; i < 3; i++ {
+			recipient, err := MakeDualKey(c, keySize)
+			So(err, ShouldBeNil)
+			recipientPublic, err := recipient.MakePublicKey()
+			So(err, ShouldBeNil)
+			recipients = append(recipients, recipient)
+			recipientsPublic = append(recipientsPublic, recipientPublic)
+		}
+
+		plaintext := []byte("this is some awesome plaintext for the whole group")
+		envelope, err := sender.SealEnvelopeMulti(c, recipientsPublic, plaintext)
+		So(err, ShouldBeNil)
+		for _, recipient := range recipients {
+			decoded, err := recipient.OpenEnvelope(c, senderPublic, envelope)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, plaintext)
+		}
+
+		Convey("the ciphertext is only stored once", func() {
+			big := make([]byte, 1<<16)
+			single, err := sender.SealEnvelope(c, recipientsPublic[0], big)
+			So(err, ShouldBeNil)
+			multi, err := sender.SealEnvelopeMulti(c, recipientsPublic, big)
+			So(err, ShouldBeNil)
+			So(len(multi), ShouldBeLessThan, len(single)+len(big)/2)
+		})
+
+		Convey("keys that weren't recipients can't open it", func() {
+			other, err := MakeDualKey(c, keySize)
+			So(err, ShouldBeNil)
+			_, err = other.OpenEnvelope(c, senderPublic, envelope)
+			So(err, ShouldEqual, ErrNotARecipient)
+		})
+
+		Convey("at least one recipient is required", func() {
+			_, err := sender.SealEnvelopeMulti(c, nil, plaintext)
+			So(err, ShouldNotBeNil)
 		})
 	})
 }
 
+// encryptV1 is how envelopes were encrypted before version 2, it's only kept around to check that
+// those envelopes can still be opened.
+func encryptV1(otk, ad, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(otk)
+	if err != nil {
+		return nil, err
+	}
+	// Pad the plaintext by adding a 1, then adding 0s until the length is a multiple of blocks.
+	padded := append(append([]byte{}, plaintext...), 1)
+	for len(padded)%block.BlockSize() != 0 {
+		padded = append(padded, 0)
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, block.BlockSize())).CryptBlocks(ciphertext, padded)
+	return ciphertext, nil
+}
+
 func benchmarkSealEnvelope(msgSize, keySize int, b *testing.B) {
 	b.StopTimer()
 	c := cmwc.MakeGoodCmwc()
@@ -0,0 +1,134 @@
+package xcrypt
+
+import (
+	"fmt"
+	"io"
+)
+
+// Shamir secret sharing over GF(256).  Each byte of the secret is the constant term of its own
+// random polynomial of degree threshold-1, and each share is the value of every polynomial at one
+// point.  Any threshold shares determine the polynomials, and so the secret, but fewer shares say
+// nothing at all about it.
+//
+// A share is the x coordinate of its point followed by one y coordinate for each byte of the secret.
+// Shares aren't authenticated, so combining a wrong or tampered share silently gives the wrong
+// secret.  Callers should seal shares with SealEnvelope and check the secret they get back.
+
+var (
+	ErrTooFewShares       = fmt.Errorf("not enough shares to recover the secret")
+	ErrSharesMismatched   = fmt.Errorf("shares are not all from the same secret")
+	ErrShareMalformed     = fmt.Errorf("share is malformed")
+	ErrDuplicateShare     = fmt.Errorf("the same share was given more than once")
+	ErrBadShareParameters = fmt.Errorf("shares must have 2 <= threshold <= n <= 255")
+)
+
+// gf256Exp and gf256Log are exponent and logarithm tables for GF(256) with the AES polynomial,
+// x^8 + x^4 + x^3 + x + 1, using 3 as the generator.  gf256Exp is doubled in length so that the sum
+// of two logarithms can be looked up without reducing it first.
+var gf256Exp, gf256Log = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// Multiply x by 3, which is x*2 + x, reducing by the AES polynomial if needed.
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+	return exp, log
+}()
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+int(gf256Log[b])]
+}
+
+func gf256Div(a, b byte) byte {
+	if b == 0 {
+		panic("division by zero in GF(256)")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+255-int(gf256Log[b])]
+}
+
+// SplitSecret splits secret into n shares, any threshold of which can be given to CombineShares to
+// recover it.
+func SplitSecret(random io.Reader, secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, ErrBadShareParameters
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret must not be empty")
+	}
+	// coefficients[i] holds the coefficients of x^(i+1) for every byte of the secret, the constant
+	// terms are the secret itself.
+	coefficients := make([][]byte, threshold-1)
+	for i := range coefficients {
+		coefficients[i] = make([]byte, len(secret))
+		if _, err := io.ReadFull(random, coefficients[i]); err != nil {
+			return nil, fmt.Errorf("unable to make shares: %v", err)
+		}
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret)+1)
+		share[0] = x
+		for j := range secret {
+			// Horner's method, starting from the highest coefficient.
+			var y byte
+			for k := len(coefficients) - 1; k >= 0; k-- {
+				y = gf256Mul(y^coefficients[k][j], x)
+			}
+			share[j+1] = y ^ secret[j]
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// CombineShares recovers a secret from shares made by SplitSecret.  It must be given at least as
+// many shares as the threshold they were made with, but it has no way to check that, with fewer
+// shares it just returns the wrong secret.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) < 2 || share[0] == 0 {
+			return nil, ErrShareMalformed
+		}
+		if len(share) != len(shares[0]) {
+			return nil, ErrSharesMismatched
+		}
+		if seen[share[0]] {
+			return nil, ErrDuplicateShare
+		}
+		seen[share[0]] = true
+	}
+
+	// Lagrange interpolation at x = 0.  In GF(256) subtraction is the same as addition, xor.
+	secret := make([]byte, len(shares[0])-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gf256Mul(basis, gf256Div(other[0], other[0]^share[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gf256Mul(basis, share[k+1])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,78 @@
+package xcrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShamir(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+
+	Convey("GF(256) multiplication and division agree", t, func() {
+		So(gf256Mul(0x53, 0xca), ShouldEqual, 0x01)
+		So(gf256Mul(0x57, 0x83), ShouldEqual, 0xc1)
+		for a := 1; a < 256; a++ {
+			for b := 1; b < 256; b++ {
+				if gf256Div(gf256Mul(byte(a), byte(b)), byte(b)) != byte(a) {
+					So(gf256Div(gf256Mul(byte(a), byte(b)), byte(b)), ShouldEqual, byte(a))
+				}
+			}
+		}
+	})
+
+	Convey("any threshold shares recover the secret", t, func() {
+		secret := []byte("this is the secret that is being shared")
+		shares, err := SplitSecret(c, secret, 5, 3)
+		So(err, ShouldBeNil)
+		So(len(shares), ShouldEqual, 5)
+		for _, share := range shares {
+			So(len(share), ShouldEqual, len(secret)+1)
+		}
+		for i := range shares {
+			for j := i + 1; j < len(shares); j++ {
+				for k := j + 1; k < len(shares); k++ {
+					recovered, err := CombineShares([][]byte{shares[k], shares[i], shares[j]})
+					So(err, ShouldBeNil)
+					So(recovered, ShouldResemble, secret)
+
+					// Fewer shares than the threshold give the wrong secret.
+					recovered, err = CombineShares([][]byte{shares[i], shares[j]})
+					So(err, ShouldBeNil)
+					So(bytes.Equal(recovered, secret), ShouldBeFalse)
+				}
+			}
+		}
+		recovered, err := CombineShares(shares)
+		So(err, ShouldBeNil)
+		So(recovered, ShouldResemble, secret)
+
+		_, err = CombineShares(shares[:1])
+		So(err, ShouldEqual, ErrTooFewShares)
+		_, err = CombineShares([][]byte{shares[0], shares[0], shares[1]})
+		So(err, ShouldEqual, ErrDuplicateShare)
+		_, err = CombineShares([][]byte{shares[0], shares[1][:10]})
+		So(err, ShouldEqual, ErrSharesMismatched)
+		_, err = CombineShares([][]byte{shares[0], append([]byte{0}, shares[1][1:]...)})
+		So(err, ShouldEqual, ErrShareMalformed)
+	})
+
+	Convey("share parameters are checked", t, func() {
+		_, err := SplitSecret(c, []byte("secret"), 3, 1)
+		So(err, ShouldEqual, ErrBadShareParameters)
+		_, err = SplitSecret(c, []byte("secret"), 3, 4)
+		So(err, ShouldEqual, ErrBadShareParameters)
+		_, err = SplitSecret(c, []byte("secret"), 256, 2)
+		So(err, ShouldEqual, ErrBadShareParameters)
+		_, err = SplitSecret(c, nil, 3, 2)
+		So(err, ShouldNotBeNil)
+		shares, err := SplitSecret(c, []byte("secret"), 255, 255)
+		So(err, ShouldBeNil)
+		recovered, err := CombineShares(shares)
+		So(err, ShouldBeNil)
+		So(string(recovered), ShouldEqual, "secret")
+	})
+}
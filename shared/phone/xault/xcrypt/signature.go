@@ -0,0 +1,160 @@
+package xcrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// signatureV1 is the info at the start of every detached signature made by Sign.
+	signatureV1 = "signature 1"
+
+	// signatureHash is the name of the only hash function that is currently used to digest signed
+	// data.
+	signatureHash = "SHA-256"
+)
+
+var ErrSignatureMalformed = fmt.Errorf("signature is malformed")
+var ErrWrongSigner = fmt.Errorf("signature was not made by this key")
+var ErrBadSignature = fmt.Errorf("signature is not valid")
+
+// Signature describes a detached signature made by Sign.
+type Signature struct {
+	// Fingerprint identifies the key that made the signature.
+	Fingerprint []byte
+
+	// Hash is the name of the hash function used to digest the signed data.
+	Hash string
+
+	// Time is when the signature was made, according to the signer.
+	Time time.Time
+
+	// Context is an optional string that says what the signature is for, so that a signature made
+	// for one purpose can't be passed off as one made for another.
+	Context string
+
+	// sig is the signiature itself, made with the signing key's algorithm.
+	sig []byte
+}
+
+// Sign makes a detached signature of data that can be verified with the corresponding public key's
+// Verify.  The signature describes itself, it contains the fingerprint of the signing key, the
+// hash used, the time it was made, and context, which may be empty.
+// Format of the signature is:
+// L0, 4 bytes, length of info
+// info, L0 bytes
+// L1, 4 bytes, length of the fingerprint of the signing key
+// fingerprint, L1 bytes
+// L2, 4 bytes, length of the name of the hash function
+// hash name, L2 bytes
+// L3, 4 bytes, length of the timestamp
+// timestamp, L3 bytes, nanoseconds since the unix epoch
+// L4, 4 bytes, length of the context
+// context, L4 bytes
+// L5, 4 bytes, length of the signiature
+// signiature, L5 bytes, covers everything from L0 through the context followed by the hash of data
+// All lengths and the timestamp are little-endian.
+func (dk *DualKey) Sign(random io.Reader, data []byte, context string) ([]byte, error) {
+	return sign(random, dk, data, context)
+}
+
+// Verify checks that sig is a signature of data made by Sign with the private half of dpk.  If it
+// is, the details of the signature are returned so that the caller can check its time and context.
+func (dpk *DualPublicKey) Verify(data, sig []byte) (*Signature, error) {
+	return verify(dpk, data, sig)
+}
+
+func sign(random io.Reader, key PrivateKey, data []byte, context string) ([]byte, error) {
+	pub, err := key.Public()
+	if err != nil {
+		return nil, err
+	}
+	s := Signature{
+		Fingerprint: pub.Fingerprint(),
+		Hash:        signatureHash,
+		Time:        time.Now(),
+		Context:     context,
+	}
+	header := s.header()
+	sig, err := key.signDigest(random, signatureDigest(header, data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign: %v", err)
+	}
+	buf := bytes.NewBuffer(header)
+	writeSignatureChunk(buf, sig)
+	return buf.Bytes(), nil
+}
+
+func verify(pub PublicKey, data, sig []byte) (*Signature, error) {
+	s, err := ParseSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(s.Fingerprint, pub.Fingerprint()) {
+		return nil, ErrWrongSigner
+	}
+	if s.Hash != signatureHash {
+		return nil, fmt.Errorf("unsupported hash function %q", s.Hash)
+	}
+	digest := signatureDigest(s.header(), data)
+	if err := pub.verifyDigest(digest, s.sig); err != nil {
+		return nil, ErrBadSignature
+	}
+	return s, nil
+}
+
+// ParseSignature parses a signature made by Sign without verifying it.  This can be used to find
+// out which key made a signature, but none of the returned values should be trusted until the
+// signature has been verified.
+func ParseSignature(sig []byte) (*Signature, error) {
+	buf := bytes.NewBuffer(sig)
+	var chunks [][]byte
+	for i := 0; i < 6; i++ {
+		var length uint32
+		if err := binary.Read(buf, binary.LittleEndian, &length); err != nil || int(length) > buf.Len() {
+			return nil, ErrSignatureMalformed
+		}
+		chunks = append(chunks, buf.Next(int(length)))
+	}
+	if buf.Len() != 0 || string(chunks[0]) != signatureV1 || len(chunks[3]) != 8 {
+		return nil, ErrSignatureMalformed
+	}
+	nanos := int64(binary.LittleEndian.Uint64(chunks[3]))
+	return &Signature{
+		Fingerprint: chunks[1],
+		Hash:        string(chunks[2]),
+		Time:        time.Unix(0, nanos),
+		Context:     string(chunks[4]),
+		sig:         chunks[5],
+	}, nil
+}
+
+// header returns everything in the encoded signature that precedes the signiature itself.
+func (s *Signature) header() []byte {
+	var buf bytes.Buffer
+	timestamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestamp, uint64(s.Time.UnixNano()))
+	for _, chunk := range [][]byte{[]byte(signatureV1), s.Fingerprint, []byte(s.Hash), timestamp, []byte(s.Context)} {
+		writeSignatureChunk(&buf, chunk)
+	}
+	return buf.Bytes()
+}
+
+func writeSignatureChunk(buf *bytes.Buffer, chunk []byte) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(chunk)))
+	buf.Write(chunk)
+}
+
+// signatureDigest returns the value that is actually signed, which covers both the header of the
+// signature and the data.
+func signatureDigest(header, data []byte) []byte {
+	hashed := sha256.Sum256(data)
+	h := sha256.New()
+	h.Write(header)
+	h.Write(hashed[:])
+	return h.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package xcrypt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSignature(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("dualKeys can make detached signatures", t, func() {
+		dk, err := MakeDualKey(c, 2048)
+		So(err, ShouldBeNil)
+		dpk, err := dk.MakePublicKey()
+		So(err, ShouldBeNil)
+
+		data := []byte("I agree to whatever this is")
+		before := time.Now()
+		sig, err := dk.Sign(c, data, "contract")
+		So(err, ShouldBeNil)
+		s, err := dpk.Verify(data, sig)
+		So(err, ShouldBeNil)
+		So(s.Context, ShouldEqual, "contract")
+		So(s.Hash, ShouldEqual, "SHA-256")
+		So(s.Fingerprint, ShouldResemble, dpk.Fingerprint())
+		So(s.Time.Before(before), ShouldBeFalse)
+		So(s.Time.After(time.Now()), ShouldBeFalse)
+
+		Convey("the signer can be found without verifying", func() {
+			s, err := ParseSignature(sig)
+			So(err, ShouldBeNil)
+			So(s.Fingerprint, ShouldResemble, dpk.Fingerprint())
+		})
+
+		Convey("signatures don't verify with the wrong key", func() {
+			other, err := MakeDualKey(c, 2048)
+			So(err, ShouldBeNil)
+			otherPublic, err := other.MakePublicKey()
+			So(err, ShouldBeNil)
+			_, err = otherPublic.Verify(data, sig)
+			So(err, ShouldEqual, ErrWrongSigner)
+		})
+
+		Convey("signatures don't verify if the data or signature is changed", func() {
+			_, err := dpk.Verify([]byte("I agree to nothing"), sig)
+			So(err, ShouldEqual, ErrBadSignature)
+
+			// Changing the context or the signiature itself should fail.
+			for _, i := range []int{len(sig) - 264, len(sig) - 1} {
+				sig[i]++
+				_, err := dpk.Verify(data, sig)
+				So(err, ShouldEqual, ErrBadSignature)
+				sig[i]--
+			}
+
+			_, err = dpk.Verify(data, sig[1:])
+			So(err, ShouldEqual, ErrSignatureMalformed)
+			_, err = dpk.Verify(data, append(sig, 0))
+			So(err, ShouldEqual, ErrSignatureMalformed)
+		})
+	})
+}
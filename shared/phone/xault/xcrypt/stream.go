@@ -0,0 +1,269 @@
+package xcrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// streamV1 is the info used by streaming envelopes.  It's distinct from the info used by
+	// regular envelopes so that one can't be mistaken for the other.
+	streamV1 = "stream 1"
+
+	// streamSegmentSize is the maximum amount of plaintext in a single segment.  This bounds the
+	// amount of memory needed to seal or open a stream.
+	streamSegmentSize = 64 << 10
+
+	// streamMaxHeaderChunk is the largest info, encrypted otk, or signiature that OpenEnvelopeStream
+	// will read, so that a bogus length can't make us allocate an arbitrary amount of memory.
+	streamMaxHeaderChunk = 64 << 10
+
+	streamSegmentMore  = 0
+	streamSegmentFinal = 1
+)
+
+// SealEnvelopeStream is like SealEnvelope, but it reads the plaintext from r and writes the
+// envelope to w a segment at a time, so that the plaintext never needs to be in memory all at once.
+// Format of the stream is:
+// L0, 4 bytes, length of internal info
+// L1, 4 bytes, length of encrypted otk
+// internal info, L0 bytes
+// encrypted otk, L1 bytes
+// L2, 4 bytes, length of the header signiature
+// header signiature, L2 bytes, covers everything from L0 through the encrypted otk
+// Then any number of segments, the last of which is marked as final, each of which is:
+// flag, 1 byte, streamSegmentFinal on the last segment, streamSegmentMore otherwise
+// L3, 4 bytes, length of the encrypted segment
+// encrypted segment, L3 bytes, at most streamSegmentSize bytes of plaintext sealed with AES-256-GCM
+// using the segment number as the nonce and the flag as additional data
+// And finally:
+// L4, 4 bytes, length of the final signiature
+// final signiature, L4 bytes, covers everything from L0 through the last segment
+// All lengths are little-endian.
+func (dk *DualKey) SealEnvelopeStream(random io.Reader, dst PublicKey, r io.Reader, w io.Writer) error {
+	return sealEnvelopeStream(random, dk, dst, r, w)
+}
+
+// OpenEnvelopeStream opens an envelope created with SealEnvelopeStream, reading it from r and
+// writing the plaintext to w as each segment is verified.  The header is verified against src
+// before anything is decrypted, and every segment is authenticated before it is written, but the
+// final signiature can only be checked once the whole stream has been read.  If this returns an
+// error then anything already written to w should be discarded.
+func (dk *DualKey) OpenEnvelopeStream(random io.Reader, src PublicKey, r io.Reader, w io.Writer) error {
+	return openEnvelopeStream(random, dk, src, r, w)
+}
+
+func sealEnvelopeStream(random io.Reader, key PrivateKey, dst PublicKey, r io.Reader, w io.Writer) error {
+	otk, err := makeOtk(random)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(otk)
+	encryptedOtk, err := dst.encryptOtk(random, otk)
+	if err != nil {
+		return err
+	}
+	gcm, err := newEnvelopeGCM(otk)
+	if err != nil {
+		return err
+	}
+
+	// Everything we write goes through running, so that it can be signed at the end.
+	running := sha256.New()
+	out := io.MultiWriter(w, running)
+
+	var header bytes.Buffer
+	info := []byte(streamV1)
+	for _, chunk := range [][]byte{info, encryptedOtk} {
+		binary.Write(&header, binary.LittleEndian, uint32(len(chunk)))
+	}
+	header.Write(info)
+	header.Write(encryptedOtk)
+	h := sha256.Sum256(header.Bytes())
+	headerSig, err := key.signDigest(random, h[:])
+	if err != nil {
+		return fmt.Errorf("unable to sign envelope: %v", err)
+	}
+	binary.Write(&header, binary.LittleEndian, uint32(len(headerSig)))
+	header.Write(headerSig)
+	if _, err := out.Write(header.Bytes()); err != nil {
+		return fmt.Errorf("unable to write envelope: %v", err)
+	}
+
+	in := bufio.NewReaderSize(r, streamSegmentSize)
+	plaintext := make([]byte, streamSegmentSize)
+	var ciphertext []byte
+	for segment := uint64(0); ; segment++ {
+		n, err := io.ReadFull(in, plaintext)
+		flag := byte(streamSegmentMore)
+		switch err {
+		case nil:
+			// We read a full segment, it's only the last one if there's nothing after it.
+			if _, err := in.Peek(1); err == io.EOF {
+				flag = streamSegmentFinal
+			} else if err != nil {
+				return fmt.Errorf("unable to read plaintext: %v", err)
+			}
+		case io.EOF, io.ErrUnexpectedEOF:
+			flag = streamSegmentFinal
+		default:
+			return fmt.Errorf("unable to read plaintext: %v", err)
+		}
+		ciphertext = gcm.Seal(ciphertext[:0], streamNonce(gcm, segment), plaintext[:n], []byte{flag})
+		zeroBytes(plaintext[:n])
+		if err := writeStreamSegment(out, flag, ciphertext); err != nil {
+			return fmt.Errorf("unable to write envelope: %v", err)
+		}
+		if flag == streamSegmentFinal {
+			break
+		}
+	}
+
+	sig, err := key.signDigest(random, running.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("unable to sign envelope: %v", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(sig))); err != nil {
+		return fmt.Errorf("unable to write envelope: %v", err)
+	}
+	if _, err := w.Write(sig); err != nil {
+		return fmt.Errorf("unable to write envelope: %v", err)
+	}
+	return nil
+}
+
+func openEnvelopeStream(random io.Reader, key PrivateKey, src PublicKey, r io.Reader, w io.Writer) error {
+	// Everything but the final signiature is read through running so that it can be verified at
+	// the end.
+	running := sha256.New()
+	br := bufio.NewReader(r)
+	in := io.TeeReader(br, running)
+
+	var infoLen, eotkLen uint32
+	for _, val := range []*uint32{&infoLen, &eotkLen} {
+		if err := binary.Read(in, binary.LittleEndian, val); err != nil {
+			return ErrUnableToVerify
+		}
+	}
+	info, err := readStreamChunk(in, infoLen)
+	if err != nil {
+		return err
+	}
+	eotk, err := readStreamChunk(in, eotkLen)
+	if err != nil {
+		return err
+	}
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, infoLen)
+	binary.Write(&header, binary.LittleEndian, eotkLen)
+	header.Write(info)
+	header.Write(eotk)
+	h := sha256.Sum256(header.Bytes())
+	if err := verifyStreamSig(in, src, h[:]); err != nil {
+		return err
+	}
+
+	// We can now trust that the header is from who we thought it was from, and since only they
+	// could have encrypted the otk every segment that decrypts correctly is from them as well.
+	if string(info) != streamV1 {
+		return ErrUnknownEnvelopeVersion
+	}
+	otk, err := key.decryptOtk(random, eotk)
+	if err != nil {
+		return ErrVerifiedBufMalformed
+	}
+	defer zeroBytes(otk)
+	gcm, err := newEnvelopeGCM(otk)
+	if err != nil {
+		return ErrVerifiedBufMalformed
+	}
+
+	var ciphertext, plaintext []byte
+	for segment := uint64(0); ; segment++ {
+		var flag byte
+		var segmentLen uint32
+		if err := binary.Read(in, binary.LittleEndian, &flag); err != nil {
+			return ErrUnableToVerify
+		}
+		if err := binary.Read(in, binary.LittleEndian, &segmentLen); err != nil {
+			return ErrUnableToVerify
+		}
+		if int(segmentLen) > streamSegmentSize+gcm.Overhead() {
+			return ErrUnableToVerify
+		}
+		if cap(ciphertext) < int(segmentLen) {
+			ciphertext = make([]byte, int(segmentLen))
+		}
+		ciphertext = ciphertext[:int(segmentLen)]
+		if _, err := io.ReadFull(in, ciphertext); err != nil {
+			return ErrUnableToVerify
+		}
+		plaintext, err = gcm.Open(plaintext[:0], streamNonce(gcm, segment), ciphertext, []byte{flag})
+		if err != nil {
+			return ErrUnableToVerify
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return fmt.Errorf("unable to write plaintext: %v", err)
+		}
+		zeroBytes(plaintext)
+		if flag == streamSegmentFinal {
+			break
+		}
+	}
+
+	// The final signiature isn't covered by the running hash, so it's read directly from br.
+	return verifyStreamSig(br, src, running.Sum(nil))
+}
+
+// verifyStreamSig reads a length-prefixed signiature from r and verifies that it is src's
+// signiature of hashed.
+func verifyStreamSig(r io.Reader, src PublicKey, hashed []byte) error {
+	var sigLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &sigLen); err != nil {
+		return ErrUnableToVerify
+	}
+	sig, err := readStreamChunk(r, sigLen)
+	if err != nil {
+		return err
+	}
+	if err := src.verifyDigest(hashed, sig); err != nil {
+		return ErrUnableToVerify
+	}
+	return nil
+}
+
+func readStreamChunk(r io.Reader, length uint32) ([]byte, error) {
+	if length > streamMaxHeaderChunk {
+		return nil, ErrUnableToVerify
+	}
+	chunk := make([]byte, int(length))
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, ErrUnableToVerify
+	}
+	return chunk, nil
+}
+
+func writeStreamSegment(w io.Writer, flag byte, ciphertext []byte) error {
+	if _, err := w.Write([]byte{flag}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(ciphertext))); err != nil {
+		return err
+	}
+	_, err := w.Write(ciphertext)
+	return err
+}
+
+// streamNonce returns the nonce for the given segment.  Every segment of a stream has a distinct
+// nonce, so segments can't be reordered, and the otk is never used for another stream, so nonces
+// never repeat for the same key.
+func streamNonce(gcm cipher.AEAD, segment uint64) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce, segment)
+	return nonce
+}
@@ -0,0 +1,74 @@
+package xcrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnvelopeStream(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	keySize := 2048
+	Convey("dualKeys can be used to seal and open streaming envelopes", t, func() {
+		localPrivate, err := MakeDualKey(c, keySize)
+		So(err, ShouldBeNil)
+		localPublic, err := localPrivate.MakePublicKey()
+		So(err, ShouldBeNil)
+		remotePrivate, err := MakeDualKey(c, keySize)
+		So(err, ShouldBeNil)
+		remotePublic, err := remotePrivate.MakePublicKey()
+		So(err, ShouldBeNil)
+
+		for _, size := range []int{0, 1, streamSegmentSize - 1, streamSegmentSize, 3*streamSegmentSize + 100} {
+			plaintext := make([]byte, size)
+			c.Read(plaintext)
+			var envelope bytes.Buffer
+			So(remotePrivate.SealEnvelopeStream(c, localPublic, bytes.NewReader(plaintext), &envelope), ShouldBeNil)
+			var decoded bytes.Buffer
+			So(localPrivate.OpenEnvelopeStream(c, remotePublic, &envelope, &decoded), ShouldBeNil)
+			So(bytes.Equal(decoded.Bytes(), plaintext), ShouldBeTrue)
+		}
+
+		plaintext := make([]byte, 2*streamSegmentSize+10)
+		c.Read(plaintext)
+		var buf bytes.Buffer
+		So(remotePrivate.SealEnvelopeStream(c, localPublic, bytes.NewReader(plaintext), &buf), ShouldBeNil)
+		envelope := buf.Bytes()
+
+		Convey("open envelope stream doesn't open malformed inputs", func() {
+			otherPrivate, err := MakeDualKey(c, keySize)
+			So(err, ShouldBeNil)
+			otherPublic, err := otherPrivate.MakePublicKey()
+			So(err, ShouldBeNil)
+
+			// Shouldn't be able to verify with the wrong public key.
+			var decoded bytes.Buffer
+			err = localPrivate.OpenEnvelopeStream(c, otherPublic, bytes.NewReader(envelope), &decoded)
+			So(err, ShouldEqual, ErrUnableToVerify)
+			So(decoded.Len(), ShouldEqual, 0)
+
+			// Shouldn't be able to verify if the stream is truncated, even at a segment boundary.
+			for _, n := range []int{1, 100, len(envelope) - len(plaintext)} {
+				err := localPrivate.OpenEnvelopeStream(c, remotePublic, bytes.NewReader(envelope[:len(envelope)-n]), &bytes.Buffer{})
+				So(err, ShouldEqual, ErrUnableToVerify)
+			}
+
+			// Shouldn't be able to verify if a byte is corrupted, whether it's in the header, a
+			// segment, or the final signiature.
+			for _, i := range []int{50, len(envelope) / 2, len(envelope) - 1} {
+				envelope[i]++
+				err := localPrivate.OpenEnvelopeStream(c, remotePublic, bytes.NewReader(envelope), &bytes.Buffer{})
+				So(err, ShouldEqual, ErrUnableToVerify)
+				envelope[i]--
+			}
+		})
+
+		Convey("streaming envelopes can't be opened as regular envelopes", func() {
+			_, err := localPrivate.OpenEnvelope(c, remotePublic, envelope)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
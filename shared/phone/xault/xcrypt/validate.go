@@ -0,0 +1,103 @@
+package xcrypt
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// MinKeyBits and MaxKeyBits bound the size of the modulus of any key that Validate accepts.
+	MinKeyBits = 1024
+	MaxKeyBits = 16384
+
+	// maxExponent bounds public exponents.  MakeDualKey only ever uses very small exponents, but
+	// anything that fits in an int32 is usable by crypto/rsa.
+	maxExponent = 1<<31 - 1
+)
+
+// Validate checks that dpk looks like a usable key: its modulus is odd, composite, and of a
+// reasonable size, and its exponents are distinct and valid RSA exponents.  Keys that come from
+// anywhere other than MakePublicKey should be validated before they are used.
+func (dpk *DualPublicKey) Validate() error {
+	if dpk.N == nil {
+		return fmt.Errorf("key is missing its modulus")
+	}
+	if err := validateModulusSize(dpk.N); err != nil {
+		return err
+	}
+	if dpk.N.Bit(0) == 0 || dpk.N.ProbablyPrime(0) {
+		return fmt.Errorf("modulus is not the product of two odd primes")
+	}
+	for _, e := range []int{dpk.E0, dpk.E1} {
+		if e < 3 || e > maxExponent || e%2 == 0 {
+			return fmt.Errorf("%d is not a valid public exponent", e)
+		}
+	}
+	if dpk.E0 == dpk.E1 {
+		return fmt.Errorf("encryption and verification exponents must be different")
+	}
+	return nil
+}
+
+// Validate checks that dk is a usable key: P and Q are distinct primes whose product is of a
+// reasonable size, and D0 and D1 are both valid private exponents for that modulus that correspond
+// to distinct public exponents.
+func (dk *DualKey) Validate() error {
+	for _, val := range []*big.Int{dk.P, dk.Q, dk.D0, dk.D1} {
+		if val == nil || val.Sign() <= 0 {
+			return fmt.Errorf("key is missing values")
+		}
+	}
+	if dk.P.Cmp(dk.Q) == 0 {
+		return fmt.Errorf("P and Q must be different")
+	}
+	for _, prime := range []*big.Int{dk.P, dk.Q} {
+		if !prime.ProbablyPrime(20) {
+			return fmt.Errorf("P and Q must be prime")
+		}
+	}
+	N := big.NewInt(0).Mul(dk.P, dk.Q)
+	if err := validateModulusSize(N); err != nil {
+		return err
+	}
+	pMinusOne := big.NewInt(0).Sub(dk.P, bigOne)
+	qMinusOne := big.NewInt(0).Sub(dk.Q, bigOne)
+	totient := big.NewInt(0).Mul(pMinusOne, qMinusOne)
+	var E []int64
+	for _, D := range []*big.Int{dk.D0, dk.D1} {
+		// This is the same as what makeRSAKey does, but we need to check that the result is sane
+		// before trusting it.
+		e := big.NewInt(0)
+		if big.NewInt(0).GCD(e, big.NewInt(0), D, totient).Cmp(bigOne) != 0 {
+			return fmt.Errorf("private exponent is not coprime with the totient")
+		}
+		if e.Sign() < 0 {
+			e.Add(e, totient)
+		}
+		if e.Cmp(big.NewInt(3)) < 0 || e.Cmp(big.NewInt(maxExponent)) > 0 {
+			return fmt.Errorf("private exponent does not correspond to a valid public exponent")
+		}
+		E = append(E, e.Int64())
+	}
+	if E[0] == E[1] {
+		return fmt.Errorf("encryption and signiature exponents must be different")
+	}
+
+	// Finally let crypto/rsa check that N == P*Q and that each exponent pair is consistent.  This
+	// uses a copy of dk so that nothing is cached in dk if it turns out to be invalid.
+	fresh := &DualKey{P: dk.P, Q: dk.Q, D0: dk.D0, D1: dk.D1}
+	for _, key := range []*rsa.PrivateKey{fresh.GetRSADecryptionKey(), fresh.GetRSASigniatureKey()} {
+		if err := key.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateModulusSize(N *big.Int) error {
+	if bits := N.BitLen(); bits < MinKeyBits || bits > MaxKeyBits {
+		return fmt.Errorf("modulus has %d bits, it must have between %d and %d", bits, MinKeyBits, MaxKeyBits)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package xcrypt
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/runningwild/cmwc"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+	c := cmwc.MakeGoodCmwc()
+	c.Seed(123456789)
+	Convey("generated keys are valid", t, func() {
+		dk, err := MakeDualKey(c, 1024)
+		So(err, ShouldBeNil)
+		So(dk.Validate(), ShouldBeNil)
+		dpk, err := dk.MakePublicKey()
+		So(err, ShouldBeNil)
+		So(dpk.Validate(), ShouldBeNil)
+
+		Convey("malformed public keys are invalid", func() {
+			for _, bad := range []DualPublicKey{
+				{E0: dpk.E0, E1: dpk.E1},
+				{N: dpk.N, E0: dpk.E0, E1: dpk.E0},
+				{N: dpk.N, E0: dpk.E0, E1: 4},
+				{N: dpk.N, E0: 1, E1: dpk.E1},
+				{N: big.NewInt(0).Add(dpk.N, bigOne), E0: dpk.E0, E1: dpk.E1},
+				{N: dk.P, E0: dpk.E0, E1: dpk.E1},
+				{N: big.NewInt(15), E0: dpk.E0, E1: dpk.E1},
+			} {
+				So(bad.Validate(), ShouldNotBeNil)
+				_, err := DualPublicKeyFromString(bad.String())
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("malformed private keys are invalid", func() {
+			notPrime := big.NewInt(0).Add(dk.P, bigOne)
+			for _, bad := range []DualKey{
+				{P: dk.P, Q: dk.Q, D0: dk.D0},
+				{P: dk.P, Q: dk.P, D0: dk.D0, D1: dk.D1},
+				{P: notPrime, Q: dk.Q, D0: dk.D0, D1: dk.D1},
+				{P: dk.P, Q: dk.Q, D0: dk.D0, D1: dk.D0},
+				{P: dk.P, Q: dk.Q, D0: dk.D0, D1: big.NewInt(2)},
+				{P: dk.P, Q: dk.Q, D0: dk.D0, D1: big.NewInt(0).Add(dk.D1, bigOne)},
+			} {
+				So(bad.Validate(), ShouldNotBeNil)
+				_, err := DualKeyFromString(bad.String())
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("keys that are too small are invalid", func() {
+			small, err := MakeDualKey(c, 512)
+			So(err, ShouldBeNil)
+			So(small.Validate(), ShouldNotBeNil)
+		})
+	})
+}
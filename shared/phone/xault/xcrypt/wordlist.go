@@ -0,0 +1,252 @@
+package xcrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// EditDistance computes the edit distance between a and b, where adding, deleting, or changing a
+// character costs 1 and swapping two adjacent characters also costs 1.  Characters are bytes, so
+// words should be ASCII.
+func EditDistance(a, b string) int {
+	// Only the last three rows of the table are needed: two for swaps and one for everything else.
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			best := prev[j-1] + cost
+			if d := prev[j] + 1; d < best {
+				best = d
+			}
+			if d := cur[j-1] + 1; d < best {
+				best = d
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if d := prev2[j-2] + 1; d < best {
+					best = d
+				}
+			}
+			cur[j] = best
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// MinEditDistance returns the smallest edit distance between any two of words, along with every
+// word that is that close to another word.  If there are fewer than two words it returns -1.
+func MinEditDistance(words []string) ([]string, int) {
+	return findWorstCaseWords(words)
+}
+
+func findWorstCaseWords(words []string) ([]string, int) {
+	// The edit distance between two words is at least the difference in their lengths, so with the
+	// words sorted by length most pairs never need to be compared.
+	sorted := append([]string{}, words...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) < len(sorted[j]) })
+	worst := -1
+	closest := make(map[string]bool)
+	for i, a := range sorted {
+		for _, b := range sorted[i+1:] {
+			if worst != -1 && len(b)-len(a) > worst {
+				break
+			}
+			ed := EditDistance(a, b)
+			if worst == -1 || ed < worst {
+				worst = ed
+				closest = make(map[string]bool)
+			}
+			if ed == worst {
+				closest[a] = true
+				closest[b] = true
+			}
+		}
+	}
+	var result []string
+	for word := range closest {
+		result = append(result, word)
+	}
+	sort.Strings(result)
+	return result, worst
+}
+
+// legacyClosePairs are the pairs of words in words.txt that are only edit distance one apart.  A bug
+// in an old version of the edit distance calculation hid them, and they can't be removed now because
+// existing phrases use them, so CheckWordDistances allows these pairs, and only these pairs.
+var legacyClosePairs = [][2]string{
+	{"arrow", "yarrow"},
+	{"back", "black"},
+	{"coast", "coat"},
+	{"money", "monkey"},
+	{"pie", "pike"},
+}
+
+// KnownClosePairs returns the pairs of words in words that are closer than edit distance two but
+// are allowed to be, because existing phrases already use them.
+func KnownClosePairs(words []string) [][2]string {
+	present := make(map[string]bool)
+	for _, word := range words {
+		present[word] = true
+	}
+	var pairs [][2]string
+	for _, pair := range legacyClosePairs {
+		if present[pair[0]] && present[pair[1]] {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// CheckWordDistances checks that every pair of words has edit distance of more than one, apart from
+// the pairs returned by KnownClosePairs.
+func CheckWordDistances(words []string) error {
+	// partners maps the second word of each legacy pair to the first.  The second words are left
+	// out of the main check, then checked against everything except their partner.
+	partners := make(map[string]string)
+	for _, pair := range KnownClosePairs(words) {
+		partners[pair[1]] = pair[0]
+	}
+	var checked []string
+	for _, word := range words {
+		if _, ok := partners[word]; !ok {
+			checked = append(checked, word)
+		}
+	}
+	if worst, dist := findWorstCaseWords(checked); dist >= 0 && dist <= 1 {
+		return fmt.Errorf("these words have edit distance one or less: %v", worst)
+	}
+	for word, partner := range partners {
+		for _, other := range words {
+			if other != word && other != partner && EditDistance(word, other) <= 1 {
+				return fmt.Errorf("these words have edit distance one or less: %v", []string{word, other})
+			}
+		}
+	}
+	return nil
+}
+
+// SelectWords chooses a subset of candidates such that every pair of chosen words has edit distance
+// at least minDistance, and every chosen word has edit distance at least minDistance from every word
+// in exclude.  Duplicate candidates are ignored.  The subset is maximal, no other candidate could be
+// added to it, and words that conflict with fewer other candidates are chosen first so that it's
+// usually much larger than what taking the candidates in order would give.  Ties go to the earlier
+// candidate, and the chosen words are returned in the same order as candidates.
+func SelectWords(candidates, exclude []string, minDistance int) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range candidates {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		excluded := false
+		for _, other := range exclude {
+			if EditDistance(word, other) < minDistance {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			words = append(words, word)
+		}
+	}
+
+	// conflicts[i] lists every word that is too close to words[i].  As with findWorstCaseWords,
+	// only words with similar lengths need to be compared.
+	conflicts := make([][]int, len(words))
+	order := make([]int, len(words))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return len(words[order[i]]) < len(words[order[j]]) })
+	for x, i := range order {
+		for _, j := range order[x+1:] {
+			if len(words[j])-len(words[i]) >= minDistance {
+				break
+			}
+			if EditDistance(words[i], words[j]) < minDistance {
+				conflicts[i] = append(conflicts[i], j)
+				conflicts[j] = append(conflicts[j], i)
+			}
+		}
+	}
+
+	// Repeatedly choose the remaining word with the fewest remaining conflicts, then remove it and
+	// everything that conflicts with it.
+	removed := make([]bool, len(words))
+	chosen := make([]bool, len(words))
+	degree := make([]int, len(words))
+	for i := range words {
+		degree[i] = len(conflicts[i])
+	}
+	remove := func(i int) {
+		removed[i] = true
+		for _, j := range conflicts[i] {
+			degree[j]--
+		}
+	}
+	for {
+		best := -1
+		for i := range words {
+			if !removed[i] && (best == -1 || degree[i] < degree[best]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+		chosen[best] = true
+		remove(best)
+		for _, j := range conflicts[best] {
+			if !removed[j] {
+				remove(j)
+			}
+		}
+	}
+
+	var selected []string
+	for i, word := range words {
+		if chosen[i] {
+			selected = append(selected, word)
+		}
+	}
+	return selected
+}
+
+// VersionWords returns every version word that km knows about, in every language, in sorted order.
+func (km *KeyMaker) VersionWords() []string {
+	return km.versions.words()
+}
+
+// ReadVersionWords returns every version word in the versions file at path, in sorted order.
+func ReadVersionWords(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read versions file %q: %v", path, err)
+	}
+	var vs versions
+	if err := json.Unmarshal(data, &vs); err != nil {
+		return nil, fmt.Errorf("unable to parse versions file %q: %v", path, err)
+	}
+	return vs.words(), nil
+}
+
+func (vs *versions) words() []string {
+	var words []string
+	for word := range vs.Words {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
@@ -0,0 +1,99 @@
+package xcrypt
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEditDistance(t *testing.T) {
+	Convey("edit distance counts additions, deletions, changes, and swaps", t, func() {
+		for _, test := range []struct {
+			a, b string
+			dist int
+		}{
+			{"", "", 0},
+			{"", "abc", 3},
+			{"lion", "lion", 0},
+			{"back", "black", 1},
+			{"black", "back", 1},
+			{"coat", "coast", 1},
+			{"lion", "loin", 1},
+			{"lion", "lien", 1},
+			{"kitten", "sitting", 3},
+			{"ca", "abc", 3},
+			{"badger", "beaver", 3},
+		} {
+			So(EditDistance(test.a, test.b), ShouldEqual, test.dist)
+			So(EditDistance(test.b, test.a), ShouldEqual, test.dist)
+		}
+	})
+
+	Convey("MinEditDistance finds every word that is too close to another", t, func() {
+		words, dist := MinEditDistance([]string{"lion", "tiger", "loin", "lien", "badger"})
+		So(dist, ShouldEqual, 1)
+		So(words, ShouldResemble, []string{"lien", "lion", "loin"})
+		_, dist = MinEditDistance([]string{"lion"})
+		So(dist, ShouldEqual, -1)
+	})
+
+	Convey("only the legacy pairs are allowed to be close", t, func() {
+		So(CheckWordDistances([]string{"pie", "pike", "lion"}), ShouldBeNil)
+		So(CheckWordDistances([]string{"pie", "pike", "bike"}), ShouldNotBeNil)
+		So(CheckWordDistances([]string{"pike", "lion", "loin"}), ShouldNotBeNil)
+		So(CheckWordDistances([]string{"pie", "lion", "pig"}), ShouldNotBeNil)
+		So(KnownClosePairs([]string{"pie", "pike", "lion", "back"}), ShouldResemble, [][2]string{{"pie", "pike"}})
+	})
+}
+
+func TestSelectWords(t *testing.T) {
+	Convey("selected words are far enough apart", t, func() {
+		candidates := strings.Fields(string(defaultWordsDataEs) + " " + string(defaultWordsDataDe))
+		exclude := []string{"lion", "tiger", "strudel"}
+		for _, minDistance := range []int{2, 3} {
+			words := SelectWords(candidates, exclude, minDistance)
+			So(len(words), ShouldBeGreaterThan, 500)
+			_, dist := MinEditDistance(words)
+			So(dist, ShouldBeGreaterThanOrEqualTo, minDistance)
+			chosen := make(map[string]bool)
+			for _, word := range words {
+				chosen[word] = true
+				for _, other := range exclude {
+					So(EditDistance(word, other), ShouldBeGreaterThanOrEqualTo, minDistance)
+				}
+			}
+
+			// The selection is maximal, every candidate that wasn't chosen is too close to something.
+			for _, candidate := range candidates {
+				if chosen[candidate] {
+					continue
+				}
+				close := false
+				for _, other := range append(append([]string{}, words...), exclude...) {
+					if EditDistance(candidate, other) < minDistance {
+						close = true
+						break
+					}
+				}
+				So(close, ShouldBeTrue)
+			}
+		}
+	})
+
+	Convey("words that conflict with fewer others are chosen first", t, func() {
+		// Taking these in order would choose only "lion", but "loin" and "lien" don't conflict.
+		So(SelectWords([]string{"lion", "loin", "lien", "lion"}, nil, 2), ShouldResemble, []string{"loin", "lien"})
+		So(SelectWords([]string{"lion", "loin", "lien"}, []string{"lied"}, 2), ShouldResemble, []string{"lion"})
+	})
+
+	Convey("version words can be read from a versions file", t, func() {
+		words, err := ReadVersionWords("versions.txt")
+		So(err, ShouldBeNil)
+		So(words, ShouldResemble, DefaultKeyMaker().VersionWords())
+		So(words, ShouldContain, "nougat")
+		So(words, ShouldContain, "churro")
+		_, err = ReadVersionWords("words.txt")
+		So(err, ShouldNotBeNil)
+	})
+}